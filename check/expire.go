@@ -0,0 +1,33 @@
+package check
+
+import (
+	"context"
+	"fisco/build/payment"
+	"fmt"
+	"github.com/chislab/go-fiscobcos/common"
+	"github.com/urfave/cli/v2"
+	"math/big"
+)
+
+// ExpireOrders 触发Payment合约处理已超时的订单，任何账户都可以调用
+func ExpireOrders(ctx *cli.Context) error {
+	if !common.IsHexAddress(ctx.String("payment")) {
+		return fmt.Errorf("invalid payment contract address %s", ctx.String("payment"))
+	}
+	height, err := GethCli.BlockNumber(context.Background())
+	if err != nil {
+		return err
+	}
+	auth := NewAuthFromPriKey(height)
+	if key := ctx.String("key"); key != "" {
+		auth = NewAuthFromPriKey(height, key)
+	}
+	contract, err := payment.NewPayment(common.HexToAddress(ctx.String("payment")), GethCli)
+	if err != nil {
+		return err
+	}
+	tx, err := contract.ExpireOrders(auth, big.NewInt(ctx.Int64("limit")))
+	checkTx(tx, err)
+	fmt.Println("expireOrders tx", tx.Hash().String())
+	return nil
+}
@@ -92,6 +92,8 @@ func deloyContracts() {
 	checkTx(tx, err)
 	tx, err = paymentContract.SetMaterialProducer(paymentAdmin, materialAddr)
 	checkTx(tx, err)
+	tx, err = materialContract.SetProduceContract(accessAdmin, produceAddr)
+	checkTx(tx, err)
 }
 
 func initKeys() {
@@ -144,14 +146,14 @@ func TestFull(ctx *cli.Context) error {
 	checkTx(tx, err)
 
 	// 普通用户下产品订单
-	tx, err = paymentContract.MakeOrder(customAuth, false, pProducerAdmins[0].From, str2Big("TV"), big.NewInt(5), big.NewInt(3000))
+	tx, err = paymentContract.MakeOrder(customAuth, false, pProducerAdmins[0].From, str2Big("TV"), big.NewInt(5), big.NewInt(3000), big.NewInt(0))
 	checkTx(tx, err)
 	// 产品厂家下原材料订单
-	tx, err = paymentContract.MakeOrder(pProducerAdmins[0], true, mProducerAdmins[0].From, str2Big("LCD"), big.NewInt(100), big.NewInt(100))
+	tx, err = paymentContract.MakeOrder(pProducerAdmins[0], true, mProducerAdmins[0].From, str2Big("LCD"), big.NewInt(100), big.NewInt(100), big.NewInt(0))
 	checkTx(tx, err)
-	tx, err = paymentContract.MakeOrder(pProducerAdmins[0], true, mProducerAdmins[1].From, str2Big("Audio"), big.NewInt(100), big.NewInt(50))
+	tx, err = paymentContract.MakeOrder(pProducerAdmins[0], true, mProducerAdmins[1].From, str2Big("Audio"), big.NewInt(100), big.NewInt(50), big.NewInt(0))
 	checkTx(tx, err)
-	tx, err = paymentContract.MakeOrder(pProducerAdmins[0], true, mProducerAdmins[2].From, str2Big("CPU"), big.NewInt(100), big.NewInt(200))
+	tx, err = paymentContract.MakeOrder(pProducerAdmins[0], true, mProducerAdmins[2].From, str2Big("CPU"), big.NewInt(100), big.NewInt(200), big.NewInt(0))
 	checkTx(tx, err)
 
 	// 检查原料, 如果数量充足, 就进行订单确认，但是这里假定订单数量都不充足。进行生产后交付。理应检查原件
@@ -163,12 +165,20 @@ func TestFull(ctx *cli.Context) error {
 	tx, err = materialContract.NewMaterial(mProducerAdmins[2], str2Big("CPU"), big.NewInt(300), str2Big("CPU_1"))
 	checkTx(tx, err)
 
+	// 原料厂家接单并发货
+	for i, auth := range mProducerAdmins {
+		tx, err = paymentContract.AcceptOrder(auth, big.NewInt(int64(i*2)))
+		checkTx(tx, err)
+		tx, err = paymentContract.ShipOrder(auth, big.NewInt(int64(i*2)), big.NewInt(0))
+		checkTx(tx, err)
+	}
+
 	// 生产厂家确认原料订单
-	tx, err = paymentContract.ConfirmOrder(pProducerAdmins[0], big.NewInt(0)) // LCD=
+	tx, err = paymentContract.ConfirmOrder(pProducerAdmins[0], big.NewInt(0), big.NewInt(0)) // LCD=
 	checkTx(tx, err)
-	tx, err = paymentContract.ConfirmOrder(pProducerAdmins[0], big.NewInt(2)) // Audio
+	tx, err = paymentContract.ConfirmOrder(pProducerAdmins[0], big.NewInt(2), big.NewInt(0)) // Audio
 	checkTx(tx, err)
-	tx, err = paymentContract.ConfirmOrder(pProducerAdmins[0], big.NewInt(4)) // CPU
+	tx, err = paymentContract.ConfirmOrder(pProducerAdmins[0], big.NewInt(4), big.NewInt(0)) // CPU
 	checkTx(tx, err)
 
 	// 进行产品生产
@@ -188,7 +198,12 @@ func TestFull(ctx *cli.Context) error {
 		checkTx(tx, err)
 	}
 
-	tx, err = paymentContract.ConfirmOrder(customAuth, big.NewInt(1))
+	// 产品厂家接单发货后，普通用户确认收货
+	tx, err = paymentContract.AcceptOrder(pProducerAdmins[0], big.NewInt(1))
+	checkTx(tx, err)
+	tx, err = paymentContract.ShipOrder(pProducerAdmins[0], big.NewInt(1), big.NewInt(0))
+	checkTx(tx, err)
+	tx, err = paymentContract.ConfirmOrder(customAuth, big.NewInt(1), big.NewInt(0))
 	checkTx(tx, err)
 
 	return nil
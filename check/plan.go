@@ -0,0 +1,215 @@
+package check
+
+import (
+	"fisco/build/material"
+	"fisco/build/payment"
+	"fisco/build/produce"
+	"fmt"
+	"github.com/chislab/go-fiscobcos/accounts/abi/bind"
+	"github.com/chislab/go-fiscobcos/common"
+	"github.com/urfave/cli/v2"
+	"math/big"
+	"sort"
+)
+
+// 最多展开的子部件层数，与Produce合约的MAX_TRACE_DEPTH一致
+const maxPlanDepth = 8
+
+// 每次查询的产品订单ID个数
+const planPageSize = 100
+
+// planner 计算生产计划时的状态，合约中的类型都是uint256，按十进制字符串作为map的key
+type planner struct {
+	opts      *bind.CallOpts
+	producer  common.Address
+	produce   *produce.Produce
+	avail     map[string]*big.Int // 还可以使用的产品库存
+	toProduce map[string]*big.Int
+	required  map[string]*big.Int
+	noBOM     []string
+}
+
+// Plan 汇总producer未完成的产品订单，扣除产品库存后按物料清单展开，打印物料缺口，
+// 指定--draft时按--supplier和物料的默认生产者中的最低报价打印物料订单草稿
+func Plan(ctx *cli.Context) error {
+	for _, name := range []string{"payment", "produce", "material", "producer"} {
+		if !common.IsHexAddress(ctx.String(name)) {
+			return fmt.Errorf("invalid %s address %s", name, ctx.String(name))
+		}
+	}
+	producer := common.HexToAddress(ctx.String("producer"))
+	// getMyProducts和getMyMaterial按msg.sender查询
+	opts := &bind.CallOpts{GroupId: callOpts.GroupId, From: producer}
+	paymentC, err := payment.NewPayment(common.HexToAddress(ctx.String("payment")), GethCli)
+	if err != nil {
+		return err
+	}
+	produceC, err := produce.NewProduce(common.HexToAddress(ctx.String("produce")), GethCli)
+	if err != nil {
+		return err
+	}
+	materialC, err := material.NewMaterial(common.HexToAddress(ctx.String("material")), GethCli)
+	if err != nil {
+		return err
+	}
+
+	// 分页读取producer收到的产品订单
+	demand := make(map[string]*big.Int)
+	count, err := paymentC.ProductOrderCount(opts, producer)
+	if err != nil {
+		return err
+	}
+	limit := big.NewInt(planPageSize)
+	for offset := new(big.Int); offset.Cmp(count) < 0; offset.Add(offset, limit) {
+		ids, err := paymentC.ProductOrderIDs(opts, producer, offset, limit)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			order, err := paymentC.GetOrder(opts, id)
+			if err != nil {
+				return err
+			}
+			if order.Status != 0 && order.Status != 3 && order.Status != 4 {
+				continue
+			}
+			addTo(demand, order.OrderType, new(big.Int).Sub(order.Count, order.Delivered))
+		}
+	}
+	p := &planner{
+		opts:      opts,
+		producer:  producer,
+		produce:   produceC,
+		avail:     make(map[string]*big.Int),
+		toProduce: make(map[string]*big.Int),
+		required:  make(map[string]*big.Int),
+	}
+	for _, pType := range sortedTypes(demand) {
+		t, _ := new(big.Int).SetString(pType, 10)
+		if err := p.explode(t, demand[pType], 0); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("demand:", formatTypes(demand))
+	fmt.Println("to produce:", formatTypes(p.toProduce))
+	if len(p.noBOM) > 0 {
+		fmt.Println("no BOM:", p.noBOM)
+	}
+	var suppliers []common.Address
+	for _, s := range ctx.StringSlice("supplier") {
+		if !common.IsHexAddress(s) {
+			return fmt.Errorf("invalid supplier address %s", s)
+		}
+		suppliers = append(suppliers, common.HexToAddress(s))
+	}
+	for _, mType := range sortedTypes(p.required) {
+		t, _ := new(big.Int).SetString(mType, 10)
+		stock, err := materialC.GetMyMaterial(opts, t)
+		if err != nil {
+			return err
+		}
+		short := new(big.Int).Sub(p.required[mType], stock)
+		if short.Sign() <= 0 {
+			fmt.Printf("material %s: required %s, stock %s\n", mType, p.required[mType], stock)
+			continue
+		}
+		fmt.Printf("material %s: required %s, stock %s, shortfall %s\n", mType, p.required[mType], stock, short)
+		if !ctx.Bool("draft") {
+			continue
+		}
+		candidates := suppliers
+		if def, err := materialC.GetMaterialProducer(opts, t); err == nil && def != (common.Address{}) {
+			candidates = append([]common.Address{def}, suppliers...)
+		}
+		var best common.Address
+		var bestPrice *big.Int
+		for _, s := range candidates {
+			price, err := materialC.GetPrice(opts, s, t)
+			if err != nil || price.Sign() == 0 || s == producer {
+				continue
+			}
+			if bestPrice == nil || price.Cmp(bestPrice) < 0 {
+				best, bestPrice = s, price
+			}
+		}
+		if bestPrice == nil {
+			fmt.Printf("  no supplier has a price for material %s\n", mType)
+			continue
+		}
+		fmt.Printf("  draft: makeOrder(true, %s, %s, %s, %s, 0), amount %s\n",
+			best.Hex(), mType, short, bestPrice, new(big.Int).Mul(bestPrice, short))
+	}
+	return nil
+}
+
+// explode 扣除可用库存后，把count个pType按物料清单展开，子部件递归展开
+func (p *planner) explode(pType, count *big.Int, depth int) error {
+	if depth > maxPlanDepth {
+		return fmt.Errorf("product nesting exceeds %d levels", maxPlanDepth)
+	}
+	key := pType.String()
+	if _, ok := p.avail[key]; !ok {
+		ids, err := p.produce.GetMyProducts(p.opts, pType)
+		if err != nil {
+			return err
+		}
+		p.avail[key] = big.NewInt(int64(len(ids)))
+	}
+	use := p.avail[key]
+	if use.Cmp(count) > 0 {
+		use = count
+	}
+	p.avail[key] = new(big.Int).Sub(p.avail[key], use)
+	count = new(big.Int).Sub(count, use)
+	if count.Sign() == 0 {
+		return nil
+	}
+	addTo(p.toProduce, pType, count)
+	bom, err := p.produce.GetBOM(p.opts, p.producer, pType)
+	if err != nil {
+		return err
+	}
+	if len(bom.MaterialTypes) == 0 && len(bom.ProductTypes) == 0 {
+		p.noBOM = append(p.noBOM, key)
+		return nil
+	}
+	for i, t := range bom.MaterialTypes {
+		addTo(p.required, t, new(big.Int).Mul(bom.Quantities[i], count))
+	}
+	for i, t := range bom.ProductTypes {
+		if err := p.explode(t, new(big.Int).Mul(bom.ProductQuantities[i], count), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addTo(m map[string]*big.Int, t, n *big.Int) {
+	key := t.String()
+	if m[key] == nil {
+		m[key] = new(big.Int)
+	}
+	m[key].Add(m[key], n)
+}
+
+func sortedTypes(m map[string]*big.Int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := new(big.Int).SetString(keys[i], 10)
+		b, _ := new(big.Int).SetString(keys[j], 10)
+		return a.Cmp(b) < 0
+	})
+	return keys
+}
+
+func formatTypes(m map[string]*big.Int) string {
+	s := ""
+	for _, k := range sortedTypes(m) {
+		s += fmt.Sprintf(" %s:%s", k, m[k])
+	}
+	return s
+}
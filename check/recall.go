@@ -0,0 +1,50 @@
+package check
+
+import (
+	"context"
+	"fisco/build/produce"
+	"fmt"
+	"github.com/chislab/go-fiscobcos/common"
+	"github.com/urfave/cli/v2"
+	"math/big"
+)
+
+// RecallBatch 召回有缺陷的物料批次，只有批次的生产者和Produce合约的owner可以调用
+func RecallBatch(ctx *cli.Context) error {
+	if !common.IsHexAddress(ctx.String("produce")) {
+		return fmt.Errorf("invalid produce contract address %s", ctx.String("produce"))
+	}
+	if ctx.Uint64("limit") == 0 {
+		return fmt.Errorf("limit must be positive")
+	}
+	height, err := GethCli.BlockNumber(context.Background())
+	if err != nil {
+		return err
+	}
+	auth := NewAuthFromPriKey(height)
+	if key := ctx.String("key"); key != "" {
+		auth = NewAuthFromPriKey(height, key)
+	}
+	contract, err := produce.NewProduce(common.HexToAddress(ctx.String("produce")), GethCli)
+	if err != nil {
+		return err
+	}
+	batch := str2Big(ctx.String("batch"))
+	limit := new(big.Int).SetUint64(ctx.Uint64("limit"))
+	tx, err := contract.RecallBatch(auth, batch, ctx.String("reason"), limit)
+	checkTx(tx, err)
+	fmt.Println("recallBatch tx", tx.Hash().String())
+	// 产品较多时分多个交易继续召回
+	for {
+		remaining, err := contract.RecallRemaining(callOpts, batch)
+		if err != nil {
+			return err
+		}
+		if remaining.Sign() == 0 {
+			return nil
+		}
+		tx, err := contract.RecallProducts(auth, batch, limit)
+		checkTx(tx, err)
+		fmt.Println("recallProducts tx", tx.Hash().String(), "remaining", remaining.String())
+	}
+}
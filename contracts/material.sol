@@ -3,8 +3,14 @@ pragma experimental ABIEncoderV2;
 
 import "./access.sol";
 import "./openzeppelin/math/SafeMath.sol";
+import "./reasons.sol";
 
-contract material {
+// Produce合约中查询召回批次的接口
+interface RecallRegistry {
+    function recalledBatches(uint256 batchID) external view returns(bool);
+}
+
+contract material is Reasons {
     struct RawMaterial {
         address producer; // 生产厂家
         uint256 createdAt;
@@ -25,6 +31,10 @@ contract material {
     event EvtMaterialTransferred(address from, address to, uint256 materialType, uint256 num);
     event EvtMaterialConsumed(address from, uint256 materialType, uint256 num);
     event EvtPriceUpdated(address from, uint256 materialType, uint256 price);
+    event EvtMaterialWrittenOff(address from, uint256 materialType, uint256 batchID, uint256 num, uint8 reason);
+
+    mapping(uint256 => uint256) public writtenOff; // 批次累计核销的数量
+    address public produceContract; // 可以按物料清单扣除物料的Produce合约
 
     Access access; // 权限管理合约实例
 
@@ -123,6 +133,83 @@ contract material {
         emit EvtMaterialConsumed(msg.sender, materialType, num);
     }
 
+    // 核销调用者持有的某个批次的物料，核销的物料不能再转移或消耗，批次信息保留
+    function writeOffMaterial(uint256 materialType, uint256 batchID, uint256 num, uint8 reason) public {
+        require(isValidReason(reason), "invalid reason");
+        RawMaterial[] storage myMaterials = keptMaterials[msg.sender][materialType];
+        uint256 idx = usedBatchIdx[msg.sender][materialType];
+        for (; idx < myMaterials.length; idx++) {
+            if (myMaterials[idx].batchID == batchID) {
+                break;
+            }
+        }
+        require(idx < myMaterials.length, "batch not found");
+        require(myMaterials[idx].keptNum >= num, "insufficient materials.");
+        myMaterials[idx].keptNum = SafeMath.sub(myMaterials[idx].keptNum, num);
+        skipUsedBatches(msg.sender, materialType);
+        writtenOff[batchID] = SafeMath.add(writtenOff[batchID], num);
+        emit EvtMaterialWrittenOff(msg.sender, materialType, batchID, num, reason);
+    }
+
+    // 由Access合约的owner设置Produce合约
+    function setProduceContract(address _produceContract) public {
+        require(msg.sender == access.owner(), "only for access owner");
+        produceContract = _produceContract;
+    }
+
+    // 由Produce合约调用，按先进先出扣除owner的物料，跳过已召回的批次，返回用到的批次
+    function consumeFor(address owner, uint256 materialType, uint256 num) public returns(uint256[] memory batches) {
+        require(msg.sender == produceContract, "only for produce contract");
+        RawMaterial[] storage kept = keptMaterials[owner][materialType];
+        uint256[] memory used = new uint256[](kept.length - usedBatchIdx[owner][materialType]);
+        uint256 n = 0;
+        uint256 left = num;
+        for (uint256 idx = usedBatchIdx[owner][materialType]; idx < kept.length && left > 0; idx++) {
+            uint256 take = kept[idx].keptNum < left ? kept[idx].keptNum : left;
+            if (take == 0 || RecallRegistry(produceContract).recalledBatches(kept[idx].batchID)) {
+                continue;
+            }
+            kept[idx].keptNum = SafeMath.sub(kept[idx].keptNum, take);
+            left = SafeMath.sub(left, take);
+            used[n++] = kept[idx].batchID;
+        }
+        require(left == 0, "insufficient materials.");
+        skipUsedBatches(owner, materialType);
+        batches = new uint256[](n);
+        for (uint i = 0; i < n; i++) {
+            batches[i] = used[i];
+        }
+        emit EvtMaterialConsumed(owner, materialType, num);
+        return batches;
+    }
+
+    // 由Produce合约调用，从owner持有的每个批次中各扣除一个物料，用于没有物料清单的产品登记
+    function consumeBatchesFor(address owner, uint256[] memory batchIDs) public {
+        require(msg.sender == produceContract, "only for produce contract");
+        for (uint i = 0; i < batchIDs.length; i++) {
+            uint256 materialType = batchInfos[batchIDs[i]].materialType;
+            RawMaterial[] storage kept = keptMaterials[owner][materialType];
+            uint256 idx = usedBatchIdx[owner][materialType];
+            for (; idx < kept.length; idx++) {
+                if (kept[idx].batchID == batchIDs[i] && kept[idx].keptNum > 0) {
+                    break;
+                }
+            }
+            require(idx < kept.length, "material batch not held");
+            kept[idx].keptNum = SafeMath.sub(kept[idx].keptNum, 1);
+            skipUsedBatches(owner, materialType);
+            emit EvtMaterialConsumed(owner, materialType, 1);
+        }
+    }
+
+    // 跳过开头已经用完的批次
+    function skipUsedBatches(address owner, uint256 materialType) private {
+        RawMaterial[] storage kept = keptMaterials[owner][materialType];
+        while (usedBatchIdx[owner][materialType] < kept.length && kept[usedBatchIdx[owner][materialType]].keptNum == 0) {
+            usedBatchIdx[owner][materialType]++;
+        }
+    }
+
     function getMyMaterial(uint256 materialType) public view returns (uint256 num) {
         RawMaterial[] memory myMaterials = keptMaterials[msg.sender][materialType];
         uint256 idx = usedBatchIdx[msg.sender][materialType];
@@ -13,24 +13,70 @@ struct Order {
     uint256 count; //商品(元件或者产品)数量
     uint256 orderType; //元件种类，如果是产品订单则这个字段无效
     uint256 createdAt; //订单创建时间
-    uint8   status; //订单状态 0处理中，1已完成，2已取消
+    uint8   status; //订单状态 0已下单，1已完成(已确认收货)，2已取消，3已接单，4已发货，5已拒单，6已关闭，7已超时
+    uint256 shipped; //已发货数量
+    uint256 delivered; //已确认收货数量
+    uint256 paid; //已支付给供货商的金额
+    uint256 deadline; //截止时间，0表示不会超时
+}
+
+struct Withdrawal {
+    address account; //申请提现的账户
+    uint256 amount; //冻结的金额
+    string  memo; //备注，如收款账户
+    uint8   status; //0已申请，1已批准(资金已销毁)，2已拒绝(资金已退回)
+    uint256 createdAt; //申请时间
+    string  ref; //批准时为链下兑付的凭证号，拒绝时为原因
 }
 
 contract Payment is Ownable {
     using SafeMath for uint256;
 
+    // 订单状态机: Created -> Accepted -> Shipped -> Delivered, Created -> Rejected, Created/Accepted -> Cancelled, Shipped -> Closed
+    // 可以分批发货和收货，全部收货前订单保持Shipped状态
+    uint8 constant STATUS_CREATED = 0;
+    uint8 constant STATUS_DELIVERED = 1;
+    uint8 constant STATUS_CANCELLED = 2;
+    uint8 constant STATUS_ACCEPTED = 3;
+    uint8 constant STATUS_SHIPPED = 4;
+    uint8 constant STATUS_REJECTED = 5;
+    uint8 constant STATUS_CLOSED = 6;
+    uint8 constant STATUS_EXPIRED = 7;
+    uint256 constant MAX_ORDER_TIMEOUT = 10 * 365 days; //订单超时秒数的上限
+
+    uint8 constant WITHDRAWAL_PENDING = 0;
+    uint8 constant WITHDRAWAL_APPROVED = 1;
+    uint8 constant WITHDRAWAL_REJECTED = 2;
+    uint256 constant MAX_MEMO_LENGTH = 256; //备注的最大字节数
+
     event EvtMint(address account, uint256 amount);
     event EvtMakeOrder(uint256 orderType, uint256 indexed id, address indexed payer, address indexed producer, uint256 cnt, uint256 price);
-    event EvtConfirmOrder(address from, uint256 orderType, uint256 indexed id);
+    event EvtAcceptOrder(uint256 indexed id, address producer);
+    event EvtRejectOrder(uint256 indexed id, address producer, uint256 amount2Payer);
+    event EvtShipOrder(uint256 indexed id, address producer, uint256 cnt);
+    event EvtConfirmOrder(address from, uint256 orderType, uint256 indexed id, uint256 cnt, uint256 amount2Producer);
     event EvtCancelOrder(uint256 indexed id, uint256 amount2Payer, uint256 amount2Producer);
+    event EvtCloseOrder(uint256 indexed id, uint256 delivered, uint256 amount2Payer, uint256 amount2Producer);
+    event EvtExpireOrder(uint256 indexed id, uint256 amount2Payer, uint256 compensate);
+    event EvtTransfer(address indexed from, address indexed to, uint256 amount, string memo);
+    event EvtWithdrawalRequested(uint256 indexed id, address indexed account, uint256 amount, string memo);
+    event EvtWithdrawalApproved(uint256 indexed id, address indexed account, uint256 amount, string ref);
+    event EvtWithdrawalRejected(uint256 indexed id, address indexed account, uint256 amount, string reason);
 
     mapping(address => uint256) balances; //各商户的可用余额
-    mapping(uint256 => Order) orders; //订单，订单ID=>订单实例，订单完成或者取消则删除
+    mapping(uint256 => Order) orders; //订单，订单ID=>订单实例，订单结束后保留最终状态
     uint256 materialOrderID = 0;  // 元件订单ID，在偶数空间递增
     uint256 productOrderID = 1; // 产品订单ID，在奇数空间递增
+    mapping(address => uint256[]) producerProductOrders; //供货商收到的产品订单ID，按下单顺序
     material materialProducer; //元件供货商
     Produce productProducer; //产品代工厂
     uint256 cancelCompensate; //代工厂取消订单时，补偿给供货商的比例，百分比
+    uint256 expireCompensate; //供货商接单后订单超时，赔付给下单者的比例，百分比
+    mapping(address => uint256) orderTimeouts; //供货商默认的订单超时秒数
+    uint256[] deadlineOrders; //设置了截止时间且可能未结束的订单ID
+    uint256 expireCursor; //expireOrders下一次从deadlineOrders的这个位置开始检查
+    mapping(uint256 => Withdrawal) withdrawals; //提现申请，申请ID=>申请，处理后保留最终状态
+    uint256 withdrawalCount; //提现申请数，申请ID从1开始
 
     constructor(uint256 _cancelCompensate) public {
         cancelCompensate = _cancelCompensate;
@@ -44,7 +90,19 @@ contract Payment is Ownable {
         productProducer = Produce(producer);
     }
 
-    function makeOrder (bool isMaterial, address to, uint256 orderType, uint256 _count, uint256 _price) public returns(uint256 id) {
+    // 供货商设置默认的订单超时秒数，0表示默认不超时
+    function setOrderTimeout(uint256 timeout) public {
+        require(timeout <= MAX_ORDER_TIMEOUT, "timeout too long");
+        orderTimeouts[msg.sender] = timeout;
+    }
+
+    function setExpireCompensate(uint256 _expireCompensate) public onlyOwner {
+        require(_expireCompensate <= 100, "expire compensate invalid");
+        expireCompensate = _expireCompensate;
+    }
+
+    // _timeout为订单超时秒数，为0时使用供货商设置的默认值
+    function makeOrder (bool isMaterial, address to, uint256 orderType, uint256 _count, uint256 _price, uint256 _timeout) public returns(uint256 id) {
         require(to != address(0), "can not make order to nobody.");
         uint256 remotePrice = 0;
         id = 0;
@@ -58,6 +116,7 @@ contract Payment is Ownable {
             remotePrice = productProducer.getProductPrice(to, orderType);
             id = productOrderID;
             productOrderID += 2;
+            producerProductOrders[to].push(id);
         }
         require(_price >= remotePrice, "price mismatch");
         uint256 _amount = remotePrice.mul(_count);
@@ -72,8 +131,20 @@ contract Payment is Ownable {
             count: _count,
             orderType: orderType,
             createdAt: now,
-            status: 0
+            status: STATUS_CREATED,
+            shipped: 0,
+            delivered: 0,
+            paid: 0,
+            deadline: 0
         });
+        require(_timeout <= MAX_ORDER_TIMEOUT, "timeout too long");
+        if (_timeout == 0) {
+            _timeout = orderTimeouts[to];
+        }
+        if (_timeout > 0) {
+            order.deadline = now.add(_timeout);
+            deadlineOrders.push(id);
+        }
         orders[id] = order;
 
         emit EvtMakeOrder(orderType, id, order.payer, order.producer, _count, _price);
@@ -81,37 +152,102 @@ contract Payment is Ownable {
         return id;
     }
 
-    // 用于交付产品或材料时，进行资金划拨和所有权变更
-    function confirmOrder(uint256 id) public {
+    modifier onlyProducerOf(uint256 id) {
         require(orders[id].payer != address(0), "order does not exis");
-        require(orders[id].payer == msg.sender, "only the payer can confirm order");
-        require(orders[id].status == 0, "order status wrong");
-        orders[id].status = 1;
+        require(orders[id].producer == msg.sender, "ErrOrderParty: only the producer can do this");
+        _;
+    }
+
+    // 供货商接单
+    function acceptOrder(uint256 id) public onlyProducerOf(id) {
+        require(orders[id].status == STATUS_CREATED, "ErrOrderStatus: only created order can be accepted");
+        orders[id].status = STATUS_ACCEPTED;
+        emit EvtAcceptOrder(id, msg.sender);
+    }
+
+    // 供货商拒单，冻结的货款全部退回下单者
+    function rejectOrder(uint256 id) public onlyProducerOf(id) {
+        require(orders[id].status == STATUS_CREATED, "ErrOrderStatus: only created order can be rejected");
+        orders[id].status = STATUS_REJECTED;
+        balances[orders[id].payer] = balances[orders[id].payer].add(orders[id].amount);
+        emit EvtRejectOrder(id, msg.sender, orders[id].amount);
+    }
+
+    // 供货商发货，_count为0时发出剩余全部数量，可以分多批发货
+    function shipOrder(uint256 id, uint256 _count) public onlyProducerOf(id) {
+        Order storage order = orders[id];
+        require(order.status == STATUS_ACCEPTED || order.status == STATUS_SHIPPED, "ErrOrderStatus: only accepted or shipped order can be shipped");
+        if (_count == 0) {
+            _count = order.count.sub(order.shipped);
+        }
+        require(_count > 0 && order.shipped.add(_count) <= order.count, "ship count exceeds order count");
+        order.shipped = order.shipped.add(_count);
+        order.status = STATUS_SHIPPED;
+        emit EvtShipOrder(id, msg.sender, _count);
+    }
+
+    // 下单者确认收货，_count为0时确认全部已发货未收货的数量
+    // 按收货数量进行资金划拨和所有权变更，全部收货后订单完成
+    function confirmOrder(uint256 id, uint256 _count) public {
+        Order storage order = orders[id];
+        require(order.payer != address(0), "order does not exis");
+        require(order.payer == msg.sender, "ErrOrderParty: only the payer can confirm order");
+        require(order.status == STATUS_SHIPPED, "ErrOrderStatus: only shipped order can be confirmed");
+        if (_count == 0) {
+            _count = order.shipped.sub(order.delivered);
+        }
+        require(_count > 0 && order.delivered.add(_count) <= order.shipped, "confirm count exceeds shipped count");
+        order.delivered = order.delivered.add(_count);
+        uint256 amount = order.amount.div(order.count).mul(_count);
+        if (order.delivered == order.count) {
+            //最后一批支付剩余全部货款
+            amount = order.amount.sub(order.paid);
+            order.status = STATUS_DELIVERED;
+        }
+        order.paid = order.paid.add(amount);
         if (id & 1 == 0) { //元件订单
-            materialProducer.transferMaterial(orders[id].producer, orders[id].payer, orders[id].orderType, orders[id].count);
+            materialProducer.transferMaterial(order.producer, order.payer, order.orderType, _count);
         } else { //产品订单
-            productProducer.transferProducts(orders[id].producer, orders[id].payer, orders[id].orderType, orders[id].count);
+            productProducer.transferProducts(order.producer, order.payer, order.orderType, _count);
         }
-        //将资金支付给供货商
-        balances[orders[id].producer] = balances[orders[id].producer].add(orders[id].amount);
-        emit EvtConfirmOrder(msg.sender, orders[id].orderType, id);
+        //将本批货款支付给供货商
+        balances[order.producer] = balances[order.producer].add(amount);
+        emit EvtConfirmOrder(msg.sender, order.orderType, id, _count, amount);
+    }
 
-        delete orders[id];
+    // 部分收货后关闭订单，未收货部分的货款退回下单者
+    // 下单者在一次都没有收货时关闭订单，与接单后取消一样按比例补偿供货商
+    function closeOrder(uint256 id) public {
+        Order storage order = orders[id];
+        require(order.payer != address(0), "order does not exis");
+        require(order.producer == msg.sender || order.payer == msg.sender, "ErrOrderParty: only the payer and producer can close order");
+        require(order.status == STATUS_SHIPPED, "ErrOrderStatus: only shipped order can be closed");
+        order.status = STATUS_CLOSED;
+        uint256 remain = order.amount.sub(order.paid);
+        uint256 compensate = 0;
+        if (msg.sender == order.payer && order.delivered == 0) {
+            compensate = (remain * cancelCompensate) / 100;
+            remain = remain.sub(compensate);
+            balances[order.producer] = balances[order.producer].add(compensate);
+        }
+        balances[order.payer] = balances[order.payer].add(remain);
+        emit EvtCloseOrder(id, order.delivered, remain, compensate);
     }
 
     function cancelOrder(uint256 id) public {
         require(orders[id].payer != address(0), "order does not exis");
-        require(orders[id].producer == msg.sender || orders[id].payer == msg.sender, "only the payer and producer can cancel order");
-        require(orders[id].status == 0, "order status wrong");
-        orders[id].status = 2;
+        require(orders[id].producer == msg.sender || orders[id].payer == msg.sender, "ErrOrderParty: only the payer and producer can cancel order");
+        uint8 status = orders[id].status;
+        require(status == STATUS_CREATED || status == STATUS_ACCEPTED, "ErrOrderStatus: only created or accepted order can be cancelled");
+        orders[id].status = STATUS_CANCELLED;
         //TODO 这里需要通知下单者吗
-        if (msg.sender == orders[id].producer) {
-            //生产商取消订单则将资金全部退回下单者
+        if (msg.sender == orders[id].producer || status == STATUS_CREATED) {
+            //生产商取消订单，或者生产商接单前下单者取消订单，则将资金全部退回下单者
             balances[orders[id].payer] = balances[orders[id].payer].add(orders[id].amount);
 
             emit EvtCancelOrder(id, orders[id].amount, 0);
         } else {
-            //下单者取消订单，则按照一定赔付比例赔付给生产商
+            //生产商接单后下单者取消订单，则按照一定赔付比例赔付给生产商
             uint256 compensate = (orders[id].amount * cancelCompensate) / 100;
             uint256 remain = orders[id].amount.sub(compensate);
             balances[orders[id].producer] = balances[orders[id].producer].add(compensate);
@@ -119,7 +255,51 @@ contract Payment is Ownable {
 
             emit EvtCancelOrder(id, remain, compensate);
         }
-        delete orders[id];
+    }
+
+    // 任何人都可以调用，从上次停下的位置开始在截止时间列表中最多检查limit个订单，到末尾后从头开始，
+    // 处理其中已超时的未结束订单，返回处理的个数
+    // 未收货部分的货款退回下单者，供货商已接单的订单还需按未发货部分的货款按比例赔付下单者，赔付以供货商余额为限
+    function expireOrders(uint256 limit) public returns(uint256 expired) {
+        uint256 i = expireCursor;
+        //每个检查过的订单都计入limit，gas不随列表长度增长
+        for (uint256 visited = 0; visited < limit && deadlineOrders.length > 0; visited++) {
+            if (i >= deadlineOrders.length) {
+                i = 0;
+            }
+            uint256 id = deadlineOrders[i];
+            Order storage order = orders[id];
+            bool open = order.status == STATUS_CREATED || order.status == STATUS_ACCEPTED || order.status == STATUS_SHIPPED;
+            if (open && order.deadline > now) {
+                i++;
+                continue;
+            }
+            //已结束或者已超时的订单移出列表，最后一个元素移到当前位置，不增加i
+            deadlineOrders[i] = deadlineOrders[deadlineOrders.length - 1];
+            deadlineOrders.pop();
+            if (!open) {
+                continue;
+            }
+            uint256 remain = order.amount.sub(order.paid);
+            uint256 compensate = 0;
+            if (order.status != STATUS_CREATED) {
+                //已发货的部分只是等待下单者确认收货，只按未发货部分的货款赔付
+                uint256 unshipped = order.amount.div(order.count).mul(order.count.sub(order.shipped));
+                if (unshipped > remain) {
+                    unshipped = remain;
+                }
+                compensate = unshipped.mul(expireCompensate) / 100;
+                if (compensate > balances[order.producer]) {
+                    compensate = balances[order.producer];
+                }
+                balances[order.producer] = balances[order.producer].sub(compensate);
+            }
+            order.status = STATUS_EXPIRED;
+            balances[order.payer] = balances[order.payer].add(remain).add(compensate);
+            expired++;
+            emit EvtExpireOrder(id, remain, compensate);
+        }
+        expireCursor = i;
     }
 
     function getOrder(uint256 id) public view returns(Order memory order) {
@@ -127,6 +307,83 @@ contract Payment is Ownable {
         return orders[id];
     }
 
+    // 供货商收到的产品订单数
+    function productOrderCount(address producer) public view returns(uint256) {
+        return producerProductOrders[producer].length;
+    }
+
+    // 按下单顺序分页查询供货商收到的产品订单ID，从第offset个开始最多limit个
+    function productOrderIDs(address producer, uint256 offset, uint256 limit) public view returns(uint256[] memory ids) {
+        uint256[] storage all = producerProductOrders[producer];
+        if (offset >= all.length) {
+            return new uint256[](0);
+        }
+        uint256 n = all.length - offset < limit ? all.length - offset : limit;
+        ids = new uint256[](n);
+        for (uint i = 0; i < n; i++) {
+            ids[i] = all[offset + i];
+        }
+        return ids;
+    }
+
+    // 向其他账户转账，memo为备注
+    function transfer(address to, uint256 amount, string memory memo) public {
+        require(to != address(0) && to != msg.sender, "invalid receiver");
+        require(amount > 0, "amount must be positive");
+        require(bytes(memo).length <= MAX_MEMO_LENGTH, "memo is too long");
+        require(balances[msg.sender] >= amount, "Insufficient balance");
+        balances[msg.sender] = balances[msg.sender].sub(amount);
+        balances[to] = balances[to].add(amount);
+        emit EvtTransfer(msg.sender, to, amount, memo);
+    }
+
+    // 申请把资金兑付到链下，申请的资金立即冻结，由owner批准后销毁或者拒绝后退回
+    function requestWithdrawal(uint256 amount, string memory memo) public returns(uint256 id) {
+        require(amount > 0, "amount must be positive");
+        require(bytes(memo).length <= MAX_MEMO_LENGTH, "memo is too long");
+        require(balances[msg.sender] >= amount, "Insufficient balance");
+        balances[msg.sender] = balances[msg.sender].sub(amount);
+        withdrawalCount++;
+        id = withdrawalCount;
+        withdrawals[id] = Withdrawal({
+            account: msg.sender,
+            amount: amount,
+            memo: memo,
+            status: WITHDRAWAL_PENDING,
+            createdAt: now,
+            ref: ""
+        });
+        emit EvtWithdrawalRequested(id, msg.sender, amount, memo);
+    }
+
+    // 批准提现申请，冻结的资金被销毁，ref为链下兑付的凭证号
+    function approveWithdrawal(uint256 id, string memory ref) public onlyOwner {
+        Withdrawal storage w = pendingWithdrawal(id);
+        w.status = WITHDRAWAL_APPROVED;
+        w.ref = ref;
+        emit EvtWithdrawalApproved(id, w.account, w.amount, ref);
+    }
+
+    // 拒绝提现申请，冻结的资金退回申请的账户
+    function rejectWithdrawal(uint256 id, string memory reason) public onlyOwner {
+        Withdrawal storage w = pendingWithdrawal(id);
+        w.status = WITHDRAWAL_REJECTED;
+        w.ref = reason;
+        balances[w.account] = balances[w.account].add(w.amount);
+        emit EvtWithdrawalRejected(id, w.account, w.amount, reason);
+    }
+
+    function pendingWithdrawal(uint256 id) private view returns(Withdrawal storage w) {
+        w = withdrawals[id];
+        require(w.account != address(0), "withdrawal does not exist");
+        require(w.status == WITHDRAWAL_PENDING, "withdrawal is already processed");
+    }
+
+    function getWithdrawal(uint256 id) public view returns(Withdrawal memory) {
+        require(withdrawals[id].account != address(0), "withdrawal does not exist");
+        return withdrawals[id];
+    }
+
     function mint(address account, uint256 amount) public onlyOwner {
         require(account != address(0), "mint to the zero address");
         balances[account] = balances[account].add(amount);
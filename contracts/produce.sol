@@ -5,10 +5,11 @@ import './material.sol';
 import './payment.sol';
 import './queue.sol';
 import './access.sol';
+import './reasons.sol';
 import './openzeppelin/access/Ownable.sol';
 
 // 生产合约
-contract Produce is Ownable {
+contract Produce is Ownable, Reasons {
     struct Product {
         address owner;
         address producer;
@@ -16,12 +17,37 @@ contract Produce is Ownable {
         uint256 batch; //产品批次
         uint256[] materialBatches; //所用到的零件批次
         bool sold; //是否已经售卖
+        bool recalled; //是否已被召回
+        bool scrapped; //是否已报废
+        uint8 scrapReason; //报废原因代码，见Reasons合约
+        string scrapNote; //报废说明
+        uint256[] components; //装入的子部件产品ID
+        bool incorporated; //是否已作为子部件装入其他产品
+        uint256 parent; //装有该产品的上级产品ID
+        uint256 depth; //子部件嵌套的层数，不超过MAX_TRACE_DEPTH
     }
 
+    // 物料清单，materialTypes[i]的用量为quantities[i]，子部件productTypes[i]的用量为productQuantities[i]
+    struct BOM {
+        uint256[] materialTypes;
+        uint256[] quantities;
+        uint256[] productTypes;
+        uint256[] productQuantities;
+    }
+
+    uint256 constant MAX_TRACE_DEPTH = 8; //子部件嵌套的最大层数
+    uint256 constant MAX_NOTE_LENGTH = 256; //报废说明的最大字节数
+
     using Queue for imap;
 
     event EvtProductOwnerChanged(uint256 indexed id, address oldOwner, address newOwner);
     event EvtProductCreated(uint256 productType, uint256 indexed productID, address creator);
+    event EvtProductRecalled(uint256 indexed batch, uint256 indexed id, address owner);
+    event EvtBatchRecalled(uint256 indexed batch, address recalledBy, string reason);
+    event EvtProductScrapped(uint256 indexed id, address owner, uint8 reason, string note);
+    event EvtProductSold(uint256 indexed id, address seller);
+    event EvtProductVerified(uint256 indexed id, bool genuine, uint256 scans);
+    event EvtProductIncorporated(uint256 indexed id, uint256 indexed parent);
 
     material materialContract; //物料合约实例
     Payment paymentContract; //结算合约实例
@@ -33,6 +59,12 @@ contract Produce is Ownable {
     mapping(address => mapping(uint256 => uint256)) productPrice; //产品价格, 暂定只有一种产品，如果有多种产品，将结构改为 mapping(address => mapping(uint256 => uint256))
     uint256 materialTypeCount; //产品包含的元件种类个数
     mapping(uint256 => imap) materialTrace; //溯源 物料批次号=>产品ID的队列
+    mapping(uint256 => bool) public recalledBatches; //已召回的物料批次
+    mapping(uint256 => uint256) recallCursors; //已召回批次下一个要处理的materialTrace下标
+    mapping(uint256 => bytes32) verifyHashes; //防伪码的keccak256，防伪码由生产者用自己的密钥线下生成
+    mapping(uint256 => uint256) public scanCounts; //防伪码的验证次数，次数过多说明产品ID可能被仿冒
+    mapping(address => mapping(bytes32 => uint256)) scanCommits; //验证承诺 调用者=>承诺=>提交时的区块号
+    mapping(address => mapping(uint256 => BOM)) boms; //物料清单 生产者=>产品类型=>BOM
 
     modifier mcMustBeSet() {
         require(
@@ -73,9 +105,98 @@ contract Produce is Ownable {
         paymentContract = Payment(_paymentContract);
     }
 
-    function registerProduct(uint256 productType, uint256 id, uint256 batchNumber, uint256[] memory materialBatches) public {
+    // 设置产品的物料清单，物料种类不超过materialTypeCount，子部件为其他产品类型，传入空数组时删除物料清单
+    function setBOM(uint256 productType, uint256[] memory materialTypes, uint256[] memory quantities,
+        uint256[] memory productTypes, uint256[] memory productQuantities) public {
         require(access.isProductProducer(msg.sender), "only for product producer");
+        require(materialTypes.length == quantities.length, "invalid bom");
+        require(productTypes.length == productQuantities.length, "invalid bom");
+        require(materialTypes.length <= materialTypeCount, "too many material types");
+        for (uint i = 0; i < quantities.length; i++) {
+            require(quantities[i] > 0, "invalid quantity");
+        }
+        for (uint i = 0; i < productTypes.length; i++) {
+            require(productTypes[i] != productType, "product type can not be a part of itself");
+            require(productQuantities[i] > 0, "invalid quantity");
+        }
+        boms[msg.sender][productType] = BOM(materialTypes, quantities, productTypes, productQuantities);
+    }
+
+    function getBOM(address producer, uint256 productType) public view returns(BOM memory) {
+        return boms[producer][productType];
+    }
+
+    // 按物料清单生产产品，在一个交易中扣除全部物料，并把每个产品实际用到的批次记为它的materialBatches，
+    // 子部件按先进先出从库存中选取，标记为已装入新产品
+    function produce(uint256 productType, uint256[] memory ids, uint256 batchNumber) public mcMustBeSet {
+        require(access.isProductProducer(msg.sender), "only for product producer");
+        BOM storage bom = boms[msg.sender][productType];
+        require(bom.materialTypes.length > 0 || bom.productTypes.length > 0, "bom not found");
+        for (uint i = 0; i < ids.length; i++) {
+            uint256[][] memory used = new uint256[][](bom.materialTypes.length);
+            uint256 total = 0;
+            for (uint j = 0; j < bom.materialTypes.length; j++) {
+                used[j] = materialContract.consumeFor(msg.sender, bom.materialTypes[j], bom.quantities[j]);
+                total += used[j].length;
+            }
+            uint256[] memory materialBatches = new uint256[](total);
+            uint256 n = 0;
+            for (uint j = 0; j < used.length; j++) {
+                for (uint k = 0; k < used[j].length; k++) {
+                    materialBatches[n++] = used[j][k];
+                }
+            }
+            _registerProduct(productType, ids[i], batchNumber, materialBatches);
+            incorporate(ids[i], bom);
+        }
+    }
+
+    // 从调用者的库存中取出子部件装入产品id
+    function incorporate(uint256 id, BOM storage bom) private {
+        uint256 total = 0;
+        for (uint j = 0; j < bom.productQuantities.length; j++) {
+            total += bom.productQuantities[j];
+        }
+        uint256[] memory components = new uint256[](total);
+        uint256 n = 0;
+        uint256 depth = 0;
+        for (uint j = 0; j < bom.productTypes.length; j++) {
+            imap storage kept = keptProducts[msg.sender][bom.productTypes[j]];
+            for (uint k = 0; k < bom.productQuantities[j]; ) {
+                require(kept.len() > 0, "insufficient components");
+                uint256 component = kept.dequeue();
+                if (!inStock(component)) {
+                    continue;
+                }
+                if (products[component].depth + 1 > depth) {
+                    depth = products[component].depth + 1;
+                }
+                require(depth <= MAX_TRACE_DEPTH, "product nesting too deep");
+                products[component].incorporated = true;
+                products[component].parent = id;
+                components[n++] = component;
+                emit EvtProductIncorporated(component, id);
+                k++;
+            }
+        }
+        products[id].components = components;
+        products[id].depth = depth;
+    }
+
+    // 登记产品，设置了物料清单的产品类型必须使用produce，否则从调用者持有的每个物料批次中各扣除一个物料
+    function registerProduct(uint256 productType, uint256 id, uint256 batchNumber, uint256[] memory materialBatches) public mcMustBeSet {
+        require(access.isProductProducer(msg.sender), "only for product producer");
+        BOM storage bom = boms[msg.sender][productType];
+        require(bom.materialTypes.length == 0 && bom.productTypes.length == 0, "product type has a bom, use produce instead");
+        materialContract.consumeBatchesFor(msg.sender, materialBatches);
+        _registerProduct(productType, id, batchNumber, materialBatches);
+    }
+
+    function _registerProduct(uint256 productType, uint256 id, uint256 batchNumber, uint256[] memory materialBatches) private {
         require(products[id].owner == address(0), "product already exists");
+        for (uint i = 0; i < materialBatches.length; i++) {
+            require(!recalledBatches[materialBatches[i]], "material batch is recalled");
+        }
 
         products[id] = Product({
             owner: msg.sender,
@@ -83,7 +204,15 @@ contract Produce is Ownable {
             createdAt: now,
             batch: batchNumber,
             materialBatches: materialBatches,
-            sold: false
+            sold: false,
+            recalled: false,
+            scrapped: false,
+            scrapReason: 0,
+            scrapNote: "",
+            components: new uint256[](0),
+            incorporated: false,
+            parent: 0,
+            depth: 0
         });
         keptProducts[msg.sender][productType].enqueue(id);
 
@@ -97,11 +226,122 @@ contract Produce is Ownable {
     function transferProducts(address from, address to, uint256 productType, uint256 count) public {
         require(access.isPayment(msg.sender), "only for payment");
         require(count <= keptProducts[from][productType].len(), "insufficient product");
-        for (uint i = 0; i < count; i++) {
+        for (uint i = 0; i < count; ) {
+            require(keptProducts[from][productType].len() > 0, "insufficient product");
             uint256 id = keptProducts[from][productType].dequeue();
+            // 已召回、已报废、已售出和已装入其他产品的产品直接移出库存
+            if (!inStock(id)) {
+                continue;
+            }
             keptProducts[to][productType].enqueue(id);
             changeProductOwner(id, to);
+            i++;
+        }
+    }
+
+    // 召回有缺陷的物料批次，只有批次的生产者和合约owner可以调用。通过materialTrace找到用到该批次的产品
+    // 并标记为已召回，每次最多处理limit个产品，剩下的由任何人调用recallProducts继续，返回剩余的产品数
+    function recallBatch(uint256 batch, string memory reason, uint256 limit) public mcMustBeSet returns(uint256 remaining) {
+        require(!recalledBatches[batch], "batch already recalled");
+        (address producer, , , , , ) = materialContract.showBatchInfo(batch);
+        require(msg.sender == owner() || (producer != address(0) && msg.sender == producer),
+            "only for batch producer or owner");
+
+        recalledBatches[batch] = true;
+        recallCursors[batch] = materialTrace[batch].head;
+        emit EvtBatchRecalled(batch, msg.sender, reason);
+        return recallProducts(batch, limit);
+    }
+
+    // 继续召回已召回批次的产品，最多处理limit个，返回剩余的产品数。召回后不能再用该批次登记产品，剩余数只会减少
+    function recallProducts(uint256 batch, uint256 limit) public returns(uint256 remaining) {
+        require(recalledBatches[batch], "batch is not recalled");
+        uint256 tail = materialTrace[batch].tail;
+        uint256 i = recallCursors[batch];
+        for (uint256 end = i + limit < tail ? i + limit : tail; i < end; i++) {
+            // 装有该产品的各级上级产品一起召回
+            uint256 id = materialTrace[batch].map[i];
+            for (uint depth = 0; depth <= MAX_TRACE_DEPTH; depth++) {
+                if (!products[id].recalled) {
+                    products[id].recalled = true;
+                    emit EvtProductRecalled(batch, id, products[id].owner);
+                }
+                if (!products[id].incorporated) {
+                    break;
+                }
+                id = products[id].parent;
+            }
+        }
+        recallCursors[batch] = i;
+        return tail - i;
+    }
+
+    // 已召回批次还没有处理的产品数
+    function recallRemaining(uint256 batch) public view returns(uint256) {
+        if (!recalledBatches[batch]) {
+            return 0;
+        }
+        return materialTrace[batch].tail - recallCursors[batch];
+    }
+
+    // 所有者报废产品，note为报废说明，报废的产品不再计入库存，不能再转移，details和trace中仍然可见
+    function scrapProduct(uint256 id, uint8 reason, string memory note) public {
+        require(products[id].owner == msg.sender, "only for product owner");
+        require(!products[id].scrapped, "product already scrapped");
+        require(isValidReason(reason), "invalid reason");
+        require(bytes(note).length <= MAX_NOTE_LENGTH, "note is too long");
+        products[id].scrapped = true;
+        products[id].scrapReason = reason;
+        products[id].scrapNote = note;
+        emit EvtProductScrapped(id, msg.sender, reason, note);
+    }
+
+    // 生产者设置产品防伪码的哈希，只能设置一次
+    function setVerifyHash(uint256 id, bytes32 hash) public {
+        require(products[id].producer == msg.sender, "only for product producer");
+        require(verifyHashes[id] == bytes32(0), "verify hash already set");
+        verifyHashes[id] = hash;
+    }
+
+    // 所有者把产品卖给最终消费者，售出的产品不再计入库存，不能再转移
+    function sellToConsumer(uint256 id) public {
+        require(products[id].owner == msg.sender, "only for product owner");
+        require(inStock(id), "product is not in stock");
+        products[id].sold = true;
+        emit EvtProductSold(id, msg.sender);
+    }
+
+    // 查询产品真伪，只做查询(call)时防伪码不上链，也不累加验证次数
+    function checkProduct(uint256 id, string memory code) public view returns(bool genuine, Product memory p, uint256 scans) {
+        genuine = verifyHashes[id] != bytes32(0) && verifyHashes[id] == keccak256(bytes(code));
+        if (genuine) {
+            p = products[id];
+            scans = scanCounts[id];
         }
+        return (genuine, p, scans);
+    }
+
+    // 记录验证的第一步，提交承诺keccak256(abi.encodePacked(id, code, msg.sender))，承诺中不含防伪码明文
+    function commitScan(bytes32 commitment) public {
+        require(scanCommits[msg.sender][commitment] == 0, "scan already committed");
+        scanCommits[msg.sender][commitment] = block.number;
+    }
+
+    // 记录验证的第二步，在提交承诺之后的区块中揭示防伪码，防伪码正确时累加验证次数并返回产品信息。
+    // 承诺绑定了调用者，其他人从待打包的交易中读到防伪码也无法抢先用它记录验证，
+    // 揭示后防伪码仍会写入区块，防伪码只能证明产品ID是生产者登记过的，仿冒要靠验证次数发现
+    function verifyProduct(uint256 id, string memory code) public returns(bool genuine, Product memory p, uint256 scans) {
+        bytes32 commitment = keccak256(abi.encodePacked(id, code, msg.sender));
+        uint256 committedAt = scanCommits[msg.sender][commitment];
+        require(committedAt != 0 && committedAt < block.number, "scan not committed");
+        delete scanCommits[msg.sender][commitment];
+
+        (genuine, p, scans) = checkProduct(id, code);
+        if (genuine) {
+            scans = ++scanCounts[id];
+        }
+        emit EvtProductVerified(id, genuine, scans);
+        return (genuine, p, scans);
     }
 
     function details(uint256 id) public view returns(Product memory) {
@@ -113,6 +353,10 @@ contract Produce is Ownable {
     function changeProductOwner(uint256 id, address newOwner) private {
         require(products[id].owner != address(0), "product does not exist");
         require(products[id].owner != newOwner, "self-transfer is disallowed");
+        require(!products[id].recalled, "product is recalled");
+        require(!products[id].scrapped, "product is scrapped");
+        require(!products[id].sold, "product is sold");
+        require(!products[id].incorporated, "product is incorporated");
 
         address oldOwner = products[id].owner;
         products[id].owner = newOwner;
@@ -122,14 +366,28 @@ contract Produce is Ownable {
 
     function getMyProducts(uint256 productType) public view returns(uint256[] memory myProductIDs) {
 //        require(keptProducts[msg.sender][productType].len() > 0, "You have no keptProducts.");
-        myProductIDs = new uint256[](keptProducts[msg.sender][productType].len());
+        imap storage kept = keptProducts[msg.sender][productType];
+        uint256 n = 0;
+        for (uint256 j = kept.head; j < kept.tail; j++) {
+            if (inStock(kept.map[j])) {
+                n++;
+            }
+        }
+        // 已召回、已报废、已售出和已装入其他产品的产品仍在队列中，转移时才移出，这里跳过
+        myProductIDs = new uint256[](n);
         uint256 i = 0;
-        for (uint256 j = keptProducts[msg.sender][productType].head; j < keptProducts[msg.sender][productType].tail; j++) {
-            myProductIDs[i++] = keptProducts[msg.sender][productType].map[j];
+        for (uint256 j = kept.head; j < kept.tail; j++) {
+            if (inStock(kept.map[j])) {
+                myProductIDs[i++] = kept.map[j];
+            }
         }
         return myProductIDs;
     }
 
+    function inStock(uint256 id) private view returns(bool) {
+        return !products[id].recalled && !products[id].scrapped && !products[id].sold && !products[id].incorporated;
+    }
+
     function trace(uint256 materialBatchNum) public view returns(uint256[] memory ids) {
         ids = new uint256[](materialTrace[materialBatchNum].len());
         for (uint i = materialTrace[materialBatchNum].head; i < materialTrace[materialBatchNum].tail; i++) {
@@ -137,4 +395,57 @@ contract Produce is Ownable {
         }
         return ids;
     }
-}
\ No newline at end of file
+
+    // 递归正向溯源: 使用了该批次的产品，以及装有这些产品的各级上级产品
+    function traceAll(uint256 materialBatchNum) public view returns(uint256[] memory ids) {
+        imap storage trace = materialTrace[materialBatchNum];
+        uint256 n = 0;
+        for (uint i = trace.head; i < trace.tail; i++) {
+            n += 1 + ancestorCount(trace.map[i]);
+        }
+        ids = new uint256[](n);
+        uint256 k = 0;
+        for (uint i = trace.head; i < trace.tail; i++) {
+            uint256 id = trace.map[i];
+            ids[k++] = id;
+            for (uint depth = 0; depth < MAX_TRACE_DEPTH && products[id].incorporated; depth++) {
+                id = products[id].parent;
+                ids[k++] = id;
+            }
+        }
+        return ids;
+    }
+
+    function ancestorCount(uint256 id) private view returns(uint256 n) {
+        for (; n < MAX_TRACE_DEPTH && products[id].incorporated; n++) {
+            id = products[id].parent;
+        }
+        return n;
+    }
+
+    // 递归反向溯源: 产品及其各级子部件所用的物料批次
+    function traceProduct(uint256 id) public view returns(uint256[] memory batches) {
+        batches = new uint256[](batchCount(id, 0));
+        fillBatches(id, batches, 0);
+        return batches;
+    }
+
+    function batchCount(uint256 id, uint256 depth) private view returns(uint256 n) {
+        require(depth <= MAX_TRACE_DEPTH, "product nesting too deep");
+        n = products[id].materialBatches.length;
+        for (uint i = 0; i < products[id].components.length; i++) {
+            n += batchCount(products[id].components[i], depth + 1);
+        }
+        return n;
+    }
+
+    function fillBatches(uint256 id, uint256[] memory batches, uint256 k) private view returns(uint256) {
+        for (uint i = 0; i < products[id].materialBatches.length; i++) {
+            batches[k++] = products[id].materialBatches[i];
+        }
+        for (uint i = 0; i < products[id].components.length; i++) {
+            k = fillBatches(products[id].components[i], batches, k);
+        }
+        return k;
+    }
+}
@@ -0,0 +1,15 @@
+pragma solidity ^0.6.0;
+
+// 报废产品和核销物料的原因代码，Material和Produce合约共用
+contract Reasons {
+    uint8 constant REASON_DAMAGED = 1; // 损坏
+    uint8 constant REASON_DEFECTIVE = 2; // 质量缺陷
+    uint8 constant REASON_EXPIRED = 3; // 过期
+    uint8 constant REASON_LOST = 4; // 丢失
+    uint8 constant REASON_RETIRED = 5; // 退役
+    uint8 constant REASON_OTHER = 6; // 其他
+
+    function isValidReason(uint8 reason) internal pure returns(bool) {
+        return reason >= REASON_DAMAGED && reason <= REASON_OTHER;
+    }
+}
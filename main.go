@@ -11,6 +11,29 @@ func main() {
 		Commands: []*cli.Command{
 			{Name: "test", Aliases: []string{"t"}, Usage: "test truffle functions", Action: check.Test},
 			{Name: "full",  Aliases: []string{"full"}, Usage: "test full sequence", Action: check.TestFull},
+			{Name: "expire", Usage: "refund expired orders", Action: check.ExpireOrders,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "payment", Usage: "payment contract address", Required: true},
+					&cli.StringFlag{Name: "key", Usage: "private key of the caller, a random key by default"},
+					&cli.Int64Flag{Name: "limit", Usage: "max orders to expire", Value: 100},
+				}},
+			{Name: "recall", Usage: "recall products made of a defective material batch", Action: check.RecallBatch,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "produce", Usage: "produce contract address", Required: true},
+					&cli.StringFlag{Name: "key", Usage: "private key of the batch producer or the contract owner", Required: true},
+					&cli.StringFlag{Name: "batch", Usage: "material batch ID, e.g. LCD_1", Required: true},
+					&cli.StringFlag{Name: "reason", Usage: "reason of the recall"},
+					&cli.Uint64Flag{Name: "limit", Usage: "max products recalled per transaction", Value: 100},
+				}},
+			{Name: "plan", Usage: "material shortfall for open product orders of a producer", Action: check.Plan,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "payment", Usage: "payment contract address", Required: true},
+					&cli.StringFlag{Name: "produce", Usage: "produce contract address", Required: true},
+					&cli.StringFlag{Name: "material", Usage: "material contract address", Required: true},
+					&cli.StringFlag{Name: "producer", Usage: "address of the product producer", Required: true},
+					&cli.BoolFlag{Name: "draft", Usage: "print material order drafts at the cheapest price"},
+					&cli.StringSliceFlag{Name: "supplier", Usage: "material supplier addresses to compare prices with"},
+				}},
 		},
 	}
 	if err := app.Run(os.Args); err != nil {
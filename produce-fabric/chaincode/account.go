@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// 记账方式
+const (
+	AccountModeOrg      = "org"      // 按组织记账，组织的所有成员共用一个资金账户(早期版本)
+	AccountModeIdentity = "identity" // 按身份记账，下单时使用成员个人的资金账户
+)
+
+// 证书中的属性(ABAC)
+const (
+	attrEnrollmentID = "hf.EnrollmentID" // fabric-ca签发证书时写入的登记ID，作为个人账户ID
+	attrRole         = "role"            // 成员在组织内的角色
+	attrLimit        = "limit"           // 单笔订单金额上限，不设置时不限制
+)
+
+// 成员在组织内的角色，按身份记账时生效
+const (
+	MemberPurchaser = "purchaser" // 采购员，可以用个人账户下单
+	MemberTreasurer = "treasurer" // 财务，可以在组织账户和成员账户之间划转资金
+)
+
+// Caller 调用者
+type Caller struct {
+	Org     string  `json:"org"`             //组织的MSP ID
+	Account string  `json:"account"`         //资金账户，按组织记账时为组织
+	Role    string  `json:"role,omitempty"`  //证书属性中的角色
+	Limit   *Amount `json:"limit,omitempty"` //证书属性中的单笔订单金额上限
+}
+
+// memberAccount 成员的个人账户 org/id
+func memberAccount(org, id string) string {
+	return fmt.Sprintf("%s/%s", org, id)
+}
+
+// getCaller 读取调用者的组织、资金账户和证书属性
+func getCaller(stub shim.ChaincodeStubInterface) (*Caller, error) {
+	org, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role %v", err)
+	}
+	caller := &Caller{Org: org, Account: org}
+	mode, err := getAccountMode(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account mode %v", err)
+	}
+	if mode != AccountModeIdentity {
+		return caller, nil
+	}
+	id, ok, err := cid.GetAttributeValue(stub, attrEnrollmentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribute %v", err)
+	}
+	if !ok || id == "" {
+		if id, err = cid.GetID(stub); err != nil {
+			return nil, fmt.Errorf("failed to get id %v", err)
+		}
+	}
+	caller.Account = memberAccount(org, id)
+	if caller.Role, _, err = cid.GetAttributeValue(stub, attrRole); err != nil {
+		return nil, fmt.Errorf("failed to get attribute %v", err)
+	}
+	limit, ok, err := cid.GetAttributeValue(stub, attrLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribute %v", err)
+	}
+	if ok {
+		amount, err := ParseAmount(limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit attribute, got %s", limit)
+		}
+		caller.Limit = &amount
+	}
+	return caller, nil
+}
+
+// checkSpend 检查调用者能否从个人账户支付amount，按组织记账时不检查
+func (caller *Caller) checkSpend(amount Amount) error {
+	if caller.Account == caller.Org {
+		return nil
+	}
+	if caller.Role != MemberPurchaser {
+		return fmt.Errorf("only for %s, got %q", MemberPurchaser, caller.Role)
+	}
+	if caller.Limit != nil && amount.Cmp(*caller.Limit) > 0 {
+		return fmt.Errorf("amount %s exceeds limit %s", amount, caller.Limit)
+	}
+	return nil
+}
+
+func getAccountMode(stub shim.ChaincodeStubInterface) (string, error) {
+	val, err := stub.GetState(PrefixAccountMode)
+	if err != nil {
+		return "", err
+	}
+	if len(val) == 0 {
+		return AccountModeOrg, nil
+	}
+	return string(val), nil
+}
+
+func putAccountMode(stub shim.ChaincodeStubInterface, mode string) error {
+	if mode != AccountModeOrg && mode != AccountModeIdentity {
+		return fmt.Errorf("invalid account mode, got %s", mode)
+	}
+	return stub.PutState(PrefixAccountMode, []byte(mode))
+}
+
+// getMyAccount 查询调用者的资金账户、证书属性和余额
+func (c *Contract) getMyAccount(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	balance, err := getBalance(stub, caller.Account)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get balance, %v", err))
+	}
+	data, err := json.Marshal(struct {
+		*Caller
+		Balance Amount `json:"balance"`
+	}{caller, balance})
+	if err != nil {
+		return shim.Error("failed to marshal response")
+	}
+	return shim.Success(data)
+}
+
+// allocate 财务从组织账户划转资金到成员的个人账户，参数 [memberID, amount]
+func (c *Contract) allocate(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return moveMemberFunds(stub, args, true)
+}
+
+// reclaim 财务从成员的个人账户收回资金到组织账户，参数 [memberID, amount]
+func (c *Contract) reclaim(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return moveMemberFunds(stub, args, false)
+}
+
+func moveMemberFunds(stub shim.ChaincodeStubInterface, args []string, toMember bool) peer.Response {
+	if len(args) != 2 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller.Account == caller.Org {
+		return shim.Error("member accounts are only available in identity account mode")
+	}
+	if caller.Role != MemberTreasurer {
+		return shim.Error(fmt.Sprintf("only for %s, got %q", MemberTreasurer, caller.Role))
+	}
+	amount, err := ParseAmount(args[1])
+	if err != nil {
+		return shim.Error("invalid amount")
+	}
+	from, to := caller.Org, memberAccount(caller.Org, args[0])
+	if !toMember {
+		from, to = to, from
+	}
+	if err := transfer(stub, from, to, amount); err != nil {
+		return shim.Error(fmt.Sprintf("failed to transfer %v", err))
+	}
+	return shim.Success(nil)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIdentityAccounts(t *testing.T) {
+	s := newTestStub(t)
+	genesis := strings.Replace(testGenesis, `"decimals": 2`, `"decimals": 2, "accountMode": "identity"`, 1)
+	if res := s.init(orgPayment, genesis); res.Status != 200 {
+		t.Fatalf("init failed: %s", res.Message)
+	}
+	s.mustInvoke(orgLCD, "setMaterialPrice", "LCD", "100")
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "300", "LCD_1")
+	s.mustInvoke(orgPayment, "mint", orgTV, "100000")
+
+	alice := map[string]string{attrEnrollmentID: "alice", attrRole: MemberPurchaser, attrLimit: "1000"}
+	bob := map[string]string{attrEnrollmentID: "bob", attrRole: MemberTreasurer}
+	carol := map[string]string{attrEnrollmentID: "carol"}
+	invoke := func(attrs map[string]string, fn string, args ...string) ([]byte, string) {
+		t.Helper()
+		res := s.call(orgTV, attrs, false, fn, args...)
+		return res.Payload, res.Message
+	}
+
+	// 只有财务可以给成员划转资金
+	if _, msg := invoke(alice, "allocate", "alice", "5000"); !strings.Contains(msg, "only for treasurer") {
+		t.Fatalf("unexpected error %s", msg)
+	}
+	if _, msg := invoke(bob, "allocate", "alice", "5000"); msg != "" {
+		t.Fatal(msg)
+	}
+	s.expectBalance(orgTV, 95000)
+	s.expectBalance(memberAccount(orgTV, "alice"), 5000)
+
+	// 采购员用个人账户下单，单笔金额不能超过证书中的上限
+	if _, msg := invoke(alice, "makeMaterialOrder", orgLCD, "LCD", "20", "100"); !strings.Contains(msg, "exceeds limit") {
+		t.Fatalf("unexpected error %s", msg)
+	}
+	if _, msg := invoke(carol, "makeMaterialOrder", orgLCD, "LCD", "5", "100"); !strings.Contains(msg, "only for purchaser") {
+		t.Fatalf("unexpected error %s", msg)
+	}
+	payload, msg := invoke(alice, "makeMaterialOrder", orgLCD, "LCD", "10", "100")
+	if msg != "" {
+		t.Fatal(msg)
+	}
+	var order Order
+	if err := json.Unmarshal(payload, &order); err != nil {
+		t.Fatal(err)
+	}
+	if order.Payer != orgTV || order.PayerAccount != memberAccount(orgTV, "alice") {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	payload, msg = invoke(alice, "getMyAccount")
+	if msg != "" {
+		t.Fatal(msg)
+	}
+	var account struct {
+		Caller
+		Balance Amount `json:"balance"`
+	}
+	if err := json.Unmarshal(payload, &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Account != memberAccount(orgTV, "alice") || account.Balance.String() != "4000.00" ||
+		account.Limit.String() != "1000.00" {
+		t.Fatalf("unexpected account %+v", account)
+	}
+
+	// 退款退回下单者个人账户，货物仍归组织
+	s.mustInvoke(orgLCD, "rejectOrder", order.OrderID)
+	s.expectBalance(memberAccount(orgTV, "alice"), 5000)
+	s.expectBalance(orgTV, 95000)
+	if _, msg := invoke(bob, "reclaim", "alice", "5000"); msg != "" {
+		t.Fatal(msg)
+	}
+	s.expectBalance(orgTV, 100000)
+
+	// 按身份记账时可以转给已知组织的成员账户
+	if _, msg := invoke(bob, "allocate", "alice", "10"); msg != "" {
+		t.Fatal(msg)
+	}
+	for _, to := range []string{"unknown/dave", orgLCD + "/"} {
+		if _, msg := invoke(alice, "transfer", to, "10"); !strings.Contains(msg, "receiver") {
+			t.Fatalf("unexpected error %s", msg)
+		}
+	}
+	if _, msg := invoke(alice, "transfer", memberAccount(orgLCD, "dave"), "10"); msg != "" {
+		t.Fatal(msg)
+	}
+	s.expectBalance(memberAccount(orgLCD, "dave"), 10)
+}
+
+func TestOrgAccounts(t *testing.T) {
+	s := setupOrder(t)
+	// 按组织记账时忽略证书属性，组织成员共用组织账户
+	res := s.call(orgTV, map[string]string{attrEnrollmentID: "alice", attrLimit: "1"}, false,
+		"makeMaterialOrder", orgLCD, "LCD", "10", "100")
+	if res.Status != 200 {
+		t.Fatal(res.Message)
+	}
+	s.expectBalance(orgTV, 99000)
+	s.mustFail(orgTV, "allocate", "alice", "100")
+}
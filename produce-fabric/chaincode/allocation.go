@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// 物料出库(转移、消耗)时选择批次的策略，也可以在调用时指定批次列表
+const (
+	AllocFIFO = "fifo" // 先进先出，按批次的生产时间，默认策略
+	AllocFEFO = "fefo" // 先到期先出，按批次的过期时间，没有过期时间的批次最后使用
+)
+
+// BatchAllocation 出库时从一个批次中取出的数量
+type BatchAllocation struct {
+	BatchID string `json:"batchID"`
+	Num     uint64 `json:"num"`
+}
+
+// batchStock 持有者某个批次的库存
+type batchStock struct {
+	key      string
+	num      uint64
+	material *Material
+}
+
+// setAllocationPolicy 设置调用者的物料出库策略，参数 [policy]，fifo或fefo
+func (c *Contract) setAllocationPolicy(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 || (args[0] != AllocFIFO && args[0] != AllocFEFO) {
+		return shim.Error("invalid arguments")
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixAllocPolicy, role), []byte(args[0])); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state, %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// getAllocationPolicy 查询某个组织的物料出库策略，参数 [org]
+func (c *Contract) getAllocationPolicy(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	policy, err := getAllocationPolicy(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(policy))
+}
+
+func getAllocationPolicy(stub shim.ChaincodeStubInterface, org string) (string, error) {
+	val, err := stub.GetState(fmt.Sprintf("%s-%s", PrefixAllocPolicy, org))
+	if err != nil {
+		return "", fmt.Errorf("failed to get state, %v", err)
+	}
+	if len(val) == 0 {
+		return AllocFIFO, nil
+	}
+	return string(val), nil
+}
+
+// materialRequest 一次出库的数量和指定的批次，batches为空时按出库策略选择
+type materialRequest struct {
+	num     uint64
+	batches []string
+}
+
+// allocateMaterial 从owner的库存中为num个materialType选择批次，只计算不修改库存。
+// store不为空时从owner寄存在该门店的物料中选择。
+// batches不为空时按给出的顺序只从这些批次中取，否则按owner的出库策略排序。
+// 已召回或已过期的批次不能出库，指定了这样的批次时返回错误，否则跳过。
+// 返回每个批次取出的数量和对应的库存
+func allocateMaterial(stub shim.ChaincodeStubInterface, owner, store, materialType string, num uint64, batches []string) ([]BatchAllocation, []batchStock, error) {
+	return allocateMaterialRequests(stub, owner, store, materialType, []materialRequest{{num: num, batches: batches}})
+}
+
+// allocateMaterialRequests 依次为每个请求选择批次，规则同allocateMaterial。
+// 前面的请求取过的数量不会再分给后面的请求，同一批次取多次时合并为一项，返回的库存是出库前的数量
+func allocateMaterialRequests(stub shim.ChaincodeStubInterface, owner, store, materialType string, reqs []materialRequest) ([]BatchAllocation, []batchStock, error) {
+	stocks, err := getBatchStocks(stub, owner, store, materialType)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Unix(t.GetSeconds(), 0)
+	byID := make(map[string]batchStock, len(stocks))
+	left := make(map[string]uint64, len(stocks))
+	for _, stock := range stocks {
+		byID[stock.material.BatchID] = stock
+		left[stock.material.BatchID] = stock.num
+	}
+	var available []batchStock
+	var sorted bool
+	var allocs []BatchAllocation
+	var used []batchStock
+	index := make(map[string]int)
+	for _, req := range reqs {
+		candidates := available
+		if len(req.batches) > 0 {
+			if candidates, err = selectBatchStocks(stub, byID, req.batches, now); err != nil {
+				return nil, nil, err
+			}
+		} else if !sorted {
+			if available, err = availableBatchStocks(stub, owner, stocks, now); err != nil {
+				return nil, nil, err
+			}
+			candidates, sorted = available, true
+		}
+		num := req.num
+		for _, stock := range candidates {
+			if num == 0 {
+				break
+			}
+			batchID := stock.material.BatchID
+			take := left[batchID]
+			if take > num {
+				take = num
+			}
+			if take == 0 {
+				continue
+			}
+			left[batchID] -= take
+			num -= take
+			if i, ok := index[batchID]; ok {
+				allocs[i].Num += take
+				continue
+			}
+			index[batchID] = len(allocs)
+			allocs = append(allocs, BatchAllocation{BatchID: batchID, Num: take})
+			used = append(used, stock)
+		}
+		if num != 0 && len(req.batches) > 0 {
+			return nil, nil, fmt.Errorf("insufficient materials in batches %v, %d less", req.batches, num)
+		}
+		if num != 0 {
+			return nil, nil, fmt.Errorf("insufficient materials, %d less", num)
+		}
+	}
+	return allocs, used, nil
+}
+
+// selectBatchStocks 按给出的顺序返回batches中仍有库存的批次，有召回或过期的批次时返回错误
+func selectBatchStocks(stub shim.ChaincodeStubInterface, byID map[string]batchStock, batches []string, now time.Time) ([]batchStock, error) {
+	selected := make([]batchStock, 0, len(batches))
+	seen := make(map[string]bool, len(batches))
+	for _, batchID := range batches {
+		recall, err := getRecall(stub, batchID)
+		if err != nil {
+			return nil, err
+		}
+		if recall != nil {
+			return nil, fmt.Errorf("material batch(%s) is recalled", batchID)
+		}
+		// 已经用完的批次跳过，数量不够时返回错误
+		if stock, ok := byID[batchID]; ok && !seen[batchID] {
+			if stock.material.expired(now) {
+				return nil, fmt.Errorf("material batch(%s) is expired", batchID)
+			}
+			seen[batchID] = true
+			selected = append(selected, stock)
+		}
+	}
+	return selected, nil
+}
+
+// availableBatchStocks 去掉召回和过期的批次，按owner的出库策略排序
+func availableBatchStocks(stub shim.ChaincodeStubInterface, owner string, stocks []batchStock, now time.Time) ([]batchStock, error) {
+	available := make([]batchStock, 0, len(stocks))
+	for _, stock := range stocks {
+		recall, err := getRecall(stub, stock.material.BatchID)
+		if err != nil {
+			return nil, err
+		}
+		if recall == nil && !stock.material.expired(now) {
+			available = append(available, stock)
+		}
+	}
+	policy, err := getAllocationPolicy(stub, owner)
+	if err != nil {
+		return nil, err
+	}
+	sortBatchStocks(available, policy)
+	return available, nil
+}
+
+// getBatchStocks 读取owner持有的某种物料的全部批次及批次信息，store不为空时读取寄存在该门店的部分
+func getBatchStocks(stub shim.ChaincodeStubInterface, owner, store, materialType string) ([]batchStock, error) {
+	prefix, keys := PrefixMaterialPreserve, []string{owner, materialType}
+	if store != "" {
+		prefix, keys = PrefixMaterialCustody, []string{store, owner, materialType}
+	}
+	iter, err := stub.GetStateByPartialCompositeKey(prefix, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	var stocks []batchStock
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(attr) != len(keys)+1 {
+			return nil, fmt.Errorf("internal key format wrong")
+		}
+		batchID := attr[len(keys)]
+		material, err := getMaterialBatch(stub, batchID)
+		if err != nil {
+			return nil, err
+		}
+		if material == nil {
+			material = &Material{BatchID: batchID, MaterialType: materialType}
+		}
+		stocks = append(stocks, batchStock{key: kv.Key, num: bytesToUint64(kv.Value), material: material})
+	}
+	return stocks, nil
+}
+
+// expired 批次的过期时间是否早于now，没有过期时间的批次不会过期
+func (m *Material) expired(now time.Time) bool {
+	return m.ExpiresAt != nil && m.ExpiresAt.Before(now)
+}
+
+// sortBatchStocks 按出库策略排序，时间相同时按批次ID
+func sortBatchStocks(stocks []batchStock, policy string) {
+	sort.SliceStable(stocks, func(i, j int) bool {
+		a, b := stocks[i].material, stocks[j].material
+		if policy == AllocFEFO {
+			switch {
+			case a.ExpiresAt != nil && b.ExpiresAt == nil:
+				return true
+			case a.ExpiresAt == nil && b.ExpiresAt != nil:
+				return false
+			case a.ExpiresAt != nil && !a.ExpiresAt.Equal(*b.ExpiresAt):
+				return a.ExpiresAt.Before(*b.ExpiresAt)
+			}
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.BatchID < b.BatchID
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAllocateMaterial(t *testing.T) {
+	s := setupOrder(t)
+	// 批次ID的字典序与生产时间、过期时间都不一致
+	s.mustFail(orgLCD, "registerMaterial", "Panel", "100", "A10", "2020-13-01")
+	s.mustInvoke(orgLCD, "registerMaterial", "Panel", "100", "A10", "2020-12-01")
+	s.mustInvoke(orgLCD, "registerMaterial", "Panel", "100", "A9", "2020-06-01T00:00:00Z")
+	s.mustInvoke(orgLCD, "registerMaterial", "Panel", "100", "A11")
+
+	consume := func(args ...string) string {
+		t.Helper()
+		var allocs []BatchAllocation
+		if err := json.Unmarshal(s.mustInvoke(orgLCD, "consumeMaterial", args...), &allocs); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(allocs)
+	}
+	if got := consume("Panel", "120"); got != "[{A10 100} {A9 20}]" {
+		t.Fatalf("unexpected fifo allocation %s", got)
+	}
+	var evt struct {
+		Batches []BatchAllocation `json:"batches"`
+	}
+	s.expectEvent("EvtMaterialConsumed", &evt)
+	if len(evt.Batches) != 2 {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+
+	s.mustFail(orgLCD, "setAllocationPolicy", "lifo")
+	s.mustInvoke(orgLCD, "setAllocationPolicy", AllocFEFO)
+	if got := string(s.mustInvoke(orgTV, "getAllocationPolicy", orgLCD)); got != AllocFEFO {
+		t.Fatalf("unexpected policy %s", got)
+	}
+	s.mustInvoke(orgLCD, "registerMaterial", "Panel", "100", "A8", "2020-09-01")
+	if got := consume("Panel", "100"); got != "[{A9 80} {A8 20}]" {
+		t.Fatalf("unexpected fefo allocation %s", got)
+	}
+
+	// 指定批次时只从这些批次中取
+	s.mustFail(orgLCD, "consumeMaterial", "Panel", "101", "A11")
+	if got := consume("Panel", "30", "A11", "A8"); got != "[{A11 30}]" {
+		t.Fatalf("unexpected explicit allocation %s", got)
+	}
+
+	// 物料订单发货时指定批次，收货时返回实际转移的批次
+	s.mustInvoke(orgLCD, "setMaterialPrice", "Panel", "10")
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "Panel", "80", "10")
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+	s.mustFail(orgLCD, "shipOrder", order.OrderID, "81")
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "", "A11", "A8")
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "confirmOrder", order.OrderID), &order); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(order.Deliveries[0].Batches); got != "[{A11 70} {A8 10}]" {
+		t.Fatalf("unexpected delivery batches %s", got)
+	}
+	s.expectEvent("EvtMaterialTransferred", &evt)
+	if len(evt.Batches) != 2 {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+	s.expectMaterials(orgTV, map[string]uint64{"Panel": 80})
+	s.expectMaterials(orgLCD, map[string]uint64{"LCD": 300, "Panel": 70})
+
+	// 召回的批次不能出库，按策略选择时跳过，指定时返回错误
+	s.mustInvoke(orgLCD, "registerMaterial", "Panel", "100", "A12")
+	s.mustInvoke(orgLCD, "recallBatch", "A8", "crack")
+	if got := consume("Panel", "50"); got != "[{A12 50}]" {
+		t.Fatalf("unexpected allocation %s", got)
+	}
+	s.mustFail(orgLCD, "consumeMaterial", "Panel", "10", "A8")
+	s.mustFail(orgLCD, "consumeMaterial", "Panel", "10", "A12", "A8")
+	s.mustFail(orgTV, "consumeMaterial", "Panel", "10", "A8")
+	order = s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "Panel", "60", "10")
+	s.shipOrder(orgLCD, order.OrderID)
+	s.mustFail(orgTV, "confirmOrder", order.OrderID)
+
+	// 过期的批次不能出库，按策略选择时跳过，指定时返回错误
+	s.mustInvoke(orgLCD, "registerMaterial", "Panel", "100", "A7", "2020-05-01")
+	if got := consume("Panel", "10"); got != "[{A12 10}]" {
+		t.Fatalf("unexpected allocation %s", got)
+	}
+	s.mustFail(orgLCD, "consumeMaterial", "Panel", "10", "A7")
+
+	// 发货时检查指定批次的库存，收货时按发货顺序使用各次发货的批次
+	s.mustInvoke(orgLCD, "registerMaterial", "Panel", "50", "A13")
+	s.mustInvoke(orgLCD, "registerMaterial", "Panel", "50", "A14")
+	order = s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "Panel", "60", "10")
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+	s.mustFail(orgLCD, "shipOrder", order.OrderID, "20", "A99")
+	s.mustFail(orgLCD, "shipOrder", order.OrderID, "20", "A7")
+	s.mustFail(orgLCD, "shipOrder", order.OrderID, "60", "A13")
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "20", "A13")
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "40", "A14")
+	for _, want := range []string{"[{A13 20} {A14 10}]", "[{A14 30}]"} {
+		if err := json.Unmarshal(s.mustInvoke(orgTV, "confirmOrder", order.OrderID, "30"), &order); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(order.Deliveries[len(order.Deliveries)-1].Batches); got != want {
+			t.Fatalf("unexpected delivery batches %s", got)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// ErrAmountOverflow 金额超过上限
+var ErrAmountOverflow = errors.New("ErrAmountOverflow: amount exceeds 2^256-1")
+
+// ErrInsufficientAmount 金额不足以扣减
+var ErrInsufficientAmount = errors.New("insufficient balance")
+
+// maxAmount 金额上限，与Solidity的uint256一致
+var maxAmount = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// maxDecimals 小数位数上限
+const maxDecimals = 18
+
+// amountDecimals 当前账本的货币小数位数，每次调用开始时由loadDecimals从账本读取，用于解析和格式化金额。
+// 小数位数在账本有数据之后不能再修改，并发的调用读到的都是同一个值
+var amountDecimals int32
+
+// Amount 金额(余额、价格、订单金额)，内部是以最小单位计的非负大整数，
+// 最小单位是 10^-decimals 个货币单位，decimals在Init时设置。
+// 参数和JSON中是带decimals位小数的十进制字符串，JSON同时兼容早期版本的数字，余额和价格的账本值是最小单位的整数。
+// Amount不可变，所有运算都返回新值，超过上限时返回ErrAmountOverflow
+type Amount struct {
+	i *big.Int // nil表示0
+}
+
+// NewAmount 由uint64构造金额
+func NewAmount(v uint64) Amount {
+	return Amount{i: new(big.Int).SetUint64(v)}
+}
+
+// ParseAmount 解析以货币单位表示的十进制金额，例如"12.5"，小数部分不能超过decimals位
+func ParseAmount(s string) (Amount, error) {
+	integer, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		integer, fraction = s[:i], s[i+1:]
+		if !isDigits([]byte(fraction)) {
+			return Amount{}, fmt.Errorf("invalid amount, got %s", s)
+		}
+	}
+	if !isDigits([]byte(integer)) {
+		return Amount{}, fmt.Errorf("invalid amount, got %s", s)
+	}
+	decimals := getAmountDecimals()
+	if len(fraction) > decimals {
+		return Amount{}, fmt.Errorf("invalid amount, got %s, at most %d decimal places", s, decimals)
+	}
+	return parseUnits(integer + fraction + strings.Repeat("0", decimals-len(fraction)))
+}
+
+// parseUnits 解析以最小单位表示的十进制整数
+func parseUnits(s string) (Amount, error) {
+	if !isDigits([]byte(s)) {
+		return Amount{}, fmt.Errorf("invalid amount, got %s", s)
+	}
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return Amount{}, fmt.Errorf("invalid amount, got %s", s)
+	}
+	return checkAmount(i)
+}
+
+func checkAmount(i *big.Int) (Amount, error) {
+	if i.Cmp(maxAmount) > 0 {
+		return Amount{}, ErrAmountOverflow
+	}
+	return Amount{i: i}, nil
+}
+
+func (a Amount) int() *big.Int {
+	if a.i == nil {
+		return new(big.Int)
+	}
+	return a.i
+}
+
+// Add 加法
+func (a Amount) Add(b Amount) (Amount, error) {
+	return checkAmount(new(big.Int).Add(a.int(), b.int()))
+}
+
+// Sub 减法，不够减时返回ErrInsufficientAmount
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if a.Cmp(b) < 0 {
+		return Amount{}, ErrInsufficientAmount
+	}
+	return Amount{i: new(big.Int).Sub(a.int(), b.int())}, nil
+}
+
+// MulUint64 乘以数量
+func (a Amount) MulUint64(n uint64) (Amount, error) {
+	return checkAmount(new(big.Int).Mul(a.int(), new(big.Int).SetUint64(n)))
+}
+
+// DivUint64 除以数量，向下取整，n为0时返回0
+func (a Amount) DivUint64(n uint64) Amount {
+	if n == 0 {
+		return Amount{}
+	}
+	return Amount{i: new(big.Int).Quo(a.int(), new(big.Int).SetUint64(n))}
+}
+
+// Percent 按百分比计算，向下取整，percent不超过100所以不会溢出
+func (a Amount) Percent(percent uint64) Amount {
+	i := new(big.Int).Mul(a.int(), new(big.Int).SetUint64(percent))
+	return Amount{i: i.Quo(i, big.NewInt(100))}
+}
+
+// Min 返回较小的金额
+func (a Amount) Min(b Amount) Amount {
+	if a.Cmp(b) > 0 {
+		return b
+	}
+	return a
+}
+
+// Cmp 比较大小
+func (a Amount) Cmp(b Amount) int {
+	return a.int().Cmp(b.int())
+}
+
+// IsZero 是否为0
+func (a Amount) IsZero() bool {
+	return a.int().Sign() == 0
+}
+
+// String 以货币单位格式化，固定为decimals位小数
+func (a Amount) String() string {
+	s := a.int().String()
+	decimals := getAmountDecimals()
+	if decimals == 0 {
+		return s
+	}
+	if len(s) <= decimals {
+		s = strings.Repeat("0", decimals-len(s)+1) + s
+	}
+	return s[:len(s)-decimals] + "." + s[len(s)-decimals:]
+}
+
+// MarshalJSON 序列化为十进制字符串，避免客户端按浮点数解析时丢失精度
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(a.String())), nil
+}
+
+// UnmarshalJSON 兼容字符串和早期版本的数字
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		*a = Amount{}
+		return nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	v, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// amountToBytes 账本中的金额保存为最小单位的十进制整数
+func amountToBytes(a Amount) []byte {
+	return []byte(a.int().String())
+}
+
+// bytesToAmount 读取账本中的金额，为空时返回0。
+// 早期版本保存的是8字节大端uint64，全部为数字字符的8字节值对应的uint64超过3*10^18，
+// 实际不会出现，所以先按十进制字符串解析，再按旧格式解析
+func bytesToAmount(b []byte) (Amount, error) {
+	if len(b) == 0 {
+		return Amount{}, nil
+	}
+	if isDigits(b) {
+		return parseUnits(string(b))
+	}
+	if isLegacyAmount(b) {
+		return NewAmount(binary.BigEndian.Uint64(b)), nil
+	}
+	return Amount{}, fmt.Errorf("data in db with wrong format")
+}
+
+func isLegacyAmount(b []byte) bool {
+	return len(b) == 8 && !isDigits(b)
+}
+
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// initDecimals 设置货币的小数位数，参数为空时保持不变(默认0)。
+// 只能在账本没有数据时设置，设置后不能修改，否则账本中已有的金额含义会改变
+func initDecimals(stub shim.ChaincodeStubInterface, arg string) error {
+	if arg == "" {
+		return nil
+	}
+	decimals, err := strconv.Atoi(arg)
+	if err != nil || decimals < 0 || decimals > maxDecimals {
+		return fmt.Errorf("invalid decimals, got %s", arg)
+	}
+	val, err := stub.GetState(PrefixDecimals)
+	if err != nil {
+		return fmt.Errorf("failed to get state %v", err)
+	}
+	if len(val) > 0 {
+		if int(val[0]) != decimals {
+			return fmt.Errorf("decimals is already set to %d", val[0])
+		}
+		return nil
+	}
+	if decimals != 0 {
+		iter, err := stub.GetStateByRange("", "")
+		if err != nil {
+			return fmt.Errorf("failed to get state by range %v", err)
+		}
+		defer iter.Close()
+		if iter.HasNext() {
+			return fmt.Errorf("decimals can only be set on an empty ledger")
+		}
+	}
+	return stub.PutState(PrefixDecimals, []byte{byte(decimals)})
+}
+
+// getDecimals 读取账本中的小数位数，没有设置时为0
+func getDecimals(stub shim.ChaincodeStubInterface) (int, error) {
+	val, err := stub.GetState(PrefixDecimals)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get state %v", err)
+	}
+	if len(val) == 0 {
+		return 0, nil
+	}
+	return int(val[0]), nil
+}
+
+// loadDecimals 读取账本中的小数位数，供本次调用解析和格式化金额
+func loadDecimals(stub shim.ChaincodeStubInterface) error {
+	decimals, err := getDecimals(stub)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&amountDecimals, int32(decimals))
+	return nil
+}
+
+func getAmountDecimals() int {
+	return int(atomic.LoadInt32(&amountDecimals))
+}
+
+func (c *Contract) getDecimals(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	decimals, err := getDecimals(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.Itoa(decimals)))
+}
+
+// migrateAmounts 将早期版本8字节格式的余额和价格改写为十进制字符串，参数 [limit]，
+// 返回本次改写的条数，为0时迁移完成。旧格式在迁移前也可以正常读取
+func (c *Contract) migrateAmounts(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if _, err := requireRole(stub, RolePayment); err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) > 1 {
+		return shim.Error("invalid arguments")
+	}
+	limit := defaultPageSize
+	if len(args) == 1 && args[0] != "" {
+		var err error
+		if limit, err = strconv.Atoi(args[0]); err != nil || limit <= 0 || limit > maxPageSize {
+			return shim.Error(fmt.Sprintf("invalid limit, got %s", args[0]))
+		}
+	}
+	migrated := 0
+	for _, prefix := range []string{PrefixBalance, PrefixMaterialPrice, PrefixProductPrice} {
+		// 这些都是 '%s-...' 形式的普通key，'.'紧跟在'-'之后
+		iter, err := stub.GetStateByRange(prefix+"-", prefix+".")
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get state by range %v", err))
+		}
+		for iter.HasNext() && migrated < limit {
+			kv, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+			}
+			if !isLegacyAmount(kv.Value) {
+				continue
+			}
+			amount, err := bytesToAmount(kv.Value)
+			if err != nil {
+				iter.Close()
+				return shim.Error(err.Error())
+			}
+			if err := stub.PutState(kv.Key, amountToBytes(amount)); err != nil {
+				iter.Close()
+				return shim.Error(fmt.Sprintf("failed to put state %v", err))
+			}
+			migrated++
+		}
+		iter.Close()
+	}
+	return shim.Success([]byte(strconv.Itoa(migrated)))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAmount(t *testing.T) {
+	atomic.StoreInt32(&amountDecimals, 0)
+	max := maxAmount.String()
+	a, err := ParseAmount(max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Add(NewAmount(1)); err != ErrAmountOverflow {
+		t.Fatalf("expected overflow, got %v", err)
+	}
+	if _, err := ParseAmount(max + "0"); err != ErrAmountOverflow {
+		t.Fatalf("expected overflow, got %v", err)
+	}
+	for _, s := range []string{"", "-1", "1.5", "1e3", "abc"} {
+		if _, err := ParseAmount(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+	if _, err := NewAmount(1).Sub(NewAmount(2)); err != ErrInsufficientAmount {
+		t.Fatalf("expected insufficient, got %v", err)
+	}
+
+	// JSON中为字符串，兼容早期版本的数字
+	var o struct {
+		Amount Amount `json:"amount"`
+		Paid   Amount `json:"paid"`
+	}
+	if err := json.Unmarshal([]byte(`{"amount":1000,"paid":"20"}`), &o); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"amount":"1000","paid":"20"}` {
+		t.Fatalf("unexpected json %s", data)
+	}
+
+	// 账本中的十进制字符串和早期版本的8字节格式
+	for b, want := range map[string]string{"12345678": "12345678", string(uint64ToBytes(300)): "300", "": "0"} {
+		a, err := bytesToAmount([]byte(b))
+		if err != nil || a.String() != want {
+			t.Fatalf("bytesToAmount(%x) = %s, %v", b, a, err)
+		}
+	}
+}
+
+func TestAmountOverflow(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgAudio, "setMaterialPrice", "Audio", maxAmount.String())
+	msg := s.mustFail(orgTV, "makeMaterialOrder", orgAudio, "Audio", "2", maxAmount.String())
+	if !strings.Contains(msg, "ErrAmountOverflow") {
+		t.Fatalf("unexpected error %s", msg)
+	}
+	s.mustInvoke(orgPayment, "mint", orgTV, maxAmount.String()[1:])
+	if msg := s.mustFail(orgPayment, "mint", orgTV, maxAmount.String()); !strings.Contains(msg, "ErrAmountOverflow") {
+		t.Fatalf("unexpected error %s", msg)
+	}
+}
+
+func TestDecimals(t *testing.T) {
+	s := newTestStub(t)
+	if d := string(s.mustInvoke(orgTV, "getDecimals")); d != "0" {
+		t.Fatalf("unexpected decimals %s", d)
+	}
+	if res := s.init(orgPayment, "2"); res.Status != 200 {
+		t.Fatal(res.Message)
+	}
+	if d := string(s.mustInvoke(orgTV, "getDecimals")); d != "2" {
+		t.Fatalf("unexpected decimals %s", d)
+	}
+	// 升级时可以省略或者重复相同的值，但不能修改
+	if res := s.init(orgPayment); res.Status != 200 {
+		t.Fatal(res.Message)
+	}
+	if res := s.init(orgPayment, "6"); res.Status == 200 {
+		t.Fatal("decimals changed")
+	}
+	if res := s.init(orgPayment, "19"); res.Status == 200 {
+		t.Fatal("invalid decimals accepted")
+	}
+
+	// 参数和返回值以货币单位计，小数不能超过2位，账本中的余额是最小单位
+	s.mustInvoke(orgPayment, "mint", orgTV, "12.5")
+	s.mustInvoke(orgPayment, "mint", orgTV, "3")
+	s.mustFail(orgPayment, "mint", orgTV, "0.001")
+	s.mustFail(orgPayment, "mint", orgTV, "1.")
+	s.mustFail(orgPayment, "mint", orgTV, ".5")
+	if got := string(s.mustInvoke(orgPayment, "balanceOf", orgTV)); got != `{"product.tv":"15.50"}` {
+		t.Fatalf("unexpected balance %s", got)
+	}
+	if val := s.State[fmt.Sprintf("%s-%s", PrefixBalance, orgTV)]; string(val) != "1550" {
+		t.Fatalf("unexpected state %q", val)
+	}
+	s.mustInvoke(orgLCD, "setMaterialPrice", "LCD", "0.05")
+	if got := string(s.mustInvoke(orgTV, "getMaterialPrice", orgLCD, "LCD")); got != "0.05" {
+		t.Fatalf("unexpected price %s", got)
+	}
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "300", "LCD_1")
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "3", "0.05")
+	if order.Amount.String() != "0.15" {
+		t.Fatalf("unexpected order amount %s", order.Amount)
+	}
+
+	// 已经有数据的账本不能再设置小数位数
+	s = newTestStub(t)
+	s.mustInvoke(orgPayment, "mint", orgTV, "100")
+	if res := s.init(orgPayment, "2"); res.Status == 200 {
+		t.Fatal("decimals set on a ledger with data")
+	}
+}
+
+func TestMigrateAmounts(t *testing.T) {
+	s := newTestStub(t)
+	// 模拟早期版本写入的8字节余额和价格
+	s.MockTransactionStart("legacy")
+	for key, v := range map[string]uint64{
+		fmt.Sprintf("%s-%s", PrefixBalance, orgTV):                  1000,
+		fmt.Sprintf("%s-%s", PrefixBalance, orgLCD):                 500,
+		fmt.Sprintf("%s-%s-%s", PrefixMaterialPrice, orgLCD, "LCD"): 100,
+	} {
+		if err := s.MockStub.PutState(key, uint64ToBytes(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.MockTransactionEnd("legacy")
+
+	// 迁移前可以正常读写
+	s.expectBalance(orgTV, 1000)
+	s.mustInvoke(orgPayment, "mint", orgLCD, "1")
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "5", "100")
+	if order.Amount.String() != "500" {
+		t.Fatalf("unexpected order %+v", order)
+	}
+
+	// 余额已经在读写时改写为新格式，只剩价格需要迁移
+	s.mustFail(orgTV, "migrateAmounts")
+	if n := string(s.mustInvoke(orgPayment, "migrateAmounts")); n != "1" {
+		t.Fatalf("unexpected migrated count %s", n)
+	}
+	s.MockTransactionStart("legacy")
+	if err := s.MockStub.PutState(fmt.Sprintf("%s-%s", PrefixBalance, orgStore), uint64ToBytes(42)); err != nil {
+		t.Fatal(err)
+	}
+	s.MockTransactionEnd("legacy")
+	if n := string(s.mustInvoke(orgPayment, "migrateAmounts", "10")); n != "1" {
+		t.Fatalf("unexpected migrated count %s", n)
+	}
+	if val := s.State[fmt.Sprintf("%s-%s", PrefixBalance, orgStore)]; string(val) != "42" {
+		t.Fatalf("unexpected state %q", val)
+	}
+	s.expectBalance(orgStore, 42)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxTraceDepth 子部件嵌套的最大层数，溯源时超过这个层数返回错误
+const maxTraceDepth = 8
+
+// BOM 物料清单，可以同时包含物料和其他产品(子部件)
+type BOM struct {
+	Materials map[string]uint64 `json:"materials,omitempty"` //物料类型 => 每个产品的用量
+	Products  map[string]uint64 `json:"products,omitempty"`  //子部件的产品类型 => 每个产品的用量
+}
+
+// setBOM 产品生产者设置某种产品的物料清单，参数 [productType, materials, products]，
+// materials为物料类型到用量的JSON对象，例如 {"LCD": 1, "Board": 2}，products为子部件的产品类型到用量，可选。
+// 两者都为空时删除物料清单
+func (c *Contract) setBOM(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 && len(args) != 3 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	role, err := requireRole(stub, RoleProductProducer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key := fmt.Sprintf("%s-%s-%s", PrefixBOM, role, args[0])
+	var bom BOM
+	for i, m := range []*map[string]uint64{&bom.Materials, &bom.Products} {
+		if len(args) <= i+1 || args[i+1] == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(args[i+1]), m); err != nil {
+			return shim.Error(fmt.Sprintf("invalid bom %v", err))
+		}
+		for name, qty := range *m {
+			if name == "" || qty == 0 {
+				return shim.Error(fmt.Sprintf("invalid quantity for %q, got %d", name, qty))
+			}
+		}
+	}
+	if _, ok := bom.Products[args[0]]; ok {
+		return shim.Error(fmt.Sprintf("productType(%s) can not be a part of itself", args[0]))
+	}
+	if len(bom.Materials) == 0 && len(bom.Products) == 0 {
+		if err := stub.DelState(key); err != nil {
+			return shim.Error(fmt.Sprintf("failed to del state, %v", err))
+		}
+		return shim.Success(nil)
+	}
+	val, err := json.Marshal(bom)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal bom %v", err))
+	}
+	if err := stub.PutState(key, val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state, %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// getBOM 查询物料清单，参数 [producer, productType]
+func (c *Contract) getBOM(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("invalid arguments")
+	}
+	bom, err := getBOM(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if bom == nil {
+		return shim.Error(fmt.Sprintf("bom for productType(%s) not found", args[1]))
+	}
+	data, err := json.Marshal(bom)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal bom %v", err))
+	}
+	return shim.Success(data)
+}
+
+// getBOM 读取物料清单，没有设置时返回nil
+func getBOM(stub shim.ChaincodeStubInterface, producer, productType string) (*BOM, error) {
+	val, err := stub.GetState(fmt.Sprintf("%s-%s-%s", PrefixBOM, producer, productType))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state, %v", err)
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	var bom BOM
+	if err := json.Unmarshal(val, &bom); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal bom %v", err)
+	}
+	return &bom, nil
+}
+
+// produce 按物料清单生产产品，参数 [productType, ids, batchID, components]，ids为逗号分隔的产品ID。
+// 在一个交易中按出库策略从调用者的库存中扣除全部物料，并把每个产品实际用到的批次记为它的MaterialBatches。
+// 物料清单中有子部件时，components为逗号分隔的子部件产品ID，按顺序分给每个产品，为空时从调用者的库存中选取；
+// 用掉的子部件标记为已装入新产品，从库存中移除
+func (c *Contract) produce(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 && len(args) != 4 || args[0] == "" || args[1] == "" {
+		return shim.Error("invalid arguments")
+	}
+	productType, batchID := args[0], args[2]
+	ids, err := splitIDs(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var explicit []string
+	if len(args) == 4 && args[3] != "" {
+		if explicit, err = splitIDs(args[3]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	role, err := requireRole(stub, RoleProductProducer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bom, err := getBOM(stub, role, productType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if bom == nil {
+		return shim.Error(fmt.Sprintf("bom for productType(%s) not found", productType))
+	}
+	n := uint64(len(ids))
+	batches := make([][]string, n)
+	for _, materialType := range sortedKeys(bom.Materials) {
+		qty := bom.Materials[materialType]
+		if qty > math.MaxUint64/n {
+			return shim.Error(fmt.Sprintf("quantity of %s overflows", materialType))
+		}
+		allocs, err := consumeMaterial(stub, role, materialType, qty*n, nil)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to consume %s, %v", materialType, err))
+		}
+		// 按出库顺序把物料依次分给每个产品，一个产品的用量可能跨多个批次
+		i, need := 0, qty
+		for _, alloc := range allocs {
+			for left := alloc.Num; left > 0; {
+				take := left
+				if take > need {
+					take = need
+				}
+				batches[i] = appendUnique(batches[i], alloc.BatchID)
+				left -= take
+				if need -= take; need == 0 {
+					i, need = i+1, qty
+				}
+			}
+		}
+	}
+
+	components, err := allocateComponents(stub, role, bom.Products, ids, explicit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	products := make([]*ProductRecord, 0, n)
+	for i, id := range ids {
+		product, err := createProduct(stub, role, productType, id, batchID, batches[i], components[i])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, component := range components[i] {
+			if err := incorporateProduct(stub, component, id); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		products = append(products, &ProductRecord{ProductID: id, Product: product})
+	}
+	data, err := json.Marshal(products)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+// splitIDs 解析逗号分隔的产品ID，不能为空或重复
+func splitIDs(arg string) ([]string, error) {
+	ids := strings.Split(arg, ",")
+	if len(ids) > maxPageSize {
+		return nil, fmt.Errorf("too many products, max %d", maxPageSize)
+	}
+	seen := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		ids[i] = strings.TrimSpace(id)
+		if ids[i] == "" || seen[ids[i]] {
+			return nil, fmt.Errorf("invalid product ids, got %s", arg)
+		}
+		seen[ids[i]] = true
+	}
+	return ids, nil
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// allocateComponents 为每个新产品分配子部件，返回每个产品的子部件ID。
+// explicit不为空时只使用其中的产品，否则按产品ID顺序从owner的库存中选取
+func allocateComponents(stub shim.ChaincodeStubInterface, owner string, need map[string]uint64, ids, explicit []string) ([][]string, error) {
+	components := make([][]string, len(ids))
+	if len(need) == 0 {
+		if len(explicit) > 0 {
+			return nil, fmt.Errorf("bom has no components")
+		}
+		return components, nil
+	}
+	byType := make(map[string][]string)
+	for _, id := range explicit {
+		product, err := getProduct(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		if product.Owner != owner || !product.inStock() {
+			return nil, fmt.Errorf("product(%s) is not in stock", id)
+		}
+		if product.Custodian != "" {
+			return nil, fmt.Errorf("product(%s) is in custody of %s", id, product.Custodian)
+		}
+		if _, ok := need[product.ProductType]; !ok {
+			return nil, fmt.Errorf("productType(%s) of product(%s) is not in bom", product.ProductType, id)
+		}
+		byType[product.ProductType] = append(byType[product.ProductType], id)
+	}
+	for _, pType := range sortedKeys(need) {
+		total := need[pType] * uint64(len(ids))
+		candidates := byType[pType]
+		if len(explicit) == 0 {
+			var err error
+			if candidates, err = productsInStock(stub, owner, pType, total); err != nil {
+				return nil, err
+			}
+		}
+		if uint64(len(candidates)) != total {
+			return nil, fmt.Errorf("need %d %s, got %d", total, pType, len(candidates))
+		}
+		for _, id := range candidates {
+			depth, err := productDepth(stub, id, 1)
+			if err != nil {
+				return nil, err
+			}
+			if depth > maxTraceDepth {
+				return nil, fmt.Errorf("product nesting exceeds %d levels", maxTraceDepth)
+			}
+		}
+		for i := range ids {
+			components[i] = append(components[i], candidates[uint64(i)*need[pType]:uint64(i+1)*need[pType]]...)
+		}
+	}
+	return components, nil
+}
+
+// productDepth 返回产品id位于第depth层时，其最深的子部件所在的层数，超过maxTraceDepth时立即返回
+func productDepth(stub shim.ChaincodeStubInterface, id string, depth int) (int, error) {
+	if depth > maxTraceDepth {
+		return depth, nil
+	}
+	product, err := getProduct(stub, id)
+	if err != nil {
+		return 0, err
+	}
+	deepest := depth
+	for _, component := range product.Components {
+		d, err := productDepth(stub, component, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		if d > deepest {
+			deepest = d
+		}
+		if deepest > maxTraceDepth {
+			break
+		}
+	}
+	return deepest, nil
+}
+
+// productsInStock 按产品ID顺序返回owner库存中最多limit个某种产品
+func productsInStock(stub shim.ChaincodeStubInterface, owner, productType string, limit uint64) ([]string, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(PrefixProductPreserve, []string{owner, productType})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state, %v", err)
+	}
+	defer iter.Close()
+	var ids []string
+	for iter.HasNext() && uint64(len(ids)) < limit {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get iter next %v", err)
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(attr) != 3 {
+			return nil, fmt.Errorf("internal key format wrong")
+		}
+		ids = append(ids, attr[2])
+	}
+	return ids, nil
+}
+
+// incorporateProduct 把子部件标记为已装入parent，并从所有者的库存中移除
+func incorporateProduct(stub shim.ChaincodeStubInterface, id, parent string) error {
+	product, err := getProduct(stub, id)
+	if err != nil {
+		return err
+	}
+	product.IncorporatedInto = parent
+	product.Action = ProductActionIncorporated
+	product.OrderID = ""
+	product.DocType = DocTypeProduct
+	val, err := json.Marshal(product)
+	if err != nil {
+		return fmt.Errorf("failed to marshal product %v", err)
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixProduct, id), val); err != nil {
+		return fmt.Errorf("failed to put state %v", err)
+	}
+	ppkey, err := productStockKey(stub, product, id)
+	if err != nil {
+		return fmt.Errorf("failed to create ppkey %v", err)
+	}
+	if err := stub.DelState(ppkey); err != nil {
+		return fmt.Errorf("failed to del state %v", err)
+	}
+	evtData, err := json.Marshal(map[string]interface{}{
+		"id":     id,
+		"parent": parent,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event data %v", err)
+	}
+	if err := stub.SetEvent("EvtProductIncorporated", evtData); err != nil {
+		return fmt.Errorf("failed to set event %v", err)
+	}
+	return nil
+}
+
+// productAncestors 沿着IncorporatedInto向上找到装有该产品的各级产品，由近到远
+func productAncestors(stub shim.ChaincodeStubInterface, product *Product) ([]string, []*Product, error) {
+	var ids []string
+	var products []*Product
+	for product.IncorporatedInto != "" {
+		if len(ids) == maxTraceDepth {
+			return nil, nil, fmt.Errorf("product nesting exceeds %d levels", maxTraceDepth)
+		}
+		id := product.IncorporatedInto
+		parent, err := getProduct(stub, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		products = append(products, parent)
+		product = parent
+	}
+	return ids, products, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestProduce(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "100", "LCD_2")
+	for _, batch := range []struct{ id, count string }{{"LCD_1", "3"}, {"LCD_2", "10"}} {
+		order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", batch.count, "100")
+		s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+		s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "", batch.id)
+		s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	}
+
+	s.mustFail(orgLCD, "setBOM", "TV", `{"LCD": 2}`)
+	s.mustFail(orgTV, "setBOM", "TV", `{"LCD": 0}`)
+	s.mustFail(orgTV, "produce", "TV", "TV_1", "2020-05-20")
+	s.mustInvoke(orgTV, "setBOM", "TV", `{"LCD": 2}`)
+	var bom BOM
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "getBOM", orgTV, "TV"), &bom); err != nil {
+		t.Fatal(err)
+	}
+	if bom.Materials["LCD"] != 2 || bom.Products != nil {
+		t.Fatalf("unexpected bom %v", bom)
+	}
+	// 有物料清单时不能直接登记产品
+	s.mustFail(orgTV, "registerProduct", "TV", "TV_0", "2020-05-20", "LCD_1")
+	s.mustFail(orgTV, "produce", "TV", "TV_1,TV_1", "2020-05-20")
+	s.mustFail(orgTV, "produce", "TV", "TV_1,TV_2,TV_3,TV_4,TV_5,TV_6,TV_7", "2020-05-20")
+
+	var products []ProductRecord
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "produce", "TV", "TV_1,TV_2", "2020-05-20"), &products); err != nil {
+		t.Fatal(err)
+	}
+	s.expectEvents("EvtMaterialConsumed", "EvtProductCreated", "EvtProductCreated")
+	if len(products) != 2 || fmt.Sprint(products[0].MaterialBatches) != "[LCD_1]" ||
+		fmt.Sprint(products[1].MaterialBatches) != "[LCD_1 LCD_2]" {
+		t.Fatalf("unexpected products %+v %+v", products[0].Product, products[1].Product)
+	}
+	s.expectMaterials(orgTV, map[string]uint64{"LCD": 9})
+	s.expectProducts(orgTV, map[string]uint64{"TV": 2})
+
+	var page struct {
+		Records []string `json:"records"`
+	}
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "traceMaterialBatch", "LCD_2"), &page); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(page.Records) != "[TV_2]" {
+		t.Fatalf("unexpected trace %v", page.Records)
+	}
+
+	// 删除物料清单后可以直接登记
+	s.mustInvoke(orgTV, "setBOM", "TV", "")
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_0", "2020-05-20", "LCD_1")
+}
+
+func TestProduceSubAssembly(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgLCD, "setMaterialPrice", "Driver", "10")
+	s.mustInvoke(orgLCD, "registerMaterial", "Driver", "100", "DRV_1")
+	for _, materialType := range []string{"LCD", "Driver"} {
+		order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, materialType, "4", "100")
+		s.shipOrder(orgLCD, order.OrderID)
+		s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	}
+
+	// 面板由LCD和驱动板生产，电视由两块面板生产
+	s.mustInvoke(orgTV, "setBOM", "Panel", `{"LCD": 1, "Driver": 1}`)
+	s.mustInvoke(orgTV, "produce", "Panel", "P_1,P_2,P_3,P_4", "2020-05-20")
+	s.mustFail(orgTV, "setBOM", "Panel", "", `{"Panel": 1}`)
+	s.mustInvoke(orgTV, "setBOM", "TV", "", `{"Panel": 2}`)
+	s.mustFail(orgTV, "produce", "TV", "TV_1", "2020-05-21", "P_3")
+	s.mustFail(orgTV, "produce", "TV", "TV_1", "2020-05-21", "P_3,P_9")
+	s.mustInvoke(orgTV, "produce", "TV", "TV_1", "2020-05-21", "P_3,P_4")
+	s.expectEvents("EvtProductCreated", "EvtProductIncorporated", "EvtProductIncorporated")
+	s.mustInvoke(orgTV, "produce", "TV", "TV_2", "2020-05-21")
+	s.mustFail(orgTV, "produce", "TV", "TV_3", "2020-05-21")
+	s.expectProducts(orgTV, map[string]uint64{"TV": 2})
+
+	var product Product
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "getProduct", "P_1"), &product); err != nil {
+		t.Fatal(err)
+	}
+	if product.IncorporatedInto != "TV_2" || product.Action != ProductActionIncorporated {
+		t.Fatalf("unexpected product %+v", product)
+	}
+	s.mustFail(orgTV, "sellToConsumer", "P_1")
+
+	// 正向溯源包括装有子部件的上级产品，反向溯源包括子部件所用的批次
+	var ids struct {
+		Records []string `json:"records"`
+	}
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "traceMaterialBatch", "DRV_1"), &ids); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(ids.Records); got != "[P_1 TV_2 P_2 P_3 TV_1 P_4]" {
+		t.Fatalf("unexpected trace %s", got)
+	}
+	var batches struct {
+		Records []TracedBatch `json:"records"`
+	}
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "traceProduct", "TV_1"), &batches); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range batches.Records {
+		got = append(got, b.Via+":"+b.BatchID)
+	}
+	if fmt.Sprint(got) != "[P_3:DRV_1 P_3:LCD_1 P_4:DRV_1 P_4:LCD_1]" {
+		t.Fatalf("unexpected trace %v", got)
+	}
+
+	// 召回驱动板批次时一起召回装有这些面板的电视
+	var recall Recall
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "recallBatch", "DRV_1", "short circuit"), &recall); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(recall.Products); got != "[P_1 TV_2 P_2 P_3 TV_1 P_4]" {
+		t.Fatalf("unexpected recall %s", got)
+	}
+	s.expectProducts(orgTV, map[string]uint64{})
+}
+
+func TestProduceNestingLimit(t *testing.T) {
+	s := setupOrder(t)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "1", "100")
+	s.shipOrder(orgLCD, order.OrderID)
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+
+	// L0由LCD生产，之后每一层都装入上一层，嵌套超过maxTraceDepth层时拒绝生产
+	s.mustInvoke(orgTV, "setBOM", "L0", `{"LCD": 1}`)
+	s.mustInvoke(orgTV, "produce", "L0", "L0_1", "2020-05-20")
+	for i := 1; i <= maxTraceDepth+1; i++ {
+		pType := fmt.Sprintf("L%d", i)
+		s.mustInvoke(orgTV, "setBOM", pType, "", fmt.Sprintf(`{"L%d": 1}`, i-1))
+		if i > maxTraceDepth {
+			s.mustFail(orgTV, "produce", pType, pType+"_1", "2020-05-20")
+			break
+		}
+		s.mustInvoke(orgTV, "produce", pType, pType+"_1", "2020-05-20")
+	}
+	s.expectProducts(orgTV, map[string]uint64{fmt.Sprintf("L%d", maxTraceDepth): 1})
+	s.mustInvoke(orgLCD, "traceMaterialBatch", "LCD_1")
+	s.mustInvoke(orgTV, "traceProduct", fmt.Sprintf("L%d_1", maxTraceDepth))
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// 寄存货物的种类，与私有价格的kind一致
+const (
+	CustodyMaterial = RoleMaterialProducer
+	CustodyProduct  = RoleProductProducer
+)
+
+// ConsignedMaterial 寄存在门店的某个批次的物料
+type ConsignedMaterial struct {
+	Owner        string `json:"owner"`
+	MaterialType string `json:"materialType"`
+	BatchID      string `json:"batchID"`
+	Num          uint64 `json:"num"`
+}
+
+// ConsignedProduct 寄存在门店的产品
+type ConsignedProduct struct {
+	Owner       string `json:"owner"`
+	ProductType string `json:"productType"`
+	ProductID   string `json:"productID"`
+}
+
+// StoreStock 门店保管的货物
+type StoreStock struct {
+	Store     string              `json:"store"`
+	Materials []ConsignedMaterial `json:"materials"`
+	Products  []ConsignedProduct  `json:"products"`
+}
+
+// checkIn 所有者把货物寄存到门店，所有权不变，参数 [kind, store, id, num]。
+// kind为product时id为逗号分隔的产品ID，忽略num；kind为material时id为批次ID，num为寄存数量。
+// 寄存的货物不再出现在所有者的库存中，由门店用getStoreStock查询
+func (c *Contract) checkIn(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 3 || args[2] == "" {
+		return shim.Error("invalid arguments")
+	}
+	kind, store, id := args[0], args[1], args[2]
+	owner, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	if err := requireStore(stub, store, owner); err != nil {
+		return shim.Error(err.Error())
+	}
+	evt := map[string]interface{}{"store": store, "owner": owner, "kind": kind}
+	switch kind {
+	case CustodyProduct:
+		ids, err := splitIDs(id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, productID := range ids {
+			product, err := getProduct(stub, productID)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if product.Owner != owner || !product.inStock() {
+				return shim.Error(fmt.Sprintf("product(%s) is not in stock", productID))
+			}
+			if product.Custodian != "" {
+				return shim.Error(fmt.Sprintf("product(%s) is in custody of %s", productID, product.Custodian))
+			}
+			if err := changeProductCustodian(stub, product, productID, store, ProductActionCheckedIn); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		evt["ids"] = ids
+	case CustodyMaterial:
+		num, material, err := parseCustodyMaterial(stub, id, args[3:])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		from, err := stub.CreateCompositeKey(PrefixMaterialPreserve, []string{owner, material.MaterialType, id})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to create key %v", err))
+		}
+		to, err := stub.CreateCompositeKey(PrefixMaterialCustody, []string{store, owner, material.MaterialType, id})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to create key %v", err))
+		}
+		if err := moveMaterialStock(stub, from, to, num); err != nil {
+			return shim.Error(err.Error())
+		}
+		evt["materialType"], evt["batchID"], evt["num"] = material.MaterialType, id, num
+	default:
+		return shim.Error(fmt.Sprintf("invalid kind, got %s", kind))
+	}
+	if err := setCustodyEvent(stub, "EvtCheckIn", evt); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// checkOut 货物从门店退回所有者，参数 [kind, store, owner, id, num]，含义同checkIn，门店和所有者都可以调用。
+// 卖给其他组织的寄存货物不需要checkOut，在订单确认收货时直接从门店出库
+func (c *Contract) checkOut(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 4 || args[3] == "" {
+		return shim.Error("invalid arguments")
+	}
+	kind, store, owner, id := args[0], args[1], args[2], args[3]
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	if role != store && role != owner {
+		return shim.Error(fmt.Sprintf("permission denied for %s", role))
+	}
+	evt := map[string]interface{}{"store": store, "owner": owner, "to": owner, "kind": kind}
+	switch kind {
+	case CustodyProduct:
+		ids, err := splitIDs(id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, productID := range ids {
+			product, err := getProduct(stub, productID)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if product.Owner != owner || product.Custodian != store || !product.inStock() {
+				return shim.Error(fmt.Sprintf("product(%s) of %s is not in custody of %s", productID, owner, store))
+			}
+			if err := changeProductCustodian(stub, product, productID, "", ProductActionCheckedOut); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		evt["ids"] = ids
+	case CustodyMaterial:
+		num, material, err := parseCustodyMaterial(stub, id, args[4:])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		from, err := stub.CreateCompositeKey(PrefixMaterialCustody, []string{store, owner, material.MaterialType, id})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to create key %v", err))
+		}
+		to, err := stub.CreateCompositeKey(PrefixMaterialPreserve, []string{owner, material.MaterialType, id})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to create key %v", err))
+		}
+		if err := moveMaterialStock(stub, from, to, num); err != nil {
+			return shim.Error(err.Error())
+		}
+		evt["materialType"], evt["batchID"], evt["num"] = material.MaterialType, id, num
+	default:
+		return shim.Error(fmt.Sprintf("invalid kind, got %s", kind))
+	}
+	if err := setCustodyEvent(stub, "EvtCheckOut", evt); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// getStoreStock 查询门店保管的货物，参数 [store]。
+// 门店和payment可以看到全部货物，其他组织只能看到自己寄存的部分
+func (c *Contract) getStoreStock(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	store := args[0]
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	keys := []string{store}
+	if role != store && !isAuditor(stub, role) {
+		keys = append(keys, role)
+	}
+	stock := &StoreStock{Store: store, Materials: []ConsignedMaterial{}, Products: []ConsignedProduct{}}
+	for _, prefix := range []string{PrefixMaterialCustody, PrefixProductCustody} {
+		iter, err := stub.GetStateByPartialCompositeKey(prefix, keys)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+		}
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+			}
+			_, attr, err := stub.SplitCompositeKey(kv.Key)
+			if err != nil || len(attr) != 4 {
+				iter.Close()
+				return shim.Error("internal key format wrong")
+			}
+			if prefix == PrefixMaterialCustody {
+				stock.Materials = append(stock.Materials, ConsignedMaterial{
+					Owner: attr[1], MaterialType: attr[2], BatchID: attr[3], Num: bytesToUint64(kv.Value),
+				})
+			} else {
+				stock.Products = append(stock.Products, ConsignedProduct{Owner: attr[1], ProductType: attr[2], ProductID: attr[3]})
+			}
+		}
+		iter.Close()
+	}
+	data, err := json.Marshal(stock)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+// requireStore 检查store是门店，并且不是寄存货物的所有者自己
+func requireStore(stub shim.ChaincodeStubInterface, store, owner string) error {
+	if store == "" {
+		return fmt.Errorf("store is empty")
+	}
+	if store == owner {
+		return fmt.Errorf("owner can not be the store")
+	}
+	ok, err := hasRole(stub, store, RoleStore)
+	if err != nil {
+		return fmt.Errorf("failed to get roles %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("%s is not a store", store)
+	}
+	return nil
+}
+
+// parseCustodyMaterial 解析寄存物料的数量并读取批次信息
+func parseCustodyMaterial(stub shim.ChaincodeStubInterface, batchID string, args []string) (uint64, *Material, error) {
+	if len(args) != 1 {
+		return 0, nil, fmt.Errorf("num is required for material")
+	}
+	num, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil || num == 0 {
+		return 0, nil, fmt.Errorf("invalid num, got %s", args[0])
+	}
+	material, err := getMaterialBatch(stub, batchID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if material == nil {
+		return 0, nil, fmt.Errorf("material batch(%s) not found", batchID)
+	}
+	return num, material, nil
+}
+
+// moveMaterialStock 在两个库存key之间移动num个物料
+func moveMaterialStock(stub shim.ChaincodeStubInterface, from, to string, num uint64) error {
+	val, err := stub.GetState(from)
+	if err != nil {
+		return fmt.Errorf("failed to get state %v", err)
+	}
+	if bytesToUint64(val) < num {
+		return fmt.Errorf("insufficient materials, %d less", num-bytesToUint64(val))
+	}
+	if err := takeStock(stub, batchStock{key: from, num: bytesToUint64(val)}, num); err != nil {
+		return err
+	}
+	val, err = stub.GetState(to)
+	if err != nil {
+		return fmt.Errorf("failed to get state %v", err)
+	}
+	if err := stub.PutState(to, uint64ToBytes(bytesToUint64(val)+num)); err != nil {
+		return fmt.Errorf("failed to put state %v", err)
+	}
+	return nil
+}
+
+// productStockKey 产品所在的库存索引，寄存在门店的产品在门店的索引中
+func productStockKey(stub shim.ChaincodeStubInterface, product *Product, id string) (string, error) {
+	if product.Custodian != "" {
+		return stub.CreateCompositeKey(PrefixProductCustody, []string{product.Custodian, product.Owner, product.ProductType, id})
+	}
+	return stub.CreateCompositeKey(PrefixProductPreserve, []string{product.Owner, product.ProductType, id})
+}
+
+// changeProductCustodian 修改产品的保管方，custodian为空时退回所有者
+func changeProductCustodian(stub shim.ChaincodeStubInterface, product *Product, id, custodian, action string) error {
+	oldKey, err := productStockKey(stub, product, id)
+	if err != nil {
+		return fmt.Errorf("failed to create key %v", err)
+	}
+	product.Custodian = custodian
+	product.Action = action
+	product.OrderID = ""
+	product.DocType = DocTypeProduct
+	newKey, err := productStockKey(stub, product, id)
+	if err != nil {
+		return fmt.Errorf("failed to create key %v", err)
+	}
+	val, err := json.Marshal(product)
+	if err != nil {
+		return fmt.Errorf("failed to marshal product %v", err)
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixProduct, id), val); err != nil {
+		return fmt.Errorf("failed to put state %v", err)
+	}
+	if err := stub.DelState(oldKey); err != nil {
+		return fmt.Errorf("failed to del state %v", err)
+	}
+	if err := stub.PutState(newKey, []byte{1}); err != nil {
+		return fmt.Errorf("failed to put state %v", err)
+	}
+	return nil
+}
+
+func setCustodyEvent(stub shim.ChaincodeStubInterface, name string, evt map[string]interface{}) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event data %v", err)
+	}
+	if err := stub.SetEvent(name, data); err != nil {
+		return fmt.Errorf("failed to set event %v", err)
+	}
+	return nil
+}
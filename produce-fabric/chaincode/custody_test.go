@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStoreCustody(t *testing.T) {
+	s := setupOrder(t)
+	for _, id := range []string{"TV_1", "TV_2", "TV_3"} {
+		s.mustInvoke(orgTV, "registerProduct", "TV", id, "2020-05-20", "LCD_1")
+	}
+	storeStock := func(caller string) StoreStock {
+		t.Helper()
+		var stock StoreStock
+		if err := json.Unmarshal(s.mustInvoke(caller, "getStoreStock", orgStore), &stock); err != nil {
+			t.Fatal(err)
+		}
+		return stock
+	}
+
+	// 只能寄存到门店，只有所有者可以寄存
+	s.mustFail(orgTV, "checkIn", CustodyProduct, orgAudio, "TV_1")
+	s.mustFail(orgStore, "checkIn", CustodyProduct, orgStore, "TV_1")
+	s.mustInvoke(orgTV, "checkIn", CustodyProduct, orgStore, "TV_1,TV_2")
+	s.expectEvents("EvtCheckIn")
+	s.mustFail(orgTV, "checkIn", CustodyProduct, orgStore, "TV_1")
+	product, err := getProduct(s, "TV_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Owner != orgTV || product.Custodian != orgStore || product.Action != ProductActionCheckedIn {
+		t.Fatalf("unexpected product %+v", product)
+	}
+	s.expectProducts(orgTV, map[string]uint64{"TV": 1})
+
+	s.mustFail(orgLCD, "checkIn", CustodyMaterial, orgStore, "LCD_1", "1000")
+	s.mustInvoke(orgLCD, "checkIn", CustodyMaterial, orgStore, "LCD_1", "50")
+	s.expectMaterials(orgLCD, map[string]uint64{"LCD": 250})
+	if stock := storeStock(orgStore); len(stock.Products) != 2 || len(stock.Materials) != 1 || stock.Materials[0].Num != 50 {
+		t.Fatalf("unexpected store stock %+v", stock)
+	}
+	// 其他组织只能看到自己寄存的货物
+	if stock := storeStock(orgLCD); len(stock.Products) != 0 || len(stock.Materials) != 1 {
+		t.Fatalf("unexpected store stock %+v", stock)
+	}
+
+	// 订单指定门店时，确认收货从门店出库
+	s.mustFail(orgTV, "makeMaterialOrder", orgLCD, "LCD", "20", "100", "", orgAudio)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "20", "100", "", orgStore)
+	s.shipOrder(orgLCD, order.OrderID)
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	s.expectEvents("EvtMaterialTransferred", "EvtCheckOut", "EvtConfirmOrder")
+	s.expectMaterials(orgLCD, map[string]uint64{"LCD": 250})
+	s.expectMaterials(orgTV, map[string]uint64{"LCD": 20})
+
+	// 门店买下寄存的产品
+	order = s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "1", "3000", "", orgStore)
+	s.shipOrder(orgTV, order.OrderID)
+	s.mustInvoke(orgStore, "confirmOrder", order.OrderID)
+	s.expectEvents("EvtProductOwnerChanged", "EvtCheckOut", "EvtConfirmOrder")
+	s.expectProducts(orgStore, map[string]uint64{"TV": 1})
+	if product, err = getProduct(s, "TV_1"); err != nil {
+		t.Fatal(err)
+	}
+	if product.Owner != orgStore || product.Custodian != "" {
+		t.Fatalf("unexpected product %+v", product)
+	}
+
+	// 门店可以把寄存的产品卖给消费者
+	s.mustInvoke(orgStore, "sellToConsumer", "TV_2")
+	order = s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "1", "3000", "", orgStore)
+	s.shipOrder(orgTV, order.OrderID)
+	s.mustFail(orgStore, "confirmOrder", order.OrderID)
+
+	s.mustFail(orgAudio, "checkOut", CustodyMaterial, orgStore, orgLCD, "LCD_1", "30")
+	s.mustFail(orgStore, "checkOut", CustodyMaterial, orgStore, orgLCD, "LCD_1", "31")
+	s.mustInvoke(orgStore, "checkOut", CustodyMaterial, orgStore, orgLCD, "LCD_1", "30")
+	s.expectEvents("EvtCheckOut")
+	s.expectMaterials(orgLCD, map[string]uint64{"LCD": 280})
+	s.mustInvoke(orgTV, "checkIn", CustodyProduct, orgStore, "TV_3")
+	s.mustFail(orgStore, "checkOut", CustodyProduct, orgStore, orgLCD, "TV_3")
+	s.mustInvoke(orgStore, "checkOut", CustodyProduct, orgStore, orgTV, "TV_3")
+	s.expectProducts(orgTV, map[string]uint64{"TV": 1})
+	if stock := storeStock(orgStore); len(stock.Products) != 0 || len(stock.Materials) != 0 {
+		t.Fatalf("unexpected store stock %+v", stock)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// 默认的仲裁方
+const defaultArbiter = RolePayment
+
+// 争议处理步骤
+const (
+	DisputeStepOpen     = "open"
+	DisputeStepEvidence = "evidence"
+	DisputeStepResolve  = "resolve"
+)
+
+// Dispute 订单争议，订单发货或者收货后由任意一方发起，由仲裁方裁决货款的分配
+type Dispute struct {
+	OrderID        string        `json:"orderID"`
+	OpenedBy       string        `json:"openedBy"`       //发起方
+	Arbiter        string        `json:"arbiter"`        //发起时配置的仲裁方
+	OrderStatus    byte          `json:"orderStatus"`    //发起争议前的订单状态
+	Resolved       bool          `json:"resolved"`       //是否已裁决
+	PayerAmount    Amount        `json:"payerAmount"`    //裁决后下单者获得的订单金额
+	ProducerAmount Amount        `json:"producerAmount"` //裁决后供货商获得的订单金额
+	Steps          []DisputeStep `json:"steps"`          //处理记录
+}
+
+// DisputeStep 争议的一个处理步骤
+type DisputeStep struct {
+	Action    string    `json:"action"`
+	Party     string    `json:"party"`
+	Evidence  []string  `json:"evidence,omitempty"` //证据的哈希，证据本身保存在链下
+	Comment   string    `json:"comment,omitempty"`
+	TxID      string    `json:"txID"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// openDispute 订单双方发起争议，参数 [orderID, evidenceHash...]，
+// 争议期间订单不能确认收货、关闭或者超时，剩余货款保持冻结
+func (c *Contract) openDispute(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 2 {
+		return shim.Error("invalid arguments")
+	}
+	evidence, err := parseEvidence(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	order, role, to, err := loadOrderForAction(stub, args[0], OrderActionDispute)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	arbiter, err := getArbiter(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get arbiter %v", err))
+	}
+	if arbiter == order.Payer || arbiter == order.Producer {
+		return shim.Error(fmt.Sprintf("arbiter %s is a party of order(%s)", arbiter, order.OrderID))
+	}
+	dispute := &Dispute{
+		OrderID:     order.OrderID,
+		OpenedBy:    role,
+		Arbiter:     arbiter,
+		OrderStatus: order.Status,
+	}
+	if err := addDisputeStep(stub, dispute, DisputeStepOpen, role, evidence, ""); err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, err := putOrder(stub, order, to); err != nil {
+		return shim.Error(err.Error())
+	}
+	return putDispute(stub, dispute, "EvtOpenDispute")
+}
+
+// addDisputeEvidence 争议裁决前，订单双方补充证据，参数 [orderID, evidenceHash...]
+func (c *Contract) addDisputeEvidence(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 2 {
+		return shim.Error("invalid arguments")
+	}
+	evidence, err := parseEvidence(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	order, dispute, role, err := loadDispute(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if role != order.Payer && role != order.Producer {
+		return shim.Error(fmt.Sprintf("only the payer or producer can add evidence, you are %s", role))
+	}
+	if dispute.Resolved {
+		return shim.Error(fmt.Sprintf("dispute of order(%s) is resolved", order.OrderID))
+	}
+	if err := addDisputeStep(stub, dispute, DisputeStepEvidence, role, evidence, ""); err != nil {
+		return shim.Error(err.Error())
+	}
+	return putDispute(stub, dispute, "EvtDisputeEvidence")
+}
+
+// resolveDispute 仲裁方裁决，参数 [orderID, payerAmount, comment]。
+// 订单金额中payerAmount归下单者，其余归供货商，已支付给供货商的部分不足时从供货商余额中扣回
+func (c *Contract) resolveDispute(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("invalid arguments")
+	}
+	order, dispute, role, err := loadDispute(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if role != dispute.Arbiter {
+		return shim.Error(fmt.Sprintf("only the arbiter %s can resolve dispute, you are %s", dispute.Arbiter, role))
+	}
+	if order.Status != OrderDisputed {
+		return shim.Error((&OrderStatusError{OrderID: order.OrderID, Action: DisputeStepResolve, Status: order.Status}).Error())
+	}
+	payerAmount, err := ParseAmount(args[1])
+	if err != nil || payerAmount.Cmp(order.Amount) > 0 {
+		return shim.Error(fmt.Sprintf("invalid payer amount, got %s", args[1]))
+	}
+	producerAmount, err := order.Amount.Sub(payerAmount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var comment string
+	if len(args) == 3 {
+		comment = args[2]
+	}
+
+	escrow, err := order.Amount.Sub(order.Paid)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if rest, err := escrow.Sub(payerAmount); err == nil {
+		if err := addOrderBalance(stub, order, order.payerAccount(), payerAmount); err != nil {
+			return shim.Error(fmt.Sprintf("failed to add balance to payer %v", err))
+		}
+		if err := addOrderBalance(stub, order, order.Producer, rest); err != nil {
+			return shim.Error(fmt.Sprintf("failed to add balance to producer %v", err))
+		}
+	} else {
+		// 冻结的货款不够，从供货商已收到的货款中扣回
+		clawback, err := payerAmount.Sub(escrow)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := reduceOrderBalance(stub, order, order.Producer, clawback); err != nil {
+			return shim.Error(fmt.Sprintf("failed to claw back from producer %v", err))
+		}
+		if err := addOrderBalance(stub, order, order.payerAccount(), payerAmount); err != nil {
+			return shim.Error(fmt.Sprintf("failed to add balance to payer %v", err))
+		}
+	}
+	order.Paid = producerAmount
+	if _, err := putOrder(stub, order, OrderResolved); err != nil {
+		return shim.Error(err.Error())
+	}
+	dispute.Resolved = true
+	dispute.PayerAmount = payerAmount
+	dispute.ProducerAmount = producerAmount
+	if err := addDisputeStep(stub, dispute, DisputeStepResolve, role, nil, comment); err != nil {
+		return shim.Error(err.Error())
+	}
+	return putDispute(stub, dispute, "EvtResolveDispute")
+}
+
+// getDispute 查询订单的争议及处理记录，只有订单双方和仲裁方可以查询
+func (c *Contract) getDispute(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	order, dispute, role, err := loadDispute(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if role != order.Payer && role != order.Producer && role != dispute.Arbiter {
+		return shim.Error(fmt.Sprintf("permission denied for %s", role))
+	}
+	data, err := json.Marshal(dispute)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal dispute %v", err))
+	}
+	return shim.Success(data)
+}
+
+// setArbiter 设置仲裁方的组织，只影响之后发起的争议
+func (c *Contract) setArbiter(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if _, err := requireRole(stub, RolePayment); err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) != 1 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	if err := stub.PutState(PrefixArbiter, []byte(args[0])); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func getArbiter(stub shim.ChaincodeStubInterface) (string, error) {
+	val, err := stub.GetState(PrefixArbiter)
+	if err != nil {
+		return "", err
+	}
+	if len(val) == 0 {
+		return defaultArbiter, nil
+	}
+	return string(val), nil
+}
+
+// loadDispute 读取订单和订单的争议，并返回调用者
+func loadDispute(stub shim.ChaincodeStubInterface, orderID string) (*Order, *Dispute, string, error) {
+	if orderID == "" {
+		return nil, nil, "", fmt.Errorf("orderID is empty")
+	}
+	order, err := getOrder(stub, orderID)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	val, err := stub.GetState(fmt.Sprintf("%s-%s", PrefixDispute, orderID))
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to get state %v", err)
+	}
+	if len(val) == 0 {
+		return nil, nil, "", fmt.Errorf("order(%s) has no dispute", orderID)
+	}
+	var dispute Dispute
+	if err := json.Unmarshal(val, &dispute); err != nil {
+		return nil, nil, "", fmt.Errorf("failed to unmarshal dispute %v", err)
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to get role")
+	}
+	return order, &dispute, role, nil
+}
+
+func addDisputeStep(stub shim.ChaincodeStubInterface, dispute *Dispute, action, party string, evidence []string, comment string) error {
+	t, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	dispute.Steps = append(dispute.Steps, DisputeStep{
+		Action:    action,
+		Party:     party,
+		Evidence:  evidence,
+		Comment:   comment,
+		TxID:      stub.GetTxID(),
+		Timestamp: time.Unix(t.GetSeconds(), 0),
+	})
+	return nil
+}
+
+// putDispute 保存争议并发出事件
+func putDispute(stub shim.ChaincodeStubInterface, dispute *Dispute, event string) peer.Response {
+	val, err := json.Marshal(dispute)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal dispute %v", err))
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixDispute, dispute.OrderID), val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	}
+	if err := stub.SetEvent(event, val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// parseEvidence 证据必须是十六进制编码的哈希
+func parseEvidence(args []string) ([]string, error) {
+	for _, h := range args {
+		if b, err := hex.DecodeString(h); err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid evidence hash, got %s", h)
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const evidenceHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestDispute(t *testing.T) {
+	s := setupOrder(t)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	s.mustFail(orgTV, "openDispute", order.OrderID, evidenceHash)
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "50")
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+
+	// 发货后任意一方都可以发起争议，证据必须是哈希
+	s.mustFail(orgTV, "openDispute", order.OrderID, "not a hash")
+	s.mustFail(orgStore, "openDispute", order.OrderID, evidenceHash)
+	s.mustInvoke(orgTV, "openDispute", order.OrderID, evidenceHash)
+	var d Dispute
+	s.expectEvent("EvtOpenDispute", &d)
+	if d.OpenedBy != orgTV || d.Arbiter != orgPayment || d.OrderStatus != OrderShipped || len(d.Steps) != 1 {
+		t.Fatalf("unexpected dispute %+v", d)
+	}
+	s.mustFail(orgLCD, "openDispute", order.OrderID, evidenceHash)
+
+	// 争议期间订单冻结
+	s.mustFail(orgTV, "confirmOrder", order.OrderID)
+	s.mustFail(orgLCD, "closeOrder", order.OrderID)
+	s.mustInvoke(orgLCD, "addDisputeEvidence", order.OrderID, evidenceHash, evidenceHash)
+	s.expectEvent("EvtDisputeEvidence", nil)
+
+	s.mustFail(orgTV, "resolveDispute", order.OrderID, "5000")
+	s.mustFail(orgPayment, "resolveDispute", order.OrderID, "10001")
+	s.mustInvoke(orgPayment, "resolveDispute", order.OrderID, "2000", "half of the second lot is broken")
+	s.expectEvent("EvtResolveDispute", &d)
+	if !d.Resolved || d.PayerAmount.String() != "2000" || d.ProducerAmount.String() != "8000" || len(d.Steps) != 3 {
+		t.Fatalf("unexpected dispute %+v", d)
+	}
+	s.expectBalance(orgTV, 92000)
+	s.expectBalance(orgLCD, 8000)
+	s.mustFail(orgPayment, "resolveDispute", order.OrderID, "2000")
+	s.mustFail(orgTV, "addDisputeEvidence", order.OrderID, evidenceHash)
+
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "getDispute", order.OrderID), &d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Steps) != 3 || d.Steps[1].Party != orgLCD || len(d.Steps[1].Evidence) != 2 {
+		t.Fatalf("unexpected dispute %+v", d)
+	}
+	s.mustFail(orgStore, "getDispute", order.OrderID)
+}
+
+func TestDisputeDeliveredOrder(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgPayment, "setArbiter", orgStore)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	s.shipOrder(orgLCD, order.OrderID)
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	s.mustInvoke(orgLCD, "openDispute", order.OrderID, evidenceHash)
+
+	// 货款已全部支付，裁决退款时从供货商余额中扣回
+	s.mustFail(orgPayment, "resolveDispute", order.OrderID, "3000")
+	s.mustInvoke(orgStore, "resolveDispute", order.OrderID, "3000")
+	s.expectBalance(orgTV, 93000)
+	s.expectBalance(orgLCD, 7000)
+	var o Order
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "getOrder", order.OrderID), &o); err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != OrderResolved || o.Paid.String() != "7000" {
+		t.Fatalf("unexpected order %+v", o)
+	}
+	s.mustFail(orgTV, "setArbiter", orgTV)
+}
+
+func TestDefaultArbiter(t *testing.T) {
+	s := setupOrder(t)
+	// 没有设置仲裁方时由payment仲裁，与管理员无关
+	if res := s.init(orgPayment, strings.NewReplacer(`"admin": "payment"`, `"admin": "store"`, `"decimals": 2`, `"decimals": 0`).Replace(testGenesis)); res.Status != 200 {
+		t.Fatalf("init failed: %s", res.Message)
+	}
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100")
+	s.shipOrder(orgLCD, order.OrderID)
+	s.mustInvoke(orgTV, "openDispute", order.OrderID, evidenceHash)
+	var d Dispute
+	s.expectEvent("EvtOpenDispute", &d)
+	if d.Arbiter != orgPayment {
+		t.Fatalf("unexpected arbiter %s", d.Arbiter)
+	}
+}
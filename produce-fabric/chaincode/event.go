@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"chislab/chaincode/events"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// eventStub 收集一次调用中产生的全部事件，调用成功后作为一个信封发出，
+// 避免Fabric只保留最后一次SetEvent导致前面的事件丢失，信封格式见events包
+type eventStub struct {
+	shim.ChaincodeStubInterface
+	events []events.Event
+}
+
+func (s *eventStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("event name can not be empty")
+	}
+	s.events = append(s.events, events.Event{Name: name, Payload: payload})
+	return nil
+}
+
+// flush 发出收集到的事件，没有事件时不发出
+func (s *eventStub) flush() error {
+	if len(s.events) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(events.Envelope{
+		Version: events.Version,
+		TxID:    s.GetTxID(),
+		Events:  s.events,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal events %v", err)
+	}
+	return s.ChaincodeStubInterface.SetEvent(events.Name, data)
+}
@@ -0,0 +1,69 @@
+// Package events 定义链码事件的信封格式，供链码和事件监听方共同使用。
+//
+// Fabric的一个交易只保留最后一次SetEvent，链码在一次调用中产生的所有领域事件
+// (例如确认收货时的EvtMaterialTransferred、EvtProductOwnerChanged和EvtConfirmOrder)
+// 按产生顺序收集到一个信封中，在调用结束时以事件名Name发出一次。监听方用Decode解析:
+//
+//	env, err := events.Decode(ccEvent.EventName, ccEvent.Payload)
+//	for _, e := range env.Events {
+//		switch e.Name {
+//		case "EvtConfirmOrder":
+//			var order Order
+//			err = e.Decode(&order)
+//		}
+//	}
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Name 信封的事件名
+const Name = "EvtEnvelope"
+
+// Version 当前的信封版本，格式不兼容时递增
+const Version = 1
+
+// Envelope 一个交易的全部事件
+type Envelope struct {
+	Version int     `json:"version"`
+	TxID    string  `json:"txID"`
+	Events  []Event `json:"events"`
+}
+
+// Event 一个领域事件，Payload为事件本身的JSON
+type Event struct {
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Decode 解析链码事件，事件名不是Name或者版本不支持时返回错误
+func Decode(name string, payload []byte) (*Envelope, error) {
+	if name != Name {
+		return nil, fmt.Errorf("unexpected event %s", name)
+	}
+	var env Envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal envelope %v", err)
+	}
+	if env.Version != Version {
+		return nil, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+	return &env, nil
+}
+
+// Find 返回第一个名为name的事件
+func (env *Envelope) Find(name string) (*Event, bool) {
+	for i := range env.Events {
+		if env.Events[i].Name == name {
+			return &env.Events[i], true
+		}
+	}
+	return nil, false
+}
+
+// Decode 将事件内容解析到v
+func (e *Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
@@ -0,0 +1,33 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	payload := []byte(`{"version":1,"txID":"tx1","events":[{"name":"EvtShipOrder","payload":{"orderID":"o1"}},{"name":"EvtConfirmOrder","payload":{"orderID":"o1","delivered":2}}]}`)
+	env, err := Decode(Name, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := env.Find("EvtConfirmOrder")
+	if !ok {
+		t.Fatal("EvtConfirmOrder not found")
+	}
+	var order struct {
+		OrderID   string `json:"orderID"`
+		Delivered uint64 `json:"delivered"`
+	}
+	if err := e.Decode(&order); err != nil || order.OrderID != "o1" || order.Delivered != 2 {
+		t.Fatalf("unexpected event %+v, %v", order, err)
+	}
+	if _, ok := env.Find("EvtCancelOrder"); ok {
+		t.Fatal("unexpected EvtCancelOrder")
+	}
+	if _, err := Decode("EvtConfirmOrder", payload); err == nil {
+		t.Fatal("expect error for wrong event name")
+	}
+	if _, err := Decode(Name, []byte(`{"version":2,"events":[]}`)); err == nil {
+		t.Fatal("expect error for unsupported version")
+	}
+}
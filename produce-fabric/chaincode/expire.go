@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxOrderTimeout 订单超时秒数的上限(10年)，避免截止时间溢出
+const maxOrderTimeout = 10 * 365 * 24 * 3600
+
+// ExpiredOrder 一个超时的订单及其退款情况
+type ExpiredOrder struct {
+	OrderID       string `json:"orderID"`
+	Payer         string `json:"payer"`
+	Producer      string `json:"producer"`
+	ReturnToPayer Amount `json:"returnToPayer"` //退回下单者的冻结货款，不含赔付
+	Compensate    Amount `json:"compensate"`    //供货商赔付给下单者的金额
+}
+
+// setOrderTimeout 供货商设置默认的订单超时秒数，0表示订单默认不超时
+func (c *Contract) setOrderTimeout(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	timeout, err := parseOrderTimeout(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key := fmt.Sprintf("%s-%s", PrefixOrderTimeout, role)
+	if err := stub.PutState(key, uint64ToBytes(timeout)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (c *Contract) setExpireCompensate(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if _, err := requireRole(stub, RolePayment); err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	compensate, err := strconv.Atoi(args[0])
+	if err != nil || compensate < 0 || compensate > 100 {
+		return shim.Error(fmt.Sprintf("expire compensate invlaid got %s", args[0]))
+	}
+	if err := stub.PutState(PrefixExpireCompensate, []byte{byte(compensate)}); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// expireOrders 任何人都可以调用，按交易时间处理已超时的未结束订单，参数 [limit]。
+// 未收货部分的货款退回下单者，供货商已接单的订单还需按未发货部分的货款按比例赔付下单者，赔付以供货商余额为限
+func (c *Contract) expireOrders(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) > 1 {
+		return shim.Error("invalid arguments")
+	}
+	limit := defaultPageSize
+	if len(args) == 1 && args[0] != "" {
+		var err error
+		if limit, err = strconv.Atoi(args[0]); err != nil || limit <= 0 || limit > maxPageSize {
+			return shim.Error(fmt.Sprintf("invalid limit, got %s", args[0]))
+		}
+	}
+	t, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	orders, err := getExpiredOrders(stub, t.GetSeconds(), limit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	percent, err := getExpireCompensate(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get expire compensate %v", err))
+	}
+
+	// 同一交易内读不到自己的写入，所以余额变化先在内存中累计，最后每个账户只写一次。
+	// 私有订单的余额在双方集合中，按集合和账户分别累计
+	type balanceKey struct{ collection, account string }
+	balances := make(map[balanceKey]Amount)
+	balanceOf := func(key balanceKey) (Amount, error) {
+		if amount, ok := balances[key]; ok {
+			return amount, nil
+		}
+		amount, err := getEscrowBalance(stub, key.collection, key.account)
+		if err != nil {
+			return Amount{}, err
+		}
+		balances[key] = amount
+		return amount, nil
+	}
+	expired := []*ExpiredOrder{}
+	for _, order := range orders {
+		collection := escrowCollection(order)
+		payerKey := balanceKey{collection, order.payerAccount()}
+		producerKey := balanceKey{collection, order.Producer}
+		if _, err := balanceOf(payerKey); err != nil {
+			return shim.Error(fmt.Sprintf("failed to get balance %v", err))
+		}
+		producerBalance, err := balanceOf(producerKey)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get balance %v", err))
+		}
+		remain, err := order.Amount.Sub(order.Paid)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		e := &ExpiredOrder{
+			OrderID:       order.OrderID,
+			Payer:         order.Payer,
+			Producer:      order.Producer,
+			ReturnToPayer: remain,
+		}
+		if order.Status != OrderCreated {
+			// 已发货的部分只是等待下单者确认收货，只按未发货部分的货款赔付
+			unshipped, err := order.Amount.DivUint64(order.Count).MulUint64(order.Count - order.Shipped)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			e.Compensate = unshipped.Min(remain).Percent(percent).Min(producerBalance)
+			if balances[producerKey], err = producerBalance.Sub(e.Compensate); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		refund, err := remain.Add(e.Compensate)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if balances[payerKey], err = balances[payerKey].Add(refund); err != nil {
+			return shim.Error(err.Error())
+		}
+		if _, err := putOrder(stub, order, OrderExpired); err != nil {
+			return shim.Error(err.Error())
+		}
+		if order.Private {
+			// 返回值和事件会写入区块，私有订单不包含金额
+			e.ReturnToPayer, e.Compensate = Amount{}, Amount{}
+		}
+		expired = append(expired, e)
+	}
+	keys := make([]balanceKey, 0, len(balances))
+	for key := range balances {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].collection != keys[j].collection {
+			return keys[i].collection < keys[j].collection
+		}
+		return keys[i].account < keys[j].account
+	})
+	for _, key := range keys {
+		if err := putEscrowBalance(stub, key.collection, key.account, balances[key]); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put balance %v", err))
+		}
+	}
+
+	data, err := json.Marshal(expired)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	if len(expired) > 0 {
+		if err := stub.SetEvent("EvtExpireOrders", data); err != nil {
+			return shim.Error(fmt.Sprintf("failed to set event %v", err))
+		}
+	}
+	return shim.Success(data)
+}
+
+// getExpiredOrders 按截止时间从早到晚返回截止时间不晚于now的未结束订单，最多limit个。
+// 当前peer上没有完整数据的私有订单由订单双方的peer背书时处理，跳过且不计入limit
+func getExpiredOrders(stub shim.ChaincodeStubInterface, now int64, limit int) ([]*Order, error) {
+	startKey := fmt.Sprintf("%s-", PrefixOrderDeadline)
+	endKey := fmt.Sprintf("%s-%020d", PrefixOrderDeadline, now+1)
+	iter, err := stub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state by range %v", err)
+	}
+	defer iter.Close()
+	prefixLen := len(startKey) + 21
+	var orders []*Order
+	for iter.HasNext() && len(orders) < limit {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get iter next %v", err)
+		}
+		if len(kv.Key) <= prefixLen {
+			return nil, fmt.Errorf("internal key format wrong")
+		}
+		order, err := getOrder(stub, kv.Key[prefixLen:])
+		if errors.Is(err, ErrPrivateOrder) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isOrderOpen(order.Status) {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+func getOrderTimeout(stub shim.ChaincodeStubInterface, producer string) (uint64, error) {
+	val, err := stub.GetState(fmt.Sprintf("%s-%s", PrefixOrderTimeout, producer))
+	if err != nil {
+		return 0, err
+	}
+	return bytesToUint64(val), nil
+}
+
+func getExpireCompensate(stub shim.ChaincodeStubInterface) (uint64, error) {
+	val, err := stub.GetState(PrefixExpireCompensate)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) == 0 {
+		return 0, nil
+	}
+	if len(val) != 1 {
+		return 0, fmt.Errorf("data in db with wrong format")
+	}
+	return uint64(val[0]), nil
+}
+
+// parseOrderTimeout 解析可选的订单超时秒数，为空时返回0，不能超过maxOrderTimeout
+func parseOrderTimeout(args []string) (uint64, error) {
+	if len(args) == 0 || args[0] == "" {
+		return 0, nil
+	}
+	timeout, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil || timeout > maxOrderTimeout {
+		return 0, fmt.Errorf("invalid timeout, got %s", args[0])
+	}
+	return timeout, nil
+}
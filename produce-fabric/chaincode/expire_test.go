@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExpireOrders(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgPayment, "setExpireCompensate", "10")
+	s.mustInvoke(orgPayment, "mint", orgLCD, "500")
+	s.mustInvoke(orgLCD, "setOrderTimeout", "3600")
+
+	// 默认使用供货商设置的超时时间，也可以在下单时指定
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	if order.Deadline == nil || order.Deadline.Sub(order.CreatedAt).Seconds() != 3600 {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	short1 := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100", "60")
+	short2 := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "20", "100", "60")
+	s.mustFail(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100", "abc")
+	// 超时时间有上限，避免截止时间溢出
+	s.mustFail(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100", "9300000000")
+	s.mustFail(orgLCD, "setOrderTimeout", "18446744073709551615")
+	s.expectBalance(orgTV, 87000)
+
+	var expired []ExpiredOrder
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "expireOrders"), &expired); err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 {
+		t.Fatalf("unexpected expired orders %+v", expired)
+	}
+
+	// 同一交易内同一下单者的多个订单超时，退款累加
+	s.now += 60
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "expireOrders"), &expired); err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 2 || !expired[0].Compensate.IsZero() {
+		t.Fatalf("unexpected expired orders %+v", expired)
+	}
+	s.expectEvent("EvtExpireOrders", nil)
+	s.expectBalance(orgTV, 90000)
+	for _, id := range []string{short1.OrderID, short2.OrderID} {
+		var o Order
+		if err := json.Unmarshal(s.mustInvoke(orgTV, "getOrder", id), &o); err != nil {
+			t.Fatal(err)
+		}
+		if o.Status != OrderExpired {
+			t.Fatalf("unexpected order %+v", o)
+		}
+	}
+	s.mustFail(orgLCD, "acceptOrder", short1.OrderID)
+
+	// 部分收货后超时，退回未收货部分的货款，供货商按比例赔付
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "40")
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	s.now += 3600
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "expireOrders", "10"), &expired); err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].ReturnToPayer.String() != "6000" || expired[0].Compensate.String() != "600" {
+		t.Fatalf("unexpected expired orders %+v", expired)
+	}
+	s.expectBalance(orgTV, 96600)
+	s.expectBalance(orgLCD, 3900)
+	s.mustFail(orgTV, "confirmOrder", order.OrderID)
+	s.mustFail(orgStore, "expireOrders", "0")
+
+	// 全部发货后下单者不确认收货，超时时退回货款但供货商不赔付
+	order = s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100", "60")
+	s.shipOrder(orgLCD, order.OrderID)
+	s.now += 60
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "expireOrders"), &expired); err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].ReturnToPayer.String() != "1000" || !expired[0].Compensate.IsZero() {
+		t.Fatalf("unexpected expired orders %+v", expired)
+	}
+	s.expectBalance(orgTV, 96600)
+	s.expectBalance(orgLCD, 3900)
+}
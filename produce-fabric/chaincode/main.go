@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/protos/peer"
@@ -13,18 +14,52 @@ var json = jsoniter.ConfigCompatibleWithStandardLibrary
 // Contract 合约
 type Contract struct{}
 
-// Init Init
+// Init 参数 [genesis]，genesis为JSON格式的创世配置，见Genesis。
+// 兼容早期版本只传货币小数位数的参数 [decimals]
 func (c *Contract) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	_, args := stub.GetFunctionAndParameters()
+	if len(args) > 1 {
+		return shim.Error("invalid arguments")
+	}
+	if len(args) == 0 {
+		return shim.Success(nil)
+	}
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		err = initGenesis(stub, args[0])
+	} else {
+		err = initDecimals(stub, args[0])
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
-// Invoke Invoke
+// Invoke Invoke，调用中产生的事件在成功后合并为一个事件发出
 func (c *Contract) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
+	if err := loadDecimals(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	es := &eventStub{ChaincodeStubInterface: stub}
+	res := c.invoke(es)
+	if res.Status != shim.OK {
+		return res
+	}
+	if err := es.flush(); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return res
+}
+
+func (c *Contract) invoke(stub shim.ChaincodeStubInterface) peer.Response {
 	fn, args := stub.GetFunctionAndParameters()
 	switch fn {
 	//material
 	case "getMyMaterials":
 		return c.getMyMaterials(stub, args)
+	case "getMyMaterialsPage":
+		return c.getMyMaterialsPage(stub, args)
 	case "registerMaterial":
 		return c.registerMaterial(stub, args)
 	case "consumeMaterial":
@@ -33,35 +68,150 @@ func (c *Contract) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		return c.setMaterialPrice(stub, args)
 	case "getMaterialPrice":
 		return c.getMaterialPrice(stub, args)
+	case "getMaterialBatch":
+		return c.getMaterialBatch(stub, args)
+	case "setAllocationPolicy":
+		return c.setAllocationPolicy(stub, args)
+	case "getAllocationPolicy":
+		return c.getAllocationPolicy(stub, args)
+	case "writeOffMaterial":
+		return c.writeOffMaterial(stub, args)
+	case "getWriteOffs":
+		return c.getWriteOffs(stub, args)
 	//product
 	case "getMyProducts":
 		return c.getMyProducts(stub, args)
+	case "getMyProductsPage":
+		return c.getMyProductsPage(stub, args)
 	case "setProductPrice":
 		return c.setProductPrice(stub, args)
 	case "getProductPrice":
 		return c.getProductPrice(stub, args)
 	case "registerProduct":
 		return c.registerProduct(stub, args)
+	case "setBOM":
+		return c.setBOM(stub, args)
+	case "getBOM":
+		return c.getBOM(stub, args)
+	case "produce":
+		return c.produce(stub, args)
+	case "planProduction":
+		return c.planProduction(stub, args)
+	case "checkIn":
+		return c.checkIn(stub, args)
+	case "checkOut":
+		return c.checkOut(stub, args)
+	case "getStoreStock":
+		return c.getStoreStock(stub, args)
+	case "getProduct":
+		return c.getProduct(stub, args)
+	case "getProducts":
+		return c.getProducts(stub, args)
+	case "queryProducts":
+		return c.queryProducts(stub, args)
+	case "getProductHistory":
+		return c.getProductHistory(stub, args)
+	case "traceMaterialBatch":
+		return c.traceMaterialBatch(stub, args)
+	case "traceProduct":
+		return c.traceProduct(stub, args)
+	case "recallBatch":
+		return c.recallBatch(stub, args)
+	case "getRecall":
+		return c.getRecall(stub, args)
+	case "scrapProduct":
+		return c.scrapProduct(stub, args)
+	case "sellToConsumer":
+		return c.sellToConsumer(stub, args)
+	case "verifyProduct":
+		return c.verifyProduct(stub, args)
 	//payment
 	case "makeMaterialOrder":
 		return c.makeMaterialOrder(stub, args)
 	case "makeProductOrder":
 		return c.makeProductOrder(stub, args)
+	case "setPrivatePrice":
+		return c.setPrivatePrice(stub, args)
+	case "getPrivatePrice":
+		return c.getPrivatePrice(stub, args)
+	case "depositEscrow":
+		return c.depositEscrow(stub, args)
+	case "withdrawEscrow":
+		return c.withdrawEscrow(stub, args)
+	case "getEscrowBalance":
+		return c.getEscrowBalance(stub, args)
+	case "acceptOrder":
+		return c.acceptOrder(stub, args)
+	case "rejectOrder":
+		return c.rejectOrder(stub, args)
+	case "shipOrder":
+		return c.shipOrder(stub, args)
 	case "confirmOrder":
 		return c.confirmOrder(stub, args)
 	case "cancelOrder":
 		return c.cancelOrder(stub, args)
+	case "closeOrder":
+		return c.closeOrder(stub, args)
 	case "getOrder":
 		return c.getOrder(stub, args)
+	case "listOrders":
+		return c.listOrders(stub, args)
+	case "queryOrders":
+		return c.queryOrders(stub, args)
+	case "openDispute":
+		return c.openDispute(stub, args)
+	case "addDisputeEvidence":
+		return c.addDisputeEvidence(stub, args)
+	case "resolveDispute":
+		return c.resolveDispute(stub, args)
+	case "getDispute":
+		return c.getDispute(stub, args)
+	case "setOrderTimeout":
+		return c.setOrderTimeout(stub, args)
+	case "expireOrders":
+		return c.expireOrders(stub, args)
 	case "balanceOf":
 		return c.balanceOf(stub, args)
+	case "getDecimals":
+		return c.getDecimals(stub, args)
+	case "getConfig":
+		return c.getConfig(stub, args)
+	case "getMyAccount":
+		return c.getMyAccount(stub, args)
+	case "allocate":
+		return c.allocate(stub, args)
+	case "reclaim":
+		return c.reclaim(stub, args)
+	//only for admin
+	case "setRole":
+		return c.setRole(stub, args)
+	case "revokeRole":
+		return c.revokeRole(stub, args)
 	//only for payment
 	case "setCancelCompensate":
 		return c.setCancelCompensate(stub, args)
+	case "setExpireCompensate":
+		return c.setExpireCompensate(stub, args)
+	case "setArbiter":
+		return c.setArbiter(stub, args)
+	case "migrateAmounts":
+		return c.migrateAmounts(stub, args)
 	case "mint":
 		return c.mint(stub, args)
 	case "burn":
 		return c.burn(stub, args)
+	case "transfer":
+		return c.transfer(stub, args)
+	case "requestWithdrawal":
+		return c.requestWithdrawal(stub, args)
+	case "approveWithdrawal":
+		return c.approveWithdrawal(stub, args)
+	case "rejectWithdrawal":
+		return c.rejectWithdrawal(stub, args)
+	case "getWithdrawal":
+		return c.getWithdrawal(stub, args)
+	case "listWithdrawals":
+		return c.listWithdrawals(stub, args)
 	}
 	return shim.Error("unsupported method")
 }
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"chislab/chaincode/events"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// 示例网络中的组织
+const (
+	orgLCD     = "material.lcd"
+	orgAudio   = "material.audio"
+	orgCPU     = "material.cpu"
+	orgTV      = "product.tv"
+	orgPC      = "product.pc"
+	orgPayment = "payment"
+	orgStore   = "store"
+)
+
+// testStub 包装 shim.MockStub，补齐测试需要的几项能力:
+//   - 可切换的调用者身份(GetCreator 返回带x509证书的 SerializedIdentity)
+//   - 与peer一致的写集语义: 交易内写入先缓存，读不到自己的写，成功才提交
+//   - 与peer一致的事件语义: 一个交易只保留最后一次 SetEvent
+//   - 按提交顺序记录每个key的历史，用于 GetHistoryForKey
+//   - 组合键分页查询，bookmark为下一页的起始key
+//   - transient字段和私有数据，私有数据同样在交易成功后提交，peer为背书peer所在的组织，
+//     为空时可以读取全部集合，否则只能读取该组织所在的集合
+type testStub struct {
+	*shim.MockStub
+	t *testing.T
+
+	identities map[string][]byte
+	creator    []byte
+	args       [][]byte
+	writes     map[string][]byte
+	writeOrder []string
+	pvtWrites  map[string]map[string][]byte
+	transient  map[string][]byte
+	peer       string
+	event      *peer.ChaincodeEvent
+	history    map[string][]*queryresult.KeyModification
+	txSeq      int
+	now        int64
+}
+
+func newTestStub(t *testing.T) *testStub {
+	s := &testStub{
+		MockStub:   shim.NewMockStub("producecc", new(Contract)),
+		t:          t,
+		identities: make(map[string][]byte),
+		history:    make(map[string][]*queryresult.KeyModification),
+		now:        time.Date(2020, 5, 20, 8, 0, 0, 0, time.UTC).Unix(),
+	}
+	res := s.init(orgPayment)
+	if res.Status != shim.OK {
+		t.Fatalf("init failed: %s", res.Message)
+	}
+	return s
+}
+
+// identity 返回某个组织成员的序列化身份，attrs为证书中的属性(ABAC)
+func (s *testStub) identity(mspID string, attrs map[string]string) []byte {
+	key := mspID
+	if len(attrs) > 0 {
+		key = fmt.Sprintf("%s%v", mspID, attrs)
+	}
+	if id, ok := s.identities[key]; ok {
+		return id
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(len(s.identities) + 1)),
+		Subject:      pkix.Name{CommonName: "User1@" + mspID, Organization: []string{mspID}},
+		NotBefore:    time.Unix(s.now, 0).Add(-time.Hour),
+		NotAfter:     time.Unix(s.now, 0).Add(24 * 365 * time.Hour),
+	}
+	if len(attrs) > 0 {
+		val, err := json.Marshal(map[string]interface{}{"attrs": attrs})
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, pkix.Extension{
+			Id:    []int{1, 2, 3, 4, 5, 6, 7, 8, 1},
+			Value: val,
+		})
+		tmpl.Subject.CommonName = fmt.Sprintf("%s-%d@%s", "User", len(s.identities)+1, mspID)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	sid := &msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+	id, err := proto.Marshal(sid)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.identities[key] = id
+	return id
+}
+
+func (s *testStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *testStub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *testStub) GetStringArgs() []string {
+	args := make([]string, 0, len(s.args))
+	for _, a := range s.args {
+		args = append(args, string(a))
+	}
+	return args
+}
+
+func (s *testStub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (s *testStub) PutState(key string, value []byte) error {
+	if s.TxID == "" {
+		return fmt.Errorf("cannot PutState without a transaction")
+	}
+	if _, ok := s.writes[key]; !ok {
+		s.writeOrder = append(s.writeOrder, key)
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *testStub) DelState(key string) error {
+	return s.PutState(key, nil)
+}
+
+func (s *testStub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *testStub) GetPrivateData(collection, key string) ([]byte, error) {
+	if s.peer != "" && !inCollection(collection, s.peer) {
+		return nil, nil
+	}
+	return s.MockStub.GetPrivateData(collection, key)
+}
+
+func (s *testStub) PutPrivateData(collection, key string, value []byte) error {
+	if s.TxID == "" {
+		return fmt.Errorf("cannot PutPrivateData without a transaction")
+	}
+	if s.pvtWrites[collection] == nil {
+		s.pvtWrites[collection] = make(map[string][]byte)
+	}
+	s.pvtWrites[collection][key] = value
+	return nil
+}
+
+// inCollection 组织是否在 pairCollection 生成的集合中，与 collections_config.json 一致，payment在所有集合中
+func inCollection(collection, org string) bool {
+	if org == orgPayment {
+		return true
+	}
+	for _, name := range strings.Split(collection, "-")[1:] {
+		if name == strings.Replace(org, ".", "_", -1) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetQueryResultWithPagination 示例网络的状态数据库为LevelDB，不支持富查询
+func (s *testStub) GetQueryResultWithPagination(query string, pageSize int32,
+	bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	return nil, nil, fmt.Errorf("ExecuteQueryWithMetadata not supported for leveldb")
+}
+
+func (s *testStub) SetEvent(name string, payload []byte) error {
+	s.event = &peer.ChaincodeEvent{EventName: name, Payload: payload}
+	return nil
+}
+
+func (s *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{items: s.history[key]}, nil
+}
+
+func (s *testStub) commit() {
+	for _, key := range s.writeOrder {
+		val := s.writes[key]
+		if len(val) > 0 {
+			s.MockStub.PutState(key, val)
+		} else {
+			s.MockStub.DelState(key)
+		}
+		s.history[key] = append(s.history[key], &queryresult.KeyModification{
+			TxId:      s.TxID,
+			Value:     val,
+			Timestamp: s.TxTimestamp,
+			IsDelete:  len(val) == 0,
+		})
+	}
+	for collection, writes := range s.pvtWrites {
+		for key, val := range writes {
+			s.MockStub.PutPrivateData(collection, key, val)
+		}
+	}
+}
+
+func (s *testStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string,
+	pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	iter, err := s.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iter.Close()
+	page := &kvIterator{}
+	var next string
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if kv.Key < bookmark {
+			continue
+		}
+		if len(page.items) == int(pageSize) {
+			next = kv.Key
+			break
+		}
+		page.items = append(page.items, kv)
+	}
+	return page, &peer.QueryResponseMetadata{FetchedRecordsCount: int32(len(page.items)), Bookmark: next}, nil
+}
+
+type kvIterator struct {
+	items []*queryresult.KV
+}
+
+func (it *kvIterator) HasNext() bool {
+	return len(it.items) > 0
+}
+
+func (it *kvIterator) Next() (*queryresult.KV, error) {
+	if len(it.items) == 0 {
+		return nil, fmt.Errorf("no more items")
+	}
+	kv := it.items[0]
+	it.items = it.items[1:]
+	return kv, nil
+}
+
+func (it *kvIterator) Close() error {
+	return nil
+}
+
+type historyIterator struct {
+	items []*queryresult.KeyModification
+}
+
+func (it *historyIterator) HasNext() bool {
+	return len(it.items) > 0
+}
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if len(it.items) == 0 {
+		return nil, fmt.Errorf("no more items")
+	}
+	km := it.items[0]
+	it.items = it.items[1:]
+	return km, nil
+}
+
+func (it *historyIterator) Close() error {
+	return nil
+}
+
+func (s *testStub) call(mspID string, attrs map[string]string, init bool, fn string, args ...string) peer.Response {
+	s.txSeq++
+	s.now++
+	txID := fmt.Sprintf("tx%04d", s.txSeq)
+	s.creator = s.identity(mspID, attrs)
+	s.args = [][]byte{[]byte(fn)}
+	for _, a := range args {
+		s.args = append(s.args, []byte(a))
+	}
+	s.writes = make(map[string][]byte)
+	s.writeOrder = nil
+	s.pvtWrites = make(map[string]map[string][]byte)
+	s.event = nil
+
+	s.MockTransactionStart(txID)
+	s.TxTimestamp = &timestamp.Timestamp{Seconds: s.now}
+	var res peer.Response
+	if init {
+		res = new(Contract).Init(s)
+	} else {
+		res = new(Contract).Invoke(s)
+	}
+	if res.Status == shim.OK {
+		s.commit()
+	} else {
+		s.event = nil
+	}
+	s.MockTransactionEnd(txID)
+	return res
+}
+
+func (s *testStub) init(mspID string, args ...string) peer.Response {
+	return s.call(mspID, nil, true, "init", args...)
+}
+
+// invoke 以 mspID 组织成员的身份调用链码
+func (s *testStub) invoke(mspID string, fn string, args ...string) peer.Response {
+	return s.call(mspID, nil, false, fn, args...)
+}
+
+// invokeWithTransient 调用链码，transient中的数据不会写入交易
+func (s *testStub) invokeWithTransient(mspID string, transient map[string]string, fn string, args ...string) peer.Response {
+	s.transient = make(map[string][]byte)
+	for k, v := range transient {
+		s.transient[k] = []byte(v)
+	}
+	defer func() { s.transient = nil }()
+	return s.call(mspID, nil, false, fn, args...)
+}
+
+// mustInvoke 调用链码，失败时终止测试
+func (s *testStub) mustInvoke(mspID string, fn string, args ...string) []byte {
+	s.t.Helper()
+	res := s.invoke(mspID, fn, args...)
+	if res.Status != shim.OK {
+		s.t.Fatalf("%s(%v) by %s failed: %s", fn, args, mspID, res.Message)
+	}
+	return res.Payload
+}
+
+// mustFail 调用链码，成功时终止测试
+func (s *testStub) mustFail(mspID string, fn string, args ...string) string {
+	s.t.Helper()
+	res := s.invoke(mspID, fn, args...)
+	if res.Status == shim.OK {
+		s.t.Fatalf("%s(%v) by %s should fail", fn, args, mspID)
+	}
+	return res.Message
+}
+
+// envelope 解析上一个交易发出的事件信封
+func (s *testStub) envelope() *events.Envelope {
+	s.t.Helper()
+	if s.event == nil {
+		s.t.Fatal("expect events, got none")
+	}
+	env, err := events.Decode(s.event.EventName, s.event.Payload)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return env
+}
+
+// expectEvent 检查上一个交易发出了名为name的事件，并解析第一个这样的事件
+func (s *testStub) expectEvent(name string, v interface{}) {
+	s.t.Helper()
+	e, ok := s.envelope().Find(name)
+	if !ok {
+		s.t.Fatalf("expect event %s, got %s", name, s.event.Payload)
+	}
+	if v != nil {
+		if err := e.Decode(v); err != nil {
+			s.t.Fatalf("failed to unmarshal event %s: %v", name, err)
+		}
+	}
+}
+
+// expectEvents 检查上一个交易发出的全部事件的名字和顺序
+func (s *testStub) expectEvents(names ...string) {
+	s.t.Helper()
+	var got []string
+	for _, e := range s.envelope().Events {
+		got = append(got, e.Name)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(names) {
+		s.t.Fatalf("expect events %v, got %v", names, got)
+	}
+}
+
+func (s *testStub) expectBalance(role string, want uint64) {
+	s.t.Helper()
+	var m map[string]Amount
+	if err := json.Unmarshal(s.mustInvoke(orgPayment, "balanceOf", role), &m); err != nil {
+		s.t.Fatal(err)
+	}
+	// want以货币单位计
+	if want, err := ParseAmount(strconv.FormatUint(want, 10)); err != nil || m[role].Cmp(want) != 0 {
+		s.t.Fatalf("balance of %s: want %d, got %s", role, want, m[role])
+	}
+}
+
+func (s *testStub) expectMaterials(role string, want map[string]uint64) {
+	s.t.Helper()
+	var m map[string]uint64
+	if err := json.Unmarshal(s.mustInvoke(role, "getMyMaterials"), &m); err != nil {
+		s.t.Fatal(err)
+	}
+	expectCounts(s.t, "materials of "+role, want, m)
+}
+
+func (s *testStub) expectProducts(role string, want map[string]uint64) {
+	s.t.Helper()
+	var m map[string]uint64
+	if err := json.Unmarshal(s.mustInvoke(role, "getMyProducts"), &m); err != nil {
+		s.t.Fatal(err)
+	}
+	expectCounts(s.t, "products of "+role, want, m)
+}
+
+func expectCounts(t *testing.T, what string, want, got map[string]uint64) {
+	t.Helper()
+	if len(want) != len(got) {
+		t.Fatalf("%s: want %v, got %v", what, want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("%s: want %v, got %v", what, want, got)
+		}
+	}
+}
+
+// setupOrder 注册价格、物料并给各方充值，返回可以直接下单的链码
+func setupOrder(t *testing.T) *testStub {
+	s := newTestStub(t)
+	s.mustInvoke(orgPayment, "setCancelCompensate", "50")
+	s.mustInvoke(orgPayment, "mint", orgTV, "100000")
+	s.mustInvoke(orgPayment, "mint", orgStore, "100000")
+	s.mustInvoke(orgLCD, "setMaterialPrice", "LCD", "100")
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "300", "LCD_1")
+	s.mustInvoke(orgTV, "setProductPrice", "TV", "3000")
+	return s
+}
+
+func (s *testStub) makeOrder(payer, fn string, args ...string) Order {
+	s.t.Helper()
+	var order Order
+	if err := json.Unmarshal(s.mustInvoke(payer, fn, args...), &order); err != nil {
+		s.t.Fatal(err)
+	}
+	return order
+}
+
+// shipOrder 供货商接单并发货，之后下单者可以确认收货
+func (s *testStub) shipOrder(producer, orderID string) {
+	s.t.Helper()
+	s.mustInvoke(producer, "acceptOrder", orderID)
+	s.mustInvoke(producer, "shipOrder", orderID)
+}
+
+func TestUnsupportedMethod(t *testing.T) {
+	s := newTestStub(t)
+	if msg := s.mustFail(orgTV, "noSuchMethod"); msg != "unsupported method" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
+
+func TestFullProcedure(t *testing.T) {
+	s := setupOrder(t)
+
+	// 电视厂商向LCD厂商下物料订单
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	s.expectEvent("EvtMakeOrder", nil)
+	s.expectBalance(orgTV, 90000)
+
+	// LCD厂商接单发货，电视厂商确认收货，物料转移，货款支付给LCD厂商
+	s.shipOrder(orgLCD, order.OrderID)
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	s.expectEvent("EvtConfirmOrder", nil)
+	s.expectBalance(orgLCD, 10000)
+	s.expectMaterials(orgTV, map[string]uint64{"LCD": 100})
+	s.expectMaterials(orgLCD, map[string]uint64{"LCD": 200})
+
+	// 生产: 消耗物料并注册产品
+	s.mustInvoke(orgTV, "consumeMaterial", "LCD", "20")
+	s.expectEvent("EvtMaterialConsumed", nil)
+	s.expectMaterials(orgTV, map[string]uint64{"LCD": 80})
+	for i := 0; i < 2; i++ {
+		s.mustInvoke(orgTV, "registerProduct", "TV", fmt.Sprintf("TV_%d", i), "2020-05-20", "LCD_1")
+		s.expectEvent("EvtProductCreated", nil)
+	}
+	s.expectProducts(orgTV, map[string]uint64{"TV": 2})
+
+	// 商店下产品订单，电视厂商接单后商店取消，按50%补偿电视厂商
+	tvOrder := s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "2", "3000")
+	s.expectBalance(orgStore, 94000)
+	s.mustInvoke(orgTV, "acceptOrder", tvOrder.OrderID)
+	s.mustInvoke(orgStore, "cancelOrder", tvOrder.OrderID)
+	var evt map[string]interface{}
+	s.expectEvent("EvtCancelOrder", &evt)
+	if evt["returnToPayer"] != "3000" || evt["payToProducer"] != "3000" {
+		t.Fatalf("unexpected cancel event %v", evt)
+	}
+	s.expectBalance(orgStore, 97000)
+	s.expectBalance(orgTV, 93000)
+	s.expectProducts(orgTV, map[string]uint64{"TV": 2})
+	s.expectProducts(orgStore, map[string]uint64{})
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -13,11 +12,13 @@ import (
 
 // Material 物料
 type Material struct {
-	Producer     string    `json:"producer"`
-	CreatedAt    time.Time `json:"createdAt"`
-	BatchID      string    `json:"batchID"`
-	MaterialType string    `json:"materialType"`
-	TotalNum     uint64    `json:"totalNum"`
+	Producer     string     `json:"producer"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	BatchID      string     `json:"batchID"`
+	MaterialType string     `json:"materialType"`
+	TotalNum     uint64     `json:"totalNum,omitempty"`
+	WrittenOff   uint64     `json:"writtenOff,omitempty"` //各持有者累计核销的数量
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`  //过期时间，按fefo策略出库时先使用先过期的批次
 }
 
 func (c *Contract) getMyMaterials(stub shim.ChaincodeStubInterface, args []string) peer.Response {
@@ -32,15 +33,92 @@ func (c *Contract) getMyMaterials(stub shim.ChaincodeStubInterface, args []strin
 	return shim.Success(data)
 }
 
-func (c *Contract) registerMaterial(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+// MaterialStock 某个批次的物料库存
+type MaterialStock struct {
+	MaterialType string `json:"materialType"`
+	BatchID      string `json:"batchID"`
+	Num          uint64 `json:"num"`
+}
+
+// getMyMaterialsPage 分页查询调用者的物料库存明细，参数 [materialType, pageSize, bookmark]，
+// materialType为空时查询所有类型
+func (c *Contract) getMyMaterialsPage(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 1 {
+		return shim.Error("invalid arguments")
+	}
+	pageSize, bookmark, err := parsePage(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	keys := []string{role}
+	if args[0] != "" {
+		keys = append(keys, args[0])
+	}
+	iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(PrefixMaterialPreserve, keys, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+	}
+	defer iter.Close()
+	stocks := []MaterialStock{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(attr) != 3 {
+			return shim.Error("internal key format wrong")
+		}
+		stocks = append(stocks, MaterialStock{
+			MaterialType: attr[1],
+			BatchID:      attr[2],
+			Num:          bytesToUint64(kv.Value),
+		})
+	}
+	data, err := json.Marshal(Page{Records: stocks, Count: len(stocks), Bookmark: meta.GetBookmark()})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+func (c *Contract) getMaterialBatch(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	material, err := getMaterialBatch(stub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	if !strings.HasPrefix(role, "material.") {
-		return shim.Error("only for material producer")
+	if material == nil {
+		return shim.Error(fmt.Sprintf("batch(%s) does not exist", args[0]))
+	}
+	data, err := json.Marshal(materialView(stub, material, role))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal material %v", err))
+	}
+	return shim.Success(data)
+}
+
+// registerMaterial 登记一个批次的物料，参数 [materialType, totalNum, batchID, expiresAt]，
+// expiresAt可选，格式为RFC3339或2006-01-02
+func (c *Contract) registerMaterial(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	role, err := requireRole(stub, RoleMaterialProducer)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	if len(args) != 3 {
+	if len(args) != 3 && len(args) != 4 {
 		return shim.Error("invalid arguments")
 	}
 	materialType := args[0]
@@ -60,6 +138,13 @@ func (c *Contract) registerMaterial(stub shim.ChaincodeStubInterface, args []str
 		MaterialType: materialType,
 		TotalNum:     totalNum,
 	}
+	if len(args) == 4 && args[3] != "" {
+		expiresAt, err := parseTime(args[3])
+		if err != nil {
+			return shim.Error(fmt.Sprintf("invalid argument(3 expiresAt), got %s", args[3]))
+		}
+		material.ExpiresAt = &expiresAt
+	}
 	mpkey, err := stub.CreateCompositeKey(PrefixMaterialPreserve, []string{role, materialType, batchID})
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to create key, %v", err))
@@ -81,8 +166,10 @@ func (c *Contract) registerMaterial(stub shim.ChaincodeStubInterface, args []str
 	return shim.Success(nil)
 }
 
+// consumeMaterial 消耗调用者持有的物料，参数 [materialType, num, batchID...]，
+// 不指定批次时按调用者的出库策略选择批次，返回实际消耗的批次
 func (c *Contract) consumeMaterial(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return shim.Error("invalid arguments")
 	}
 	materialType := args[0]
@@ -90,49 +177,59 @@ func (c *Contract) consumeMaterial(stub shim.ChaincodeStubInterface, args []stri
 	if err != nil {
 		return shim.Error(fmt.Sprintf("invalid num, got %s", args[1]))
 	}
-	total := num
 	role, err := cid.GetMSPID(stub)
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to get role %v", err))
 	}
-	iter, err := stub.GetStateByPartialCompositeKey(PrefixMaterialPreserve, []string{role, materialType})
+	allocs, err := consumeMaterial(stub, role, materialType, num, args[2:])
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to create key %v", err))
+		return shim.Error(err.Error())
 	}
-	for iter.HasNext() && num > 0 {
-		kv, err := iter.Next()
-		if err != nil {
-			return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
-		}
-		keptNum := bytesToUint64(kv.Value)
-		if keptNum > num {
-			keptNum -= num
-			if err := stub.PutState(kv.Key, uint64ToBytes(keptNum)); err != nil {
-				return shim.Error(fmt.Sprintf("failed to put state"))
-			}
-			num = 0
-		} else {
-			if err := stub.DelState(kv.Key); err != nil {
-				return shim.Error(fmt.Sprintf("failed to del state"))
-			}
-			num -= keptNum
-		}
+	data, err := json.Marshal(allocs)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
 	}
-	if num != 0 {
-		return shim.Error(fmt.Sprintf("insufficient materials, %d less", num))
+	return shim.Success(data)
+}
+
+// consumeMaterial 从owner的库存中扣除物料，发出EvtMaterialConsumed事件，返回实际消耗的批次
+func consumeMaterial(stub shim.ChaincodeStubInterface, owner, materialType string, num uint64, batches []string) ([]BatchAllocation, error) {
+	allocs, stocks, err := allocateMaterial(stub, owner, "", materialType, num, batches)
+	if err != nil {
+		return nil, err
+	}
+	for i, alloc := range allocs {
+		if err := takeStock(stub, stocks[i], alloc.Num); err != nil {
+			return nil, err
+		}
 	}
 	evtData, err := json.Marshal(map[string]interface{}{
-		"who":          role,
+		"who":          owner,
 		"materialType": materialType,
-		"num":          total,
+		"num":          num,
+		"batches":      allocs,
 	})
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to marshal event data %v", err))
+		return nil, fmt.Errorf("failed to marshal event data %v", err)
 	}
 	if err := stub.SetEvent("EvtMaterialConsumed", evtData); err != nil {
-		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+		return nil, fmt.Errorf("failed to set event %v", err)
 	}
-	return shim.Success(nil)
+	return allocs, nil
+}
+
+// takeStock 从一个批次的库存中扣除num个，扣完时删除
+func takeStock(stub shim.ChaincodeStubInterface, stock batchStock, num uint64) error {
+	if stock.num > num {
+		if err := stub.PutState(stock.key, uint64ToBytes(stock.num-num)); err != nil {
+			return fmt.Errorf("failed to put state %v", err)
+		}
+		return nil
+	}
+	if err := stub.DelState(stock.key); err != nil {
+		return fmt.Errorf("failed to del state %v", err)
+	}
+	return nil
 }
 
 func (c *Contract) getMaterialPrice(stub shim.ChaincodeStubInterface, args []string) peer.Response {
@@ -145,7 +242,7 @@ func (c *Contract) getMaterialPrice(stub shim.ChaincodeStubInterface, args []str
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	return shim.Success([]byte(strconv.FormatUint(price, 10)))
+	return shim.Success([]byte(price.String()))
 }
 
 func (c *Contract) setMaterialPrice(stub shim.ChaincodeStubInterface, args []string) peer.Response {
@@ -153,34 +250,38 @@ func (c *Contract) setMaterialPrice(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("invalid arguments")
 	}
 	materialType := args[0]
-	role, err := cid.GetMSPID(stub)
+	role, err := requireRole(stub, RoleMaterialProducer)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get role %v", err))
-	}
-	if !strings.HasPrefix(role, "material.") {
-		return shim.Error(fmt.Sprintf("only for material producer, got %s", role))
+		return shim.Error(err.Error())
 	}
-	price, err := strconv.ParseUint(args[1], 10, 64)
+	price, err := ParseAmount(args[1])
 	if err != nil {
 		return shim.Error(fmt.Sprintf("invalid price, got %v", args[1]))
 	}
 	key := fmt.Sprintf("%s-%s-%s", PrefixMaterialPrice, role, materialType)
-	if err := stub.PutState(key, uint64ToBytes(price)); err != nil {
+	if err := stub.PutState(key, amountToBytes(price)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state, %v", err))
+	}
+	ikey, err := stub.CreateCompositeKey(PrefixMaterialPriceIndex, []string{materialType, role})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to create key, %v", err))
+	}
+	if err := stub.PutState(ikey, []byte{1}); err != nil {
 		return shim.Error(fmt.Sprintf("failed to put state, %v", err))
 	}
 	return shim.Success(nil)
 }
 
-func getMaterialPrice(stub shim.ChaincodeStubInterface, role string, materialType string) (uint64, error) {
+func getMaterialPrice(stub shim.ChaincodeStubInterface, role string, materialType string) (Amount, error) {
 	key := fmt.Sprintf("%s-%s-%s", PrefixMaterialPrice, role, materialType)
 	val, err := stub.GetState(key)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get state, %v", err)
+		return Amount{}, fmt.Errorf("failed to get state, %v", err)
 	}
-	if len(val) != 8 {
-		return 0, fmt.Errorf("price for materialType(%s) not found", materialType)
+	if len(val) == 0 {
+		return Amount{}, fmt.Errorf("price for materialType(%s) not found", materialType)
 	}
-	return bytesToUint64(val), nil
+	return bytesToAmount(val)
 }
 
 func getMyMaterials(stub shim.ChaincodeStubInterface) (map[string]uint64, error) {
@@ -211,63 +312,85 @@ func getMyMaterials(stub shim.ChaincodeStubInterface) (map[string]uint64, error)
 	return m, nil
 }
 
-func transferMaterial(stub shim.ChaincodeStubInterface, from, to string, materialType string, num uint64) error {
+// transferMaterial 按reqs从from的库存中转移物料给to，每个请求的batches不为空时只从这些批次中取，返回实际转移的批次。
+// store不为空时从from寄存在该门店的物料中出库，并发出门店的EvtCheckOut事件
+func transferMaterial(stub shim.ChaincodeStubInterface, from, to, store, materialType string, reqs []materialRequest, orderID string) ([]BatchAllocation, error) {
 	if from == to {
-		return fmt.Errorf("transfer to a same guy is forbidden")
+		return nil, fmt.Errorf("transfer to a same guy is forbidden")
 	}
-	iter, err := stub.GetStateByPartialCompositeKey(PrefixMaterialPreserve, []string{from, materialType})
+	allocs, stocks, err := allocateMaterialRequests(stub, from, store, materialType, reqs)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	total := num
-	for iter.HasNext() && num > 0 {
-		kv, err := iter.Next()
-		if err != nil {
-			return err
+	var num uint64
+	for _, req := range reqs {
+		num += req.num
+	}
+	for i, alloc := range allocs {
+		if err := takeStock(stub, stocks[i], alloc.Num); err != nil {
+			return nil, err
 		}
-		ot, attr, err := stub.SplitCompositeKey(kv.Key)
+		toKey, err := stub.CreateCompositeKey(PrefixMaterialPreserve, []string{to, materialType, alloc.BatchID})
 		if err != nil {
-			return err
+			return nil, err
 		}
-		attr[0] = to
-		toKey, err := stub.CreateCompositeKey(ot, attr)
+		// 收货方可能已经持有同一批次的物料(例如分批收货)，需要累加
+		toState, err := stub.GetState(toKey)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		keptNum := bytesToUint64(kv.Value)
-		if keptNum > num {
-			keptNum -= num
-			if err := stub.PutState(kv.Key, uint64ToBytes(keptNum)); err != nil {
-				return err
-			}
-			if err := stub.PutState(toKey, uint64ToBytes(num)); err != nil {
-				return err
-			}
-			num = 0
-		} else {
-			if err := stub.DelState(kv.Key); err != nil {
-				return err
-			}
-			if err := stub.PutState(toKey, uint64ToBytes(keptNum)); err != nil {
-				return err
-			}
-			num -= keptNum
+		if err := stub.PutState(toKey, uint64ToBytes(bytesToUint64(toState)+alloc.Num)); err != nil {
+			return nil, err
 		}
 	}
-	if num != 0 {
-		return fmt.Errorf("insufficient materials, %d less", num)
-	}
 	evtData, err := json.Marshal(map[string]interface{}{
 		"from":         from,
 		"to":           to,
 		"materialType": materialType,
-		"num":          total,
+		"num":          num,
+		"batches":      allocs,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err := stub.SetEvent("EvtMaterialTransferred", evtData); err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	if store != "" {
+		if err := setCustodyEvent(stub, "EvtCheckOut", map[string]interface{}{
+			"store": store, "owner": from, "to": to, "kind": CustodyMaterial,
+			"materialType": materialType, "num": num, "batches": allocs, "orderID": orderID,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return allocs, nil
+}
+
+// materialView 按调用者过滤批次字段，批次产量和核销数量只对生产者和结算方可见
+func materialView(stub shim.ChaincodeStubInterface, material *Material, role string) *Material {
+	if material == nil || role == material.Producer || isAuditor(stub, role) {
+		return material
+	}
+	m := *material
+	m.TotalNum = 0
+	m.WrittenOff = 0
+	return &m
+}
+
+// getMaterialBatch 获取批次信息，批次不存在时返回nil
+func getMaterialBatch(stub shim.ChaincodeStubInterface, batchID string) (*Material, error) {
+	mbkey := fmt.Sprintf("%s-%s", PrefixMaterialBatchInfo, batchID)
+	val, err := stub.GetState(mbkey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state, %v", err)
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	var material Material
+	if err := json.Unmarshal(val, &material); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal material, %v", err)
+	}
+	return &material, nil
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRegisterMaterial(t *testing.T) {
+	s := newTestStub(t)
+	s.mustFail(orgTV, "registerMaterial", "LCD", "100", "LCD_1")
+	s.mustFail(orgLCD, "registerMaterial", "LCD", "abc", "LCD_1")
+
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "100", "LCD_1")
+	var m Material
+	s.expectEvent("EvtMaterialCreated", &m)
+	if m.Producer != orgLCD || m.BatchID != "LCD_1" || m.TotalNum != 100 {
+		t.Fatalf("unexpected material %+v", m)
+	}
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "50", "LCD_2")
+	s.expectMaterials(orgLCD, map[string]uint64{"LCD": 150})
+	s.expectMaterials(orgTV, map[string]uint64{})
+}
+
+func TestConsumeMaterial(t *testing.T) {
+	s := newTestStub(t)
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "100", "LCD_1")
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "100", "LCD_2")
+
+	// 跨批次消耗
+	s.mustInvoke(orgLCD, "consumeMaterial", "LCD", "150")
+	var evt map[string]interface{}
+	s.expectEvent("EvtMaterialConsumed", &evt)
+	if evt["num"].(float64) != 150 {
+		t.Fatalf("unexpected event %v", evt)
+	}
+	s.expectMaterials(orgLCD, map[string]uint64{"LCD": 50})
+
+	// 库存不足时整笔失败，不会消耗剩余物料
+	s.mustFail(orgLCD, "consumeMaterial", "LCD", "51")
+	s.expectMaterials(orgLCD, map[string]uint64{"LCD": 50})
+}
+
+func TestMaterialPrice(t *testing.T) {
+	s := newTestStub(t)
+	s.mustFail(orgTV, "setMaterialPrice", "LCD", "100")
+	s.mustFail(orgLCD, "setMaterialPrice", "LCD", "-1")
+	s.mustFail(orgTV, "getMaterialPrice", orgLCD, "LCD")
+
+	s.mustInvoke(orgLCD, "setMaterialPrice", "LCD", "100")
+	if price := string(s.mustInvoke(orgTV, "getMaterialPrice", orgLCD, "LCD")); price != "100" {
+		t.Fatalf("unexpected price %s", price)
+	}
+}
+
+func TestGetMaterialBatch(t *testing.T) {
+	s := newTestStub(t)
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "100", "LCD_1")
+
+	var m Material
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "getMaterialBatch", "LCD_1"), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Producer != orgLCD || m.MaterialType != "LCD" || m.TotalNum != 100 {
+		t.Fatalf("unexpected batch %+v", m)
+	}
+	// 产量对其他组织不可见
+	m = Material{}
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "getMaterialBatch", "LCD_1"), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Producer != orgLCD || m.TotalNum != 0 {
+		t.Fatalf("unexpected batch %+v", m)
+	}
+	s.mustFail(orgTV, "getMaterialBatch", "LCD_2")
+}
+
+func TestGetMyMaterialsPage(t *testing.T) {
+	s := newTestStub(t)
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "100", "LCD_1")
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "50", "LCD_2")
+	s.mustInvoke(orgLCD, "registerMaterial", "Panel", "10", "Panel_1")
+
+	type page struct {
+		Records  []MaterialStock `json:"records"`
+		Bookmark string          `json:"bookmark"`
+	}
+	var p page
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "getMyMaterialsPage", "LCD", "1"), &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Records) != 1 || p.Records[0].BatchID != "LCD_1" || p.Records[0].Num != 100 || p.Bookmark == "" {
+		t.Fatalf("unexpected page %+v", p)
+	}
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "getMyMaterialsPage", "LCD", "1", p.Bookmark), &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Records) != 1 || p.Records[0].BatchID != "LCD_2" || p.Records[0].Num != 50 || p.Bookmark != "" {
+		t.Fatalf("unexpected page %+v", p)
+	}
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "getMyMaterialsPage", ""), &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Records) != 3 {
+		t.Fatalf("unexpected page %+v", p)
+	}
+	s.mustFail(orgLCD, "getMyMaterialsPage", "LCD", "abc")
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// 订单状态，0-2沿用早期版本的取值，早期版本取消的订单也记为1
+const (
+	OrderCreated   byte = 0 // 已下单，等待供货商接单
+	OrderDelivered byte = 1 // 下单者已确认收货，货款已支付给供货商
+	OrderCancelled byte = 2 // 已取消
+	OrderAccepted  byte = 3 // 供货商已接单
+	OrderShipped   byte = 4 // 供货商已发货，可能只发了一部分
+	OrderRejected  byte = 5 // 供货商拒单
+	OrderClosed    byte = 6 // 部分收货后关闭，未收货部分的货款已退回下单者
+	OrderExpired   byte = 7 // 超时未完成，未收货部分的货款已退回下单者
+	OrderDisputed  byte = 8 // 争议中，等待仲裁方裁决，货款冻结
+	OrderResolved  byte = 9 // 仲裁方已裁决，货款已按裁决结果分配
+)
+
+var orderStatusNames = map[byte]string{
+	OrderCreated:   "created",
+	OrderDelivered: "delivered",
+	OrderCancelled: "cancelled",
+	OrderAccepted:  "accepted",
+	OrderShipped:   "shipped",
+	OrderRejected:  "rejected",
+	OrderClosed:    "closed",
+	OrderExpired:   "expired",
+	OrderDisputed:  "disputed",
+	OrderResolved:  "resolved",
+}
+
+func orderStatusName(status byte) string {
+	if name, ok := orderStatusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", status)
+}
+
+// isOrderOpen 订单是否还未结束
+func isOrderOpen(status byte) bool {
+	return status == OrderCreated || status == OrderAccepted || status == OrderShipped
+}
+
+// 订单操作
+const (
+	OrderActionAccept  = "accept"
+	OrderActionReject  = "reject"
+	OrderActionShip    = "ship"
+	OrderActionConfirm = "confirm"
+	OrderActionCancel  = "cancel"
+	OrderActionClose   = "close"
+	OrderActionDispute = "dispute"
+)
+
+// 订单操作的执行者
+const (
+	partyPayer    = "payer"
+	partyProducer = "producer"
+	partyBoth     = "payer or producer"
+)
+
+type orderTransition struct {
+	party string
+	from  []byte
+	to    byte
+}
+
+// orderTransitions 订单状态机: 操作 => 执行者、允许的起始状态和目标状态
+var orderTransitions = map[string]orderTransition{
+	OrderActionAccept:  {party: partyProducer, from: []byte{OrderCreated}, to: OrderAccepted},
+	OrderActionReject:  {party: partyProducer, from: []byte{OrderCreated}, to: OrderRejected},
+	OrderActionShip:    {party: partyProducer, from: []byte{OrderAccepted, OrderShipped}, to: OrderShipped},
+	OrderActionConfirm: {party: partyPayer, from: []byte{OrderShipped}, to: OrderDelivered},
+	OrderActionCancel:  {party: partyBoth, from: []byte{OrderCreated, OrderAccepted}, to: OrderCancelled},
+	OrderActionClose:   {party: partyBoth, from: []byte{OrderShipped}, to: OrderClosed},
+	OrderActionDispute: {party: partyBoth, from: []byte{OrderShipped, OrderDelivered}, to: OrderDisputed},
+}
+
+// OrderStatusError 订单当前状态不允许执行该操作
+type OrderStatusError struct {
+	OrderID string
+	Action  string
+	Status  byte
+}
+
+func (e *OrderStatusError) Error() string {
+	return fmt.Sprintf("ErrOrderStatus: order(%s) can not %s in status %s", e.OrderID, e.Action, orderStatusName(e.Status))
+}
+
+// OrderPartyError 调用者无权对订单执行该操作
+type OrderPartyError struct {
+	OrderID string
+	Action  string
+	Party   string
+	Caller  string
+}
+
+func (e *OrderPartyError) Error() string {
+	return fmt.Sprintf("ErrOrderParty: only the %s can %s order(%s), you are %s", e.Party, e.Action, e.OrderID, e.Caller)
+}
+
+// loadOrderForAction 读取订单，检查调用者身份和订单状态是否允许执行action，
+// 返回订单、调用者和迁移后的目标状态
+func loadOrderForAction(stub shim.ChaincodeStubInterface, orderID, action string) (*Order, string, byte, error) {
+	tr, ok := orderTransitions[action]
+	if !ok {
+		return nil, "", 0, fmt.Errorf("unknown order action %s", action)
+	}
+	if orderID == "" {
+		return nil, "", 0, fmt.Errorf("orderID is empty")
+	}
+	order, err := getOrder(stub, orderID)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("failed to get role")
+	}
+	var allowed bool
+	switch tr.party {
+	case partyPayer:
+		allowed = role == order.Payer
+	case partyProducer:
+		allowed = role == order.Producer
+	case partyBoth:
+		allowed = role == order.Payer || role == order.Producer
+	}
+	if !allowed {
+		return nil, "", 0, &OrderPartyError{OrderID: orderID, Action: action, Party: tr.party, Caller: role}
+	}
+	for _, from := range tr.from {
+		if order.Status == from {
+			return order, role, tr.to, nil
+		}
+	}
+	return nil, "", 0, &OrderStatusError{OrderID: orderID, Action: action, Status: order.Status}
+}
+
+// acceptOrder 供货商接单
+func (c *Contract) acceptOrder(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	order, _, to, err := loadOrderForAction(stub, args[0], OrderActionAccept)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	val, err := putOrder(stub, order, to)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.SetEvent("EvtAcceptOrder", val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// rejectOrder 供货商拒单，冻结的货款全部退回下单者
+func (c *Contract) rejectOrder(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	order, _, to, err := loadOrderForAction(stub, args[0], OrderActionReject)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addOrderBalance(stub, order, order.payerAccount(), order.Amount); err != nil {
+		return shim.Error(fmt.Sprintf("failed to add balance to payer %v", err))
+	}
+	val, err := putOrder(stub, order, to)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.SetEvent("EvtRejectOrder", val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// shipOrder 供货商发货，参数 [orderID, count, batchID...]，count为空时发出剩余全部数量，
+// 可以分多批发货，之后由下单者按批确认收货。物料订单可以指定本次发货的批次，发货时检查批次的库存，
+// 收货时按发货顺序只从各次发货指定的批次中转移
+func (c *Contract) shipOrder(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 1 {
+		return shim.Error("invalid arguments")
+	}
+	order, _, to, err := loadOrderForAction(stub, args[0], OrderActionShip)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	count, err := parseOrderCount(args[1:], order.Count-order.Shipped)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if order.Shipped+count > order.Count {
+		return shim.Error(fmt.Sprintf("order(%s) count %d, shipped %d, can not ship %d more", order.OrderID, order.Count, order.Shipped, count))
+	}
+	if len(args) > 2 && order.OrderType != 0 {
+		return shim.Error("batches can only be specified for material orders")
+	}
+	if order.OrderType == 0 {
+		// 指定的批次必须是供货商持有(或寄存在门店)的、未召回未过期的批次，并且数量足够
+		var batches []string
+		if len(args) > 2 {
+			batches = args[2:]
+			if _, _, err := allocateMaterial(stub, order.Producer, order.Store, order.Type, count, batches); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		order.Shipments = append(order.Shipments, OrderShipment{TxID: stub.GetTxID(), Count: count, Batches: batches})
+	}
+	order.Shipped += count
+	val, err := putOrder(stub, order, to)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.SetEvent("EvtShipOrder", val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// closeOrder 部分收货后关闭订单，未收货部分的货款退回下单者。
+// 下单者在一次都没有收货时关闭订单，与接单后取消一样按比例补偿供货商
+func (c *Contract) closeOrder(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	order, role, to, err := loadOrderForAction(stub, args[0], OrderActionClose)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	remain, err := order.Amount.Sub(order.Paid)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var compensate Amount
+	if role == order.Payer && order.Delivered == 0 {
+		cancelCompensate, err := getCancelCompensate(stub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get cancel compensate %v", err))
+		}
+		compensate = remain.Percent(cancelCompensate)
+		if remain, err = remain.Sub(compensate); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := addOrderBalance(stub, order, order.Producer, compensate); err != nil {
+			return shim.Error(fmt.Sprintf("failed to add balance to producer %v", err))
+		}
+	}
+	if err := addOrderBalance(stub, order, order.payerAccount(), remain); err != nil {
+		return shim.Error(fmt.Sprintf("failed to add balance to payer %v", err))
+	}
+	if _, err := putOrder(stub, order, to); err != nil {
+		return shim.Error(err.Error())
+	}
+	// 私有订单的事件中不包含金额
+	evt := map[string]interface{}{"orderID": order.OrderID, "delivered": order.Delivered}
+	if !order.Private {
+		evt["returnToPayer"] = remain
+		evt["payToProducer"] = compensate
+	}
+	evtData, err := json.Marshal(evt)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal event data %v", err))
+	}
+	if err := stub.SetEvent("EvtCloseOrder", evtData); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// parseOrderCount 解析可选的数量参数，为空时返回def，数量必须大于0
+func parseOrderCount(args []string, def uint64) (uint64, error) {
+	count := def
+	if len(args) > 0 && args[0] != "" {
+		var err error
+		if count, err = strconv.ParseUint(args[0], 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid count, got %s", args[0])
+		}
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("count must be greater than 0")
+	}
+	return count, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrderStateMachine(t *testing.T) {
+	s := setupOrder(t)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+
+	// 未接单、未发货时不能确认收货，供货商在接单前拿不到货款
+	if msg := s.mustFail(orgTV, "confirmOrder", order.OrderID); !strings.HasPrefix(msg, "ErrOrderStatus") {
+		t.Fatalf("unexpected error %s", msg)
+	}
+	s.mustFail(orgLCD, "shipOrder", order.OrderID)
+	if msg := s.mustFail(orgTV, "acceptOrder", order.OrderID); !strings.HasPrefix(msg, "ErrOrderParty") {
+		t.Fatalf("unexpected error %s", msg)
+	}
+
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+	var o Order
+	s.expectEvent("EvtAcceptOrder", &o)
+	if o.Status != OrderAccepted {
+		t.Fatalf("unexpected order %+v", o)
+	}
+	s.mustFail(orgLCD, "acceptOrder", order.OrderID)
+	s.mustFail(orgLCD, "rejectOrder", order.OrderID)
+
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID)
+	s.expectEvent("EvtShipOrder", &o)
+	if o.Status != OrderShipped {
+		t.Fatalf("unexpected order %+v", o)
+	}
+	// 发货后不能再取消
+	s.mustFail(orgTV, "cancelOrder", order.OrderID)
+	s.mustFail(orgLCD, "cancelOrder", order.OrderID)
+	s.expectBalance(orgLCD, 0)
+
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	s.expectBalance(orgLCD, 10000)
+	s.mustFail(orgTV, "confirmOrder", order.OrderID)
+}
+
+func TestRejectOrder(t *testing.T) {
+	s := setupOrder(t)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	s.mustFail(orgTV, "rejectOrder", order.OrderID)
+
+	s.mustInvoke(orgLCD, "rejectOrder", order.OrderID)
+	var o Order
+	s.expectEvent("EvtRejectOrder", &o)
+	if o.Status != OrderRejected {
+		t.Fatalf("unexpected order %+v", o)
+	}
+	s.expectBalance(orgTV, 100000)
+	s.mustFail(orgLCD, "acceptOrder", order.OrderID)
+	s.mustFail(orgTV, "cancelOrder", order.OrderID)
+}
+
+func TestCancelBeforeAccept(t *testing.T) {
+	s := setupOrder(t)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+
+	// 供货商接单前取消不需要补偿，订单记为已取消
+	s.mustInvoke(orgTV, "cancelOrder", order.OrderID)
+	s.expectBalance(orgTV, 100000)
+	s.expectBalance(orgLCD, 0)
+	var o Order
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "getOrder", order.OrderID), &o); err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != OrderCancelled {
+		t.Fatalf("unexpected order %+v", o)
+	}
+}
+
+func TestPartialDelivery(t *testing.T) {
+	s := setupOrder(t)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+	s.mustFail(orgLCD, "shipOrder", order.OrderID, "101")
+	s.mustFail(orgLCD, "shipOrder", order.OrderID, "0")
+
+	// 分两批发货，第一批收货后只支付对应部分的货款
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "50")
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID, "30")
+	var o Order
+	s.expectEvent("EvtConfirmOrder", &o)
+	if o.Status != OrderShipped || o.Delivered != 30 || o.Paid.String() != "3000" || len(o.Deliveries) != 1 {
+		t.Fatalf("unexpected order %+v", o)
+	}
+	s.mustFail(orgTV, "confirmOrder", order.OrderID, "21")
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "50")
+	s.mustFail(orgLCD, "shipOrder", order.OrderID, "1")
+
+	// 同一批次的物料分批到货时累加
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	s.expectEvent("EvtConfirmOrder", &o)
+	if o.Status != OrderDelivered || o.Delivered != 100 || o.Paid.String() != "10000" || len(o.Deliveries) != 2 {
+		t.Fatalf("unexpected order %+v", o)
+	}
+	s.expectMaterials(orgTV, map[string]uint64{"LCD": 100})
+	s.expectBalance(orgLCD, 10000)
+	s.mustFail(orgTV, "closeOrder", order.OrderID)
+}
+
+func TestCloseOrder(t *testing.T) {
+	s := setupOrder(t)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+	s.mustFail(orgTV, "closeOrder", order.OrderID)
+
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "40")
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	s.mustFail(orgStore, "closeOrder", order.OrderID)
+
+	// 关闭后未收货部分的货款退回下单者
+	s.mustInvoke(orgLCD, "closeOrder", order.OrderID)
+	var evt map[string]interface{}
+	s.expectEvent("EvtCloseOrder", &evt)
+	if evt["returnToPayer"] != "6000" || evt["delivered"].(float64) != 40 {
+		t.Fatalf("unexpected close event %v", evt)
+	}
+	s.expectBalance(orgTV, 96000)
+	s.expectBalance(orgLCD, 4000)
+	s.expectMaterials(orgTV, map[string]uint64{"LCD": 40})
+	s.mustFail(orgLCD, "shipOrder", order.OrderID, "10")
+	s.mustFail(orgTV, "confirmOrder", order.OrderID)
+
+	// 下单者在没有收货时关闭订单，与接单后取消一样按比例补偿供货商
+	order = s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "1")
+	s.mustInvoke(orgTV, "closeOrder", order.OrderID)
+	s.expectEvent("EvtCloseOrder", &evt)
+	if evt["returnToPayer"] != "5000" || evt["payToProducer"] != "5000" || evt["delivered"].(float64) != 0 {
+		t.Fatalf("unexpected close event %v", evt)
+	}
+	s.expectBalance(orgTV, 91000)
+	s.expectBalance(orgLCD, 9000)
+
+	// 供货商关闭没有收货的订单时全部退回下单者
+	order = s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100")
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+	s.mustInvoke(orgLCD, "shipOrder", order.OrderID, "1")
+	s.mustInvoke(orgLCD, "closeOrder", order.OrderID)
+	s.expectBalance(orgTV, 91000)
+	s.expectBalance(orgLCD, 9000)
+}
@@ -15,16 +15,94 @@ type Order struct {
 	OrderID   string    `json:"orderID"`   //订单ID
 	Payer     string    `json:"payer"`     //下单者
 	Producer  string    `json:"producer"`  //供货商
-	Amount    uint64    `json:"amount"`    //订单金额
+	Amount    Amount    `json:"amount"`    //订单金额
 	Count     uint64    `json:"count"`     //下单数量
 	Type      string    `json:"type"`      //产品类型
 	OrderType int       `json:"orderType"` //订单类型(物料订单0，产品订单1)
 	CreatedAt time.Time `json:"createdAt"` //下单时间
-	Status    byte      `json:"status"`    //订单状态 0处理中，1已完成，2已取消
+	Status    byte      `json:"status"`    //订单状态，见 order.go 中的 Order* 常量
+	Shipped   uint64    `json:"shipped"`   //已发货数量
+	Delivered uint64    `json:"delivered"` //已确认收货数量
+	Paid      Amount    `json:"paid"`      //已支付给供货商的金额
+
+	Deadline *time.Time `json:"deadline,omitempty"` //截止时间，超时未完成的订单任何人都可以触发退款
+
+	PayerAccount string `json:"payerAccount,omitempty"` //按身份记账时下单者个人的资金账户，退款退回该账户
+
+	Private        bool   `json:"private,omitempty"`        //金额保存在双方的私有数据集合中，通道上的金额为0
+	FinancialsHash string `json:"financialsHash,omitempty"` //私有订单完整数据的sha256，只出现在通道上的公开部分
+	Salt           string `json:"salt,omitempty"`           //私有订单的随机盐，只保存在私有数据中
+	Escrow         bool   `json:"escrow,omitempty"`         //货款托管在双方私有数据集合中的余额里，早期的私有订单为false
+
+	DocType string `json:"docType,omitempty"` //固定为order，用于CouchDB富查询
+
+	Deliveries []OrderDelivery `json:"deliveries,omitempty"` //分批收货记录
+
+	Batches   []string        `json:"batches,omitempty"`   //早期物料订单发货时供货商指定的批次，新订单记录在Shipments中
+	Shipments []OrderShipment `json:"shipments,omitempty"` //物料订单的分批发货记录
+
+	Store string `json:"store,omitempty"` //从供货商寄存在该门店的货物中发货，确认收货时从门店出库
 }
 
+// payerAccount 下单者支付货款和接收退款的资金账户
+func (order *Order) payerAccount() string {
+	if order.PayerAccount != "" {
+		return order.PayerAccount
+	}
+	return order.Payer
+}
+
+// OrderShipment 物料订单的一次发货
+type OrderShipment struct {
+	TxID    string   `json:"txID"`              //发货的交易ID
+	Count   uint64   `json:"count"`             //本次发货数量
+	Batches []string `json:"batches,omitempty"` //本次发货指定的批次，为空时收货时按供货商的出库策略选择
+}
+
+// deliveryRequests 按发货顺序返回接下来count个收货对应的各次发货的出库请求。
+// 早期订单没有发货记录，没有记录的部分视为最先发出，使用order.Batches
+func (order *Order) deliveryRequests(count uint64) []materialRequest {
+	var recorded uint64
+	for _, shipment := range order.Shipments {
+		recorded += shipment.Count
+	}
+	shipments := append([]OrderShipment{{Count: order.Shipped - recorded, Batches: order.Batches}}, order.Shipments...)
+	skip := order.Delivered
+	var reqs []materialRequest
+	for _, shipment := range shipments {
+		if count == 0 {
+			break
+		}
+		if shipment.Count <= skip {
+			skip -= shipment.Count
+			continue
+		}
+		num := shipment.Count - skip
+		skip = 0
+		if num > count {
+			num = count
+		}
+		reqs = append(reqs, materialRequest{num: num, batches: shipment.Batches})
+		count -= num
+	}
+	return reqs
+}
+
+// OrderDelivery 一次确认收货
+type OrderDelivery struct {
+	TxID      string    `json:"txID"`      //确认收货的交易ID
+	Count     uint64    `json:"count"`     //本次收货数量
+	Amount    Amount    `json:"amount"`    //本次支付给供货商的金额
+	Timestamp time.Time `json:"timestamp"` //收货时间
+
+	Batches []BatchAllocation `json:"batches,omitempty"` //物料订单本次收货实际转移的批次
+}
+
+// makeMaterialOrder 下物料订单，参数 [producer, materialType, count, price, timeout, store]，
+// timeout为订单超时秒数，为空时使用供货商设置的默认值。store不为空时从供货商寄存在该门店的货物中发货。
+// price为空时从transient的price读取，订单为私有订单，优先使用供货商给下单者的协商价格
 func (c *Contract) makeMaterialOrder(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	if len(args) != 4 {
+	if len(args) < 4 || len(args) > 6 {
 		return shim.Error("invalid arguments")
 	}
 	producer := args[0]
@@ -33,15 +111,20 @@ func (c *Contract) makeMaterialOrder(stub shim.ChaincodeStubInterface, args []st
 	if err != nil {
 		return shim.Error(fmt.Sprintf("invalid count, got %s", args[2]))
 	}
-	price, err := strconv.ParseUint(args[3], 10, 64)
+	price, private, err := parseOrderPrice(stub, args[3])
 	if err != nil {
-		return shim.Error(fmt.Sprintf("invalid price, got %s", args[3]))
+		return shim.Error(err.Error())
+	}
+	timeout, err := parseOrderTimeout(args[4:])
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	return makeOrder(stub, producer, 0, materialType, count, price)
+	return makeOrder(stub, producer, 0, materialType, count, price, timeout, private, orderStore(args))
 }
 
+// makeProductOrder 下产品订单，参数同makeMaterialOrder
 func (c *Contract) makeProductOrder(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	if len(args) != 4 {
+	if len(args) < 4 || len(args) > 6 {
 		return shim.Error("invalid arguments")
 	}
 	producer := args[0]
@@ -50,67 +133,83 @@ func (c *Contract) makeProductOrder(stub shim.ChaincodeStubInterface, args []str
 	if err != nil {
 		return shim.Error(fmt.Sprintf("invalid count, got %s", args[2]))
 	}
-	price, err := strconv.ParseUint(args[3], 10, 64)
+	price, private, err := parseOrderPrice(stub, args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	timeout, err := parseOrderTimeout(args[4:])
 	if err != nil {
-		return shim.Error(fmt.Sprintf("invalid price, got %s", args[3]))
+		return shim.Error(err.Error())
 	}
-	return makeOrder(stub, producer, 1, productType, count, price)
+	return makeOrder(stub, producer, 1, productType, count, price, timeout, private, orderStore(args))
 }
 
+// confirmOrder 下单者确认收货，参数 [orderID, count]，count为空时确认全部已发货未收货的数量。
+// 按收货数量转移物料或产品，并将对应部分的货款支付给供货商，全部收货后订单完成。
+// 返回更新后的订单，物料订单的收货记录中有实际转移的批次
 func (c *Contract) confirmOrder(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		return shim.Error("invalid arguments")
 	}
-	orderID := args[0]
-	if orderID == "" {
-		return shim.Error("orderID is empty")
-	}
-	okey := fmt.Sprintf("%s-%s", PrefixOrder, orderID)
-	val, err := stub.GetState(okey)
+	order, _, to, err := loadOrderForAction(stub, args[0], OrderActionConfirm)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get order from orderID %v", err))
-	}
-	if len(val) == 0 {
-		return shim.Error(fmt.Sprintf("order(%s) does not exist", orderID))
-	}
-	var order Order
-	if err := json.Unmarshal(val, &order); err != nil {
-		return shim.Error(fmt.Sprintf("failed to unmarshal order %v", err))
-	}
-	if order.Status != 0 {
-		return shim.Error(fmt.Sprintf("order status wrong(%d)", order.Status))
+		return shim.Error(err.Error())
 	}
-	role, err := cid.GetMSPID(stub)
+	count, err := parseOrderCount(args[1:], order.Shipped-order.Delivered)
 	if err != nil {
-		return shim.Error("failed to get role")
+		return shim.Error(err.Error())
 	}
-	if role != order.Payer {
-		return shim.Error(fmt.Sprintf("only the payer can confirm order, payer is %s, you are %s", order.Payer, role))
+	if order.Delivered+count > order.Shipped {
+		return shim.Error(fmt.Sprintf("order(%s) shipped %d, delivered %d, can not confirm %d more", order.OrderID, order.Shipped, order.Delivered, count))
 	}
+	var allocs []BatchAllocation
 	if order.OrderType == 0 {
-		if err := transferMaterial(stub, order.Producer, order.Payer, order.Type, order.Count); err != nil {
+		if allocs, err = transferMaterial(stub, order.Producer, order.Payer, order.Store, order.Type, order.deliveryRequests(count), order.OrderID); err != nil {
 			return shim.Error(fmt.Sprintf("failed to transfer material %v", err))
 		}
 	} else {
-		if err := transferProduct(stub, order.Producer, order.Payer, order.Type, order.Count); err != nil {
+		if err := transferProduct(stub, order.Producer, order.Payer, order.Store, order.Type, count, order.OrderID); err != nil {
 			return shim.Error(fmt.Sprintf("failed to transfer product %v", err))
 		}
 	}
-	if err := addBalance(stub, order.Producer, order.Amount); err != nil {
+	order.Delivered += count
+	// 最后一批支付剩余全部货款，避免单价取整造成的误差
+	amount, err := order.Amount.DivUint64(order.Count).MulUint64(count)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if order.Delivered == order.Count {
+		if amount, err = order.Amount.Sub(order.Paid); err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		to = OrderShipped
+	}
+	if err := addOrderBalance(stub, order, order.Producer, amount); err != nil {
 		return shim.Error(fmt.Sprintf("failed to pay to %s, %v", order.Producer, err))
 	}
-	order.Status = 1
-	val, err = json.Marshal(order)
+	if order.Paid, err = order.Paid.Add(amount); err != nil {
+		return shim.Error(err.Error())
+	}
+	t, err := stub.GetTxTimestamp()
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to marshal order %v", err))
+		return shim.Error(err.Error())
 	}
-	if err = stub.PutState(okey, val); err != nil {
-		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	order.Deliveries = append(order.Deliveries, OrderDelivery{
+		TxID:      stub.GetTxID(),
+		Count:     count,
+		Amount:    amount,
+		Timestamp: time.Unix(t.GetSeconds(), 0),
+		Batches:   allocs,
+	})
+	val, err := putOrder(stub, order, to)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 	if err := stub.SetEvent("EvtConfirmOrder", val); err != nil {
 		return shim.Error(fmt.Sprintf("failed to set event %v", err))
 	}
-	return shim.Success(nil)
+	return shim.Success(val)
 }
 
 func (c *Contract) cancelOrder(stub shim.ChaincodeStubInterface, args []string) peer.Response {
@@ -118,65 +217,46 @@ func (c *Contract) cancelOrder(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error("invalid arguments")
 	}
 	orderID := args[0]
-	if orderID == "" {
-		return shim.Error("orderID is empty")
-	}
-	key := fmt.Sprintf("%s-%s", PrefixOrder, orderID)
-	val, err := stub.GetState(key)
+	order, role, to, err := loadOrderForAction(stub, orderID, OrderActionCancel)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get state %v", err))
-	}
-	if len(val) == 0 {
-		return shim.Error(fmt.Sprintf("order(%s) does not exist", orderID))
-	}
-	var order Order
-	if err = json.Unmarshal(val, &order); err != nil {
-		return shim.Error(fmt.Sprintf("failed to unmarshal order %v", err))
-	}
-	if order.Status != 0 {
-		return shim.Error(fmt.Sprintf("order status wrong(%d)", order.Status))
-	}
-	role, err := cid.GetMSPID(stub)
-	if err != nil {
-		return shim.Error("failed to get role")
+		return shim.Error(err.Error())
 	}
-	var compensate uint64
-	var remain uint64
-	if role == order.Payer {
+	var compensate Amount
+	var remain Amount
+	if role == order.Payer && order.Status == OrderAccepted {
+		// 供货商接单后下单者取消订单，按比例补偿供货商
 		cancelCompensate, err := getCancelCompensate(stub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("failed to get cancel compensate %v", err))
 		}
-		compensate = (order.Amount * cancelCompensate) / 100
-		remain = order.Amount - compensate
-		if err = addBalance(stub, order.Payer, remain); err != nil {
+		compensate = order.Amount.Percent(cancelCompensate)
+		if remain, err = order.Amount.Sub(compensate); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err = addOrderBalance(stub, order, order.payerAccount(), remain); err != nil {
 			return shim.Error(fmt.Sprintf("failed to add balance to payer %v", err))
 		}
-		if err = addBalance(stub, order.Producer, compensate); err != nil {
+		if err = addOrderBalance(stub, order, order.Producer, compensate); err != nil {
 			return shim.Error(fmt.Sprintf("failed to add balance to producer %v", err))
 		}
-	} else if role == order.Producer {
-		compensate = 0
+	} else {
+		// 供货商取消订单或者供货商接单前下单者取消订单，全部退回下单者
+		compensate = Amount{}
 		remain = order.Amount
-		if err = addBalance(stub, order.Payer, remain); err != nil {
+		if err = addOrderBalance(stub, order, order.payerAccount(), remain); err != nil {
 			return shim.Error(fmt.Sprintf("failed to add balance to payer %v", err))
 		}
-	} else {
-		return shim.Error(fmt.Sprintf("only the payer(%s) and producer(%s) can cancel order, you are %s", order.Payer, order.Producer, role))
 	}
-	order.Status = 1
-	val, err = json.Marshal(order)
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to marshal order %v", err))
+	if _, err = putOrder(stub, order, to); err != nil {
+		return shim.Error(err.Error())
 	}
-	if err = stub.PutState(key, val); err != nil {
-		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	// 私有订单的事件中不包含金额
+	evt := map[string]interface{}{"orderID": orderID}
+	if !order.Private {
+		evt["returnToPayer"] = remain
+		evt["payToProducer"] = compensate
 	}
-	evtData, err := json.Marshal(map[string]interface{}{
-		"orderID":       orderID,
-		"returnToPayer": remain,
-		"payToProducer": compensate,
-	})
+	evtData, err := json.Marshal(evt)
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to marshal event data %v", err))
 	}
@@ -194,25 +274,21 @@ func (c *Contract) getOrder(stub shim.ChaincodeStubInterface, args []string) pee
 	if orderID == "" {
 		return shim.Error("orderID is empty")
 	}
-	key := fmt.Sprintf("%s-%s", PrefixOrder, orderID)
-	val, err := stub.GetState(key)
+	order, err := getOrderView(stub, orderID)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get state %v", err))
+		return shim.Error(err.Error())
 	}
-	if len(val) == 0 {
-		return shim.Error("order does not exist")
+	val, err := json.Marshal(order)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal order %v", err))
 	}
 	return shim.Success(val)
 }
 
 func (c *Contract) setCancelCompensate(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	role, err := cid.GetMSPID(stub)
-	if err != nil {
+	if _, err := requireRole(stub, RolePayment); err != nil {
 		return shim.Error(err.Error())
 	}
-	if role != "payment" {
-		return shim.Error("only for payment")
-	}
 	if len(args) != 1 {
 		return shim.Error("invalid arguments")
 	}
@@ -228,51 +304,95 @@ func (c *Contract) setCancelCompensate(stub shim.ChaincodeStubInterface, args []
 	return shim.Success(nil)
 }
 
-func makeOrder(stub shim.ChaincodeStubInterface, producer string, orderType int, pType string, count, price uint64) peer.Response {
-	var remotePrice uint64
-	var err error
-	if orderType == 0 {
-		remotePrice, err = getMaterialPrice(stub, producer, pType)
-	} else {
-		remotePrice, err = getProductPrice(stub, producer, pType)
+// orderStore 下单参数中可选的门店
+func orderStore(args []string) string {
+	if len(args) > 5 {
+		return args[5]
 	}
+	return ""
+}
+
+func makeOrder(stub shim.ChaincodeStubInterface, producer string, orderType int, pType string, count uint64, price Amount, timeout uint64, private bool, store string) peer.Response {
+	payer, err := getCaller(stub)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get remote price, %v", err))
+		return shim.Error(err.Error())
+	}
+	if store != "" {
+		if err := requireStore(stub, store, producer); err != nil {
+			return shim.Error(err.Error())
+		}
 	}
-	if remotePrice > price {
-		return shim.Error(fmt.Sprintf("price missmatch, set %d, remote %d", price, remotePrice))
+	// 私有订单优先使用协商价格，公开订单不读取私有数据，双方不需要配置私有数据集合
+	var remotePrice Amount
+	var negotiated bool
+	if private {
+		if remotePrice, negotiated, err = getPrivatePrice(stub, orderType, producer, payer.Org, pType); err != nil {
+			return shim.Error(err.Error())
+		}
 	}
-	amount := remotePrice * count
-	payer, err := cid.GetMSPID(stub)
+	if !negotiated {
+		if orderType == 0 {
+			remotePrice, err = getMaterialPrice(stub, producer, pType)
+		} else {
+			remotePrice, err = getProductPrice(stub, producer, pType)
+		}
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get remote price, %v", err))
+		}
+	}
+	if remotePrice.Cmp(price) > 0 {
+		return shim.Error(fmt.Sprintf("price missmatch, set %s, remote %s", price, remotePrice))
+	}
+	amount, err := remotePrice.MulUint64(count)
 	if err != nil {
-		return shim.Error("failed to get role")
+		return shim.Error(err.Error())
 	}
-	orderID := stub.GetTxID()
-	if err := reduceBalance(stub, payer, amount); err != nil {
-		return shim.Error(fmt.Sprintf("failed to freeze balance %v", err))
+	if err := payer.checkSpend(amount); err != nil {
+		return shim.Error(err.Error())
 	}
+	orderID := stub.GetTxID()
 	t, err := stub.GetTxTimestamp()
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	order := Order{
+	order := &Order{
 		OrderID:   orderID,
-		Payer:     payer,
+		Payer:     payer.Org,
 		Producer:  producer,
 		Amount:    amount,
 		Count:     count,
 		Type:      pType,
 		OrderType: orderType,
 		CreatedAt: time.Unix(t.GetSeconds(), 0),
-		Status:    0,
+		Status:    OrderCreated,
+		Private:   private,
+		Escrow:    private,
+		Store:     store,
 	}
-	okey := fmt.Sprintf("%s-%s", PrefixOrder, orderID)
-	odata, err := json.Marshal(order)
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to marshal order %v", err))
+	if payer.Account != payer.Org {
+		order.PayerAccount = payer.Account
+	}
+	if private {
+		if order.Salt, err = getTransientSalt(stub); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	// 私有订单从下单者在双方私有数据集合中的托管余额冻结货款
+	if err := reduceOrderBalance(stub, order, payer.Account, amount); err != nil {
+		return shim.Error(fmt.Sprintf("failed to freeze balance %v", err))
 	}
-	if err := stub.PutState(okey, odata); err != nil {
-		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	if timeout == 0 {
+		if timeout, err = getOrderTimeout(stub, producer); err != nil {
+			return shim.Error(fmt.Sprintf("failed to get order timeout %v", err))
+		}
+	}
+	if timeout > 0 {
+		deadline := order.CreatedAt.Add(time.Duration(timeout) * time.Second)
+		order.Deadline = &deadline
+	}
+	odata, err := putOrder(stub, order, OrderCreated)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 	if err := stub.SetEvent("EvtMakeOrder", odata); err != nil {
 		return shim.Error(fmt.Sprintf("failed to set event %v", err))
@@ -280,6 +400,171 @@ func makeOrder(stub shim.ChaincodeStubInterface, producer string, orderType int,
 	return shim.Success(odata)
 }
 
+// listOrders 分页查询调用者的订单，参数 [side, status, orderType, pageSize, bookmark]
+// side为payer(我下的订单)或producer(我收到的订单)，status和orderType为空时不过滤，
+// 指定orderType时使用按类型的索引，在索引上过滤后再分页，
+// 该索引之前创建的订单在下一次状态变化时才写入索引
+func (c *Contract) listOrders(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 3 {
+		return shim.Error("invalid arguments")
+	}
+	var prefix, typePrefix string
+	switch args[0] {
+	case "payer":
+		prefix, typePrefix = PrefixOrderPayer, PrefixOrderPayerType
+	case "producer":
+		prefix, typePrefix = PrefixOrderProducer, PrefixOrderProducerType
+	default:
+		return shim.Error(fmt.Sprintf("invalid side, got %s", args[0]))
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	keys := []string{role}
+	if args[2] != "" {
+		orderType, err := strconv.Atoi(args[2])
+		if err != nil {
+			return shim.Error(fmt.Sprintf("invalid orderType, got %s", args[2]))
+		}
+		prefix = typePrefix
+		keys = append(keys, strconv.Itoa(orderType))
+	}
+	if args[1] != "" {
+		status, err := strconv.ParseUint(args[1], 10, 8)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("invalid status, got %s", args[1]))
+		}
+		keys = append(keys, strconv.FormatUint(status, 10))
+	}
+	pageSize, bookmark, err := parsePage(args[3:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(prefix, keys, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+	}
+	defer iter.Close()
+	orders := []*Order{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if (prefix == typePrefix && len(attr) != 4) || (prefix != typePrefix && len(attr) != 3) {
+			return shim.Error("internal key format wrong")
+		}
+		order, err := getOrderView(stub, attr[len(attr)-1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		orders = append(orders, order)
+	}
+	data, err := json.Marshal(Page{Records: orders, Count: len(orders), Bookmark: meta.GetBookmark()})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+// getOrder 读取订单的完整数据，私有订单从双方的私有数据集合中读取
+func getOrder(stub shim.ChaincodeStubInterface, orderID string) (*Order, error) {
+	order, err := getPublicOrder(stub, orderID)
+	if err != nil || !order.Private {
+		return order, err
+	}
+	return getPrivateOrder(stub, order)
+}
+
+// getPublicOrder 读取通道上的订单
+func getPublicOrder(stub shim.ChaincodeStubInterface, orderID string) (*Order, error) {
+	key := fmt.Sprintf("%s-%s", PrefixOrder, orderID)
+	val, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state %v", err)
+	}
+	if len(val) == 0 {
+		return nil, fmt.Errorf("order(%s) does not exist", orderID)
+	}
+	var order Order
+	if err := json.Unmarshal(val, &order); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal order %v", err)
+	}
+	return &order, nil
+}
+
+// putOrder 将订单状态改为status后保存，并维护下单者和供货商的订单索引，
+// 返回通道上保存的订单，私有订单只包含公开部分，可以用作事件数据
+func putOrder(stub shim.ChaincodeStubInterface, order *Order, status byte) ([]byte, error) {
+	key := fmt.Sprintf("%s-%s", PrefixOrder, order.OrderID)
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state %v", err)
+	}
+	orderType := strconv.Itoa(order.OrderType)
+	for _, prefix := range []string{PrefixOrderPayer, PrefixOrderProducer, PrefixOrderPayerType, PrefixOrderProducerType} {
+		party := order.Payer
+		if prefix == PrefixOrderProducer || prefix == PrefixOrderProducerType {
+			party = order.Producer
+		}
+		keys := []string{party}
+		if prefix == PrefixOrderPayerType || prefix == PrefixOrderProducerType {
+			keys = append(keys, orderType)
+		}
+		if len(existing) > 0 {
+			oldKey, err := stub.CreateCompositeKey(prefix, append(keys, strconv.Itoa(int(order.Status)), order.OrderID))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create key, %v", err)
+			}
+			if err := stub.DelState(oldKey); err != nil {
+				return nil, fmt.Errorf("failed to del state %v", err)
+			}
+		}
+		newKey, err := stub.CreateCompositeKey(prefix, append(keys, strconv.Itoa(int(status)), order.OrderID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create key, %v", err)
+		}
+		if err := stub.PutState(newKey, []byte{1}); err != nil {
+			return nil, fmt.Errorf("failed to put state %v", err)
+		}
+	}
+	if order.Deadline != nil {
+		deadlineKey := fmt.Sprintf("%s-%020d-%s", PrefixOrderDeadline, order.Deadline.Unix(), order.OrderID)
+		if isOrderOpen(status) {
+			err = stub.PutState(deadlineKey, []byte{1})
+		} else {
+			err = stub.DelState(deadlineKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update deadline index %v", err)
+		}
+	}
+	order.Status = status
+	order.DocType = DocTypeOrder
+	val, err := json.Marshal(order)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal order %v", err)
+	}
+	if order.Private {
+		// 完整数据写入双方的私有数据集合，通道上只保存公开部分
+		if err := stub.PutPrivateData(pairCollection(order.Payer, order.Producer), key, val); err != nil {
+			return nil, fmt.Errorf("failed to put private data %v", err)
+		}
+		if val, err = json.Marshal(publicOrder(order, val)); err != nil {
+			return nil, fmt.Errorf("failed to marshal order %v", err)
+		}
+	}
+	if err := stub.PutState(key, val); err != nil {
+		return nil, fmt.Errorf("failed to put state %v", err)
+	}
+	return val, nil
+}
+
 func getCancelCompensate(stub shim.ChaincodeStubInterface) (uint64, error) {
 	key := PrefixCancelCompensate
 	val, err := stub.GetState(key)
@@ -294,17 +579,13 @@ func getCancelCompensate(stub shim.ChaincodeStubInterface) (uint64, error) {
 
 //资金相关
 func (c *Contract) mint(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	role, err := cid.GetMSPID(stub)
-	if err != nil {
+	if _, err := requireRole(stub, RolePayment); err != nil {
 		return shim.Error(err.Error())
 	}
-	if role != "payment" {
-		return shim.Error("only for payment")
-	}
 	if len(args) != 2 {
 		return shim.Error("invalid arguments")
 	}
-	amount, err := strconv.ParseUint(args[1], 10, 64)
+	amount, err := ParseAmount(args[1])
 	if err != nil {
 		return shim.Error("invalid amount")
 	}
@@ -315,38 +596,32 @@ func (c *Contract) mint(stub shim.ChaincodeStubInterface, args []string) peer.Re
 }
 
 func (c *Contract) burn(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	role, err := cid.GetMSPID(stub)
-	if err != nil {
+	if _, err := requireRole(stub, RolePayment); err != nil {
 		return shim.Error(err.Error())
 	}
-	if role != "payment" {
-		return shim.Error("only for payment")
-	}
 	if len(args) != 2 {
 		return shim.Error("invalid arguments")
 	}
-	amount, err := strconv.ParseUint(args[1], 10, 64)
+	amount, err := ParseAmount(args[1])
 	if err != nil {
 		return shim.Error("invalid amount")
 	}
 	key := fmt.Sprintf("%s-%s", PrefixBalance, args[0])
-	currentState, err := stub.GetState(key)
+	currentAmount, err := getBalance(stub, args[0])
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+		return shim.Error(fmt.Sprintf("failed to get balance, %v", err))
 	}
-	currentAmount := bytesToUint64(currentState)
-	if currentAmount < amount {
-		amount = currentAmount
-
+	newAmount, err := currentAmount.Sub(currentAmount.Min(amount))
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	newAmount := currentAmount - amount
-	if newAmount == 0 {
+	if newAmount.IsZero() {
 		if err := stub.DelState(key); err != nil {
 			return shim.Error(fmt.Sprintf("failed to del state, %v", err))
 		}
 		return shim.Success(nil)
 	}
-	val := uint64ToBytes(newAmount)
+	val := amountToBytes(newAmount)
 	if err := stub.PutState(key, val); err != nil {
 		return shim.Error(fmt.Sprintf("failed to put state, %v", err))
 	}
@@ -357,12 +632,10 @@ func (c *Contract) balanceOf(stub shim.ChaincodeStubInterface, args []string) pe
 	if len(args) != 1 {
 		return shim.Error("invalid arguments")
 	}
-	key := fmt.Sprintf("%s-%s", PrefixBalance, args[0])
-	val, err := stub.GetState(key)
+	amount, err := getBalance(stub, args[0])
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+		return shim.Error(fmt.Sprintf("failed to get balance, %v", err))
 	}
-	amount := bytesToUint64(val)
 	m := map[string]interface{}{
 		args[0]: amount,
 	}
@@ -373,39 +646,48 @@ func (c *Contract) balanceOf(stub shim.ChaincodeStubInterface, args []string) pe
 	return shim.Success(resp)
 }
 
-func reduceBalance(stub shim.ChaincodeStubInterface, role string, amount uint64) error {
+// getBalance 读取余额，兼容早期版本的8字节格式
+func getBalance(stub shim.ChaincodeStubInterface, role string) (Amount, error) {
 	key := fmt.Sprintf("%s-%s", PrefixBalance, role)
 	currentState, err := stub.GetState(key)
+	if err != nil {
+		return Amount{}, err
+	}
+	return bytesToAmount(currentState)
+}
+
+func reduceBalance(stub shim.ChaincodeStubInterface, role string, amount Amount) error {
+	currentAmount, err := getBalance(stub, role)
 	if err != nil {
 		return err
 	}
-	currentAmount := bytesToUint64(currentState)
-	if amount > currentAmount {
-		return fmt.Errorf("insufficient balance")
+	newAmount, err := currentAmount.Sub(amount)
+	if err != nil {
+		return err
 	}
-	newAmount := currentAmount - amount
-	val := uint64ToBytes(newAmount)
-	if err := stub.PutState(key, val); err != nil {
+	key := fmt.Sprintf("%s-%s", PrefixBalance, role)
+	if err := stub.PutState(key, amountToBytes(newAmount)); err != nil {
 		return err
 	}
 	return nil
 }
 
-func addBalance(stub shim.ChaincodeStubInterface, role string, amount uint64) error {
-	key := fmt.Sprintf("%s-%s", PrefixBalance, role)
-	currentState, err := stub.GetState(key)
+func addBalance(stub shim.ChaincodeStubInterface, role string, amount Amount) error {
+	currentAmount, err := getBalance(stub, role)
 	if err != nil {
 		return err
 	}
-	currentAmount := bytesToUint64(currentState)
-	newAmount := currentAmount + amount
-	val := uint64ToBytes(newAmount)
-	if err := stub.PutState(key, val); err != nil {
+	newAmount, err := currentAmount.Add(amount)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s-%s", PrefixBalance, role)
+	if err := stub.PutState(key, amountToBytes(newAmount)); err != nil {
 		return err
 	}
 	return nil
 }
-func transfer(stub shim.ChaincodeStubInterface, from, to string, amount uint64) error {
+func transfer(stub shim.ChaincodeStubInterface, from, to string, amount Amount) error {
 	if err := reduceBalance(stub, from, amount); err != nil {
 		return err
 	}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMakeOrder(t *testing.T) {
+	s := setupOrder(t)
+	s.mustFail(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "99")
+	s.mustFail(orgTV, "makeMaterialOrder", orgLCD, "CPU", "100", "100")
+	s.mustFail(orgTV, "makeMaterialOrder", orgLCD, "LCD", "1001", "100")
+
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "150")
+	if order.Amount.String() != "1000" || order.Payer != orgTV || order.Producer != orgLCD || order.OrderType != 0 {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	var got Order
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "getOrder", order.OrderID), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.OrderID != order.OrderID || got.Status != OrderCreated {
+		t.Fatalf("unexpected order %+v", got)
+	}
+	s.mustFail(orgLCD, "getOrder", "unknown")
+	s.expectBalance(orgTV, 99000)
+}
+
+func TestConfirmOrder(t *testing.T) {
+	s := setupOrder(t)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	s.shipOrder(orgLCD, order.OrderID)
+	s.mustFail(orgLCD, "confirmOrder", order.OrderID)
+	s.mustFail(orgTV, "confirmOrder", "unknown")
+
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	var confirmed Order
+	s.expectEvent("EvtConfirmOrder", &confirmed)
+	if confirmed.Status != OrderDelivered {
+		t.Fatalf("unexpected order %+v", confirmed)
+	}
+	s.mustFail(orgTV, "confirmOrder", order.OrderID)
+	s.expectBalance(orgLCD, 10000)
+}
+
+func TestCancelOrderByProducer(t *testing.T) {
+	s := setupOrder(t)
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "100", "100")
+	s.mustFail(orgStore, "cancelOrder", order.OrderID)
+	s.mustInvoke(orgLCD, "acceptOrder", order.OrderID)
+
+	s.mustInvoke(orgLCD, "cancelOrder", order.OrderID)
+	s.expectBalance(orgTV, 100000)
+	s.expectBalance(orgLCD, 0)
+	s.mustFail(orgTV, "cancelOrder", order.OrderID)
+}
+
+func TestSetCancelCompensate(t *testing.T) {
+	s := newTestStub(t)
+	s.mustFail(orgTV, "setCancelCompensate", "10")
+	s.mustFail(orgPayment, "setCancelCompensate", "101")
+	s.mustInvoke(orgPayment, "setCancelCompensate", "10")
+}
+
+func TestMintAndBurn(t *testing.T) {
+	s := newTestStub(t)
+	s.mustFail(orgTV, "mint", orgTV, "100")
+	s.mustFail(orgPayment, "mint", orgTV, "abc")
+	s.mustInvoke(orgPayment, "mint", orgTV, "100")
+	s.expectBalance(orgTV, 100)
+
+	s.mustFail(orgTV, "burn", orgTV, "10")
+	s.mustInvoke(orgPayment, "burn", orgTV, "30")
+	s.expectBalance(orgTV, 70)
+	s.mustInvoke(orgPayment, "burn", orgTV, "1000")
+	s.expectBalance(orgTV, 0)
+}
+
+func TestListOrders(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgAudio, "setMaterialPrice", "Audio", "50")
+	lcdOrder := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100")
+	audioOrder := s.makeOrder(orgTV, "makeMaterialOrder", orgAudio, "Audio", "10", "50")
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1")
+	tvOrder := s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "1", "3000")
+	s.shipOrder(orgLCD, lcdOrder.OrderID)
+	s.mustInvoke(orgTV, "confirmOrder", lcdOrder.OrderID)
+
+	list := func(role string, args ...string) []Order {
+		var page struct {
+			Records  []Order `json:"records"`
+			Bookmark string  `json:"bookmark"`
+		}
+		if err := json.Unmarshal(s.mustInvoke(role, "listOrders", args...), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page.Records
+	}
+	if orders := list(orgTV, "payer", "", ""); len(orders) != 2 {
+		t.Fatalf("unexpected orders %+v", orders)
+	}
+	if orders := list(orgTV, "payer", "0", ""); len(orders) != 1 || orders[0].OrderID != audioOrder.OrderID {
+		t.Fatalf("unexpected orders %+v", orders)
+	}
+	if orders := list(orgTV, "producer", "0", ""); len(orders) != 1 || orders[0].OrderID != tvOrder.OrderID {
+		t.Fatalf("unexpected orders %+v", orders)
+	}
+	if orders := list(orgTV, "producer", "", "0"); len(orders) != 0 {
+		t.Fatalf("unexpected orders %+v", orders)
+	}
+	if orders := list(orgLCD, "producer", "1", "0"); len(orders) != 1 || orders[0].OrderID != lcdOrder.OrderID {
+		t.Fatalf("unexpected orders %+v", orders)
+	}
+	if orders := list(orgLCD, "producer", "0", ""); len(orders) != 0 {
+		t.Fatalf("unexpected orders %+v", orders)
+	}
+	// 按类型过滤在分页之前，每页都是满的
+	s.makeOrder(orgStore, "makeMaterialOrder", orgLCD, "LCD", "1", "100")
+	s.makeOrder(orgStore, "makeMaterialOrder", orgLCD, "LCD", "2", "100")
+	if orders := list(orgStore, "payer", "", "1", "1"); len(orders) != 1 || orders[0].OrderID != tvOrder.OrderID {
+		t.Fatalf("unexpected orders %+v", orders)
+	}
+	if orders := list(orgStore, "payer", "0", "0", "2"); len(orders) != 2 || orders[0].OrderType != 0 || orders[1].OrderType != 0 {
+		t.Fatalf("unexpected orders %+v", orders)
+	}
+	s.mustFail(orgTV, "listOrders", "store", "", "")
+}
+
+func TestConfirmOrderEvents(t *testing.T) {
+	s := setupOrder(t)
+	for _, id := range []string{"TV_1", "TV_2"} {
+		s.mustInvoke(orgTV, "registerProduct", "TV", id, "2020-05-20", "LCD_1")
+	}
+	order := s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "2", "3000")
+	s.shipOrder(orgTV, order.OrderID)
+	// 每个产品的所有权变更和确认收货都在同一个信封中
+	s.mustInvoke(orgStore, "confirmOrder", order.OrderID)
+	s.expectEvents("EvtProductOwnerChanged", "EvtProductOwnerChanged", "EvtConfirmOrder")
+	env := s.envelope()
+	if env.Version != 1 || env.TxID == "" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+
+	order = s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100")
+	s.shipOrder(orgLCD, order.OrderID)
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	s.expectEvents("EvtMaterialTransferred", "EvtConfirmOrder")
+}
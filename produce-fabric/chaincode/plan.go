@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// ProductionPlan 按未完成的产品订单计算的生产计划
+type ProductionPlan struct {
+	Demand        map[string]uint64 `json:"demand"`           //未完成的产品订单中还未收货的数量，按产品类型
+	ProductStock  map[string]uint64 `json:"productStock"`     //当前产品库存，包括子部件和寄存在门店的产品
+	ToProduce     map[string]uint64 `json:"toProduce"`        //扣除库存后需要生产的数量，包括子部件
+	Required      map[string]uint64 `json:"required"`         //按物料清单需要的物料数量
+	MaterialStock map[string]uint64 `json:"materialStock"`    //当前物料库存，包括寄存在门店的物料
+	Shortfall     map[string]uint64 `json:"shortfall"`        //物料缺口，按物料类型
+	NoBOM         []string          `json:"noBOM,omitempty"`  //没有物料清单、无法计算物料的产品类型
+	Drafts        []OrderDraft      `json:"drafts,omitempty"` //按最低报价补足缺口的物料订单草稿
+}
+
+// OrderDraft 物料订单草稿，可以直接作为makeMaterialOrder的参数
+type OrderDraft struct {
+	Producer     string `json:"producer"`
+	MaterialType string `json:"materialType"`
+	Count        uint64 `json:"count"`
+	Price        Amount `json:"price"`
+	Amount       Amount `json:"amount"`
+}
+
+// planProduction 产品生产者查询生产计划，参数 [draft]，draft为true时附带物料订单草稿。
+// 汇总调用者作为供货商的未完成产品订单，扣除产品库存后按物料清单(包括子部件)展开，与物料库存比较得到缺口。
+// 草稿使用供货商公开的物料价格，不考虑私有的协商价格
+func (c *Contract) planProduction(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) > 1 {
+		return shim.Error("invalid arguments")
+	}
+	draft := false
+	if len(args) == 1 && args[0] != "" {
+		var err error
+		if draft, err = strconv.ParseBool(args[0]); err != nil {
+			return shim.Error(fmt.Sprintf("invalid draft, got %s", args[0]))
+		}
+	}
+	role, err := requireRole(stub, RoleProductProducer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	plan := &ProductionPlan{
+		ToProduce: make(map[string]uint64),
+		Required:  make(map[string]uint64),
+		Shortfall: make(map[string]uint64),
+	}
+	if plan.Demand, err = openProductDemand(stub, role); err != nil {
+		return shim.Error(err.Error())
+	}
+	if plan.ProductStock, err = getMyProducts(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	if plan.MaterialStock, err = getMyMaterials(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addCustodyStock(stub, PrefixProductCustody, role, plan.ProductStock); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addCustodyStock(stub, PrefixMaterialCustody, role, plan.MaterialStock); err != nil {
+		return shim.Error(err.Error())
+	}
+	avail := make(map[string]uint64, len(plan.ProductStock))
+	for pType, n := range plan.ProductStock {
+		avail[pType] = n
+	}
+	for _, pType := range sortedKeys(plan.Demand) {
+		if err := plan.explode(stub, role, pType, plan.Demand[pType], avail, 0); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	for materialType, n := range plan.Required {
+		if n > plan.MaterialStock[materialType] {
+			plan.Shortfall[materialType] = n - plan.MaterialStock[materialType]
+		}
+	}
+	if draft {
+		for _, materialType := range sortedKeys(plan.Shortfall) {
+			d, err := draftMaterialOrder(stub, role, materialType, plan.Shortfall[materialType])
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if d != nil {
+				plan.Drafts = append(plan.Drafts, *d)
+			}
+		}
+	}
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+// openProductDemand 汇总producer未完成的产品订单中还未收货的数量
+func openProductDemand(stub shim.ChaincodeStubInterface, producer string) (map[string]uint64, error) {
+	demand := make(map[string]uint64)
+	// 与isOrderOpen一致，已发货未确认的产品仍在供货商的库存中
+	for _, status := range []byte{OrderCreated, OrderAccepted, OrderShipped} {
+		iter, err := stub.GetStateByPartialCompositeKey(PrefixOrderProducer, []string{producer, strconv.Itoa(int(status))})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get state, %v", err)
+		}
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return nil, fmt.Errorf("failed to get iter next %v", err)
+			}
+			_, attr, err := stub.SplitCompositeKey(kv.Key)
+			if err != nil || len(attr) != 3 {
+				iter.Close()
+				return nil, fmt.Errorf("internal key format wrong")
+			}
+			// 私有订单的公开部分也有数量
+			order, err := getPublicOrder(stub, attr[2])
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			if order.OrderType == 1 {
+				if err := addQuantity(demand, order.Type, order.Count-order.Delivered, 1); err != nil {
+					iter.Close()
+					return nil, err
+				}
+			}
+		}
+		iter.Close()
+	}
+	return demand, nil
+}
+
+// addCustodyStock 把owner寄存在各门店的产品或物料按类型累加到stock，prefix为PrefixProductCustody或PrefixMaterialCustody
+func addCustodyStock(stub shim.ChaincodeStubInterface, prefix, owner string, stock map[string]uint64) error {
+	// 寄存的key以门店开头，所有者是第2个属性，只能遍历后过滤
+	iter, err := stub.GetStateByPartialCompositeKey(prefix, []string{})
+	if err != nil {
+		return fmt.Errorf("failed to get state, %v", err)
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return fmt.Errorf("failed to get iter next %v", err)
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attr) != 4 {
+			return fmt.Errorf("internal key format wrong")
+		}
+		if attr[1] != owner {
+			continue
+		}
+		n := uint64(1)
+		if prefix == PrefixMaterialCustody {
+			n = bytesToUint64(kv.Value)
+		}
+		if err := addQuantity(stock, attr[2], n, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// explode 扣除可用库存后，把count个pType按物料清单展开，子部件递归展开
+func (plan *ProductionPlan) explode(stub shim.ChaincodeStubInterface, producer, pType string, count uint64, avail map[string]uint64, depth int) error {
+	if depth > maxTraceDepth {
+		return fmt.Errorf("product nesting exceeds %d levels", maxTraceDepth)
+	}
+	use := avail[pType]
+	if use > count {
+		use = count
+	}
+	avail[pType] -= use
+	count -= use
+	if count == 0 {
+		return nil
+	}
+	if err := addQuantity(plan.ToProduce, pType, count, 1); err != nil {
+		return err
+	}
+	bom, err := getBOM(stub, producer, pType)
+	if err != nil {
+		return err
+	}
+	if bom == nil {
+		plan.NoBOM = appendUnique(plan.NoBOM, pType)
+		return nil
+	}
+	for materialType, qty := range bom.Materials {
+		if err := addQuantity(plan.Required, materialType, qty, count); err != nil {
+			return err
+		}
+	}
+	for _, sub := range sortedKeys(bom.Products) {
+		qty := bom.Products[sub]
+		if qty > math.MaxUint64/count {
+			return fmt.Errorf("quantity of %s overflows", sub)
+		}
+		if err := plan.explode(stub, producer, sub, qty*count, avail, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addQuantity 把qty*n累加到m[key]，溢出时返回错误
+func addQuantity(m map[string]uint64, key string, qty, n uint64) error {
+	if n != 0 && qty > math.MaxUint64/n || m[key] > math.MaxUint64-qty*n {
+		return fmt.Errorf("quantity of %s overflows", key)
+	}
+	m[key] += qty * n
+	return nil
+}
+
+// draftMaterialOrder 在所有物料生产者的公开报价中选择最低价，没有报价时返回nil
+func draftMaterialOrder(stub shim.ChaincodeStubInterface, buyer, materialType string, count uint64) (*OrderDraft, error) {
+	// 通过报价索引找到这种物料的所有生产者
+	iter, err := stub.GetStateByPartialCompositeKey(PrefixMaterialPriceIndex, []string{materialType})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state, %v", err)
+	}
+	defer iter.Close()
+	var best *OrderDraft
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get iter next %v", err)
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attr) != 2 {
+			return nil, fmt.Errorf("internal key format wrong")
+		}
+		producer := attr[1]
+		if producer == buyer {
+			continue
+		}
+		ok, err := hasRole(stub, producer, RoleMaterialProducer)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		price, err := getMaterialPrice(stub, producer, materialType)
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || price.Cmp(best.Price) < 0 {
+			best = &OrderDraft{Producer: producer, MaterialType: materialType, Count: count, Price: price}
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	if best.Amount, err = best.Price.MulUint64(count); err != nil {
+		return nil, err
+	}
+	return best, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPlanProduction(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgAudio, "setMaterialPrice", "LCD", "90")
+	s.mustInvoke(orgLCD, "setMaterialPrice", "Driver", "10")
+	s.mustInvoke(orgLCD, "registerMaterial", "Driver", "100", "DRV_1")
+	// 物料类型中含有'-'时不能与其他类型混淆
+	s.mustInvoke(orgLCD, "setMaterialPrice", "Big-Shell", "1")
+	// MSP ID中含有'-'的供货商也能参与比价
+	s.mustInvoke("material.big-lcd", "setMaterialPrice", "LCD", "85")
+	for _, m := range []struct{ materialType, count string }{{"LCD", "4"}, {"Driver", "2"}} {
+		order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, m.materialType, m.count, "100")
+		s.shipOrder(orgLCD, order.OrderID)
+		s.mustInvoke(orgTV, "confirmOrder", order.OrderID)
+	}
+	s.mustInvoke(orgTV, "setBOM", "Panel", `{"LCD": 1, "Driver": 1}`)
+	s.mustInvoke(orgTV, "produce", "Panel", "P_1", "2020-05-20")
+	// 寄存在门店的面板和物料仍然计入库存
+	s.mustInvoke(orgTV, "checkIn", CustodyProduct, orgStore, "P_1")
+	s.mustInvoke(orgTV, "checkIn", CustodyMaterial, orgStore, "LCD_1", "1")
+
+	s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "3", "3000")
+	rejected := s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "1", "3000")
+	s.mustInvoke(orgTV, "rejectOrder", rejected.OrderID)
+	s.mustFail(orgLCD, "planProduction")
+	s.mustFail(orgTV, "planProduction", "yes")
+
+	plan := func(draft string) *ProductionPlan {
+		var p ProductionPlan
+		if err := json.Unmarshal(s.mustInvoke(orgTV, "planProduction", draft), &p); err != nil {
+			t.Fatal(err)
+		}
+		return &p
+	}
+	// 没有物料清单时无法展开
+	p := plan("")
+	if p.Demand["TV"] != 3 || p.ToProduce["TV"] != 3 || fmt.Sprint(p.NoBOM) != "[TV]" || len(p.Required) != 0 {
+		t.Fatalf("unexpected plan %+v", p)
+	}
+
+	// 电视需要一个外壳和两块面板，库存中的一块面板先用掉
+	s.mustInvoke(orgTV, "setBOM", "TV", `{"Shell": 1}`, `{"Panel": 2}`)
+	p = plan("true")
+	if p.ToProduce["TV"] != 3 || p.ToProduce["Panel"] != 5 || p.ProductStock["Panel"] != 1 || len(p.NoBOM) != 0 {
+		t.Fatalf("unexpected plan %+v", p)
+	}
+	if fmt.Sprint(p.Required) != "map[Driver:5 LCD:5 Shell:3]" || fmt.Sprint(p.Shortfall) != "map[Driver:4 LCD:2 Shell:3]" {
+		t.Fatalf("unexpected required %v, shortfall %v", p.Required, p.Shortfall)
+	}
+	// 外壳没有报价，LCD选择报价最低的供货商
+	if len(p.Drafts) != 2 {
+		t.Fatalf("unexpected drafts %+v", p.Drafts)
+	}
+	if d := p.Drafts[0]; d.MaterialType != "Driver" || d.Producer != orgLCD || d.Count != 4 || d.Amount.Cmp(NewAmount(40)) != 0 {
+		t.Fatalf("unexpected draft %+v", d)
+	}
+	if d := p.Drafts[1]; d.MaterialType != "LCD" || d.Producer != "material.big-lcd" || d.Count != 2 || d.Amount.Cmp(NewAmount(170)) != 0 {
+		t.Fatalf("unexpected draft %+v", d)
+	}
+	// 草稿可以直接下单
+	d := p.Drafts[1]
+	s.makeOrder(orgTV, "makeMaterialOrder", d.Producer, d.MaterialType, fmt.Sprint(d.Count), d.Price.String())
+
+	// 数量溢出时返回错误
+	for _, bom := range [][]string{{`{"Shell": 1}`, `{"Panel": 9223372036854775807}`}, {`{"Shell": 9223372036854775807}`}} {
+		s.mustInvoke(orgTV, "setBOM", append([]string{"TV"}, bom...)...)
+		if msg := s.mustFail(orgTV, "planProduction"); !strings.Contains(msg, "overflows") {
+			t.Fatalf("unexpected error %s", msg)
+		}
+	}
+	if err := addQuantity(map[string]uint64{"TV": math.MaxUint64}, "TV", 1, 1); err == nil {
+		t.Fatal("expected overflow")
+	}
+}
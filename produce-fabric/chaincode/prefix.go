@@ -1,26 +1,72 @@
 package main
 
 const (
-	// PrefixMaterialPreserve 物料库存 (组合: prefix + role + materialType + batchID) => uint64个数
+	// PrefixMaterialPreserve 物料库存，不包括寄存在门店的部分 (组合: prefix + role + materialType + batchID) => uint64个数
 	PrefixMaterialPreserve = "\x01"
-	// PrefixBalance 余额 ('%s-%s', prefix, role) => uint64余额
+	// PrefixBalance 余额 ('%s-%s', prefix, role) => Amount余额
 	PrefixBalance = "\x02"
 	// PrefixMaterialBatchInfo 物料批次信息 ('%s-%s', prefix, batchID) => Material
 	PrefixMaterialBatchInfo = "\x03"
-	// PrefixMaterialPrice 物料价格 ('%s-%s-%s', prefix, role, materialType) => uint64价格
+	// PrefixMaterialPrice 物料价格 ('%s-%s-%s', prefix, role, materialType) => Amount价格
 	PrefixMaterialPrice = "\x04"
-	// PrefixProductPrice 产品价格 ('%s-%s-%s', prefix, role, productType) => uint64价格
+	// PrefixProductPrice 产品价格 ('%s-%s-%s', prefix, role, productType) => Amount价格
 	PrefixProductPrice = "\x05"
 	// PrefixProduct 产品列表 ('%s-%s', prefix, productID) => Product
 	PrefixProduct = "\x06"
 	// PrefixMaterialProduct 物料批号到产品ID的映射，用于溯源 (组合 prefix + batchID + productID) => 1
 	PrefixMaterialProduct = "\x07"
-	// PrefixProductPreserve 产品库存 (组合 prefix + role + productType + productID) => 1
+	// PrefixProductPreserve 产品库存，不包括寄存在门店的部分 (组合 prefix + role + productType + productID) => 1
 	PrefixProductPreserve = "\x08"
 	// PrefixOrder 订单 ('%s-%s', prefix, orderID) => Order
 	PrefixOrder = "\x09"
 	// PrefixCancelCompensate //下单者取消订单时，补偿给供货商的比例，百分比，直接为key
 	PrefixCancelCompensate = "\x10"
-	// PrefixOwner 拥有者, 直接为key
+	// PrefixOwner 拥有者(管理员)的组织，Init时设置，直接为key
 	PrefixOwner = "\x11"
+	// PrefixOrderPayer 下单者的订单索引 (组合: prefix + payer + status + orderID) => 1
+	PrefixOrderPayer = "\x12"
+	// PrefixOrderProducer 供货商的订单索引 (组合: prefix + producer + status + orderID) => 1
+	PrefixOrderProducer = "\x13"
+	// PrefixOrderDeadline 未结束订单的截止时间索引，用于范围查询 ('%s-%020d-%s', prefix, deadline, orderID) => 1
+	PrefixOrderDeadline = "\x14"
+	// PrefixOrderTimeout 供货商默认的订单超时时间 ('%s-%s', prefix, role) => uint64秒数
+	PrefixOrderTimeout = "\x15"
+	// PrefixExpireCompensate 订单超时时，供货商赔付给下单者的比例，百分比，直接为key
+	PrefixExpireCompensate = "\x16"
+	// PrefixDispute 订单争议 ('%s-%s', prefix, orderID) => Dispute
+	PrefixDispute = "\x17"
+	// PrefixArbiter 仲裁方的组织，为空时为payment，直接为key
+	PrefixArbiter = "\x18"
+	// PrefixDecimals 货币的小数位数，Init时设置，直接为key
+	PrefixDecimals = "\x19"
+	// PrefixRole 组织的角色 ('%s-%s', prefix, org) => JSON角色列表
+	PrefixRole = "\x1a"
+	// PrefixAccountMode 记账方式(org按组织，identity按身份)，Init时设置，直接为key
+	PrefixAccountMode = "\x1b"
+	// PrefixRecall 物料批次的召回记录 ('%s-%s', prefix, batchID) => Recall
+	PrefixRecall = "\x1c"
+	// PrefixMaterialWriteOff 物料核销记录 (组合: prefix + batchID + txID) => WriteOff
+	PrefixMaterialWriteOff = "\x1d"
+	// PrefixProductScan 产品防伪码的验证次数 ('%s-%s', prefix, productID) => ScanStats
+	PrefixProductScan = "\x1e"
+	// PrefixAllocPolicy 组织的物料出库策略 ('%s-%s', prefix, role) => fifo或fefo
+	PrefixAllocPolicy = "\x1f"
+	// PrefixBOM 产品的物料清单 ('%s-%s-%s', prefix, role, productType) => BOM
+	PrefixBOM = "\x20"
+	// PrefixProductCustody 寄存在门店的产品 (组合: prefix + store + owner + productType + productID) => 1
+	PrefixProductCustody = "\x21"
+	// PrefixMaterialCustody 寄存在门店的物料 (组合: prefix + store + owner + materialType + batchID) => uint64个数
+	PrefixMaterialCustody = "\x22"
+	// PrefixWithdrawal 提现申请 ('%s-%s', prefix, withdrawalID) => Withdrawal
+	PrefixWithdrawal = "\x23"
+	// PrefixWithdrawalStatus 提现申请的状态索引 (组合: prefix + status + withdrawalID) => 1
+	PrefixWithdrawalStatus = "\x24"
+	// PrefixOrderPayerType 下单者按订单类型的索引 (组合: prefix + payer + orderType + status + orderID) => 1
+	PrefixOrderPayerType = "\x25"
+	// PrefixOrderProducerType 供货商按订单类型的索引 (组合: prefix + producer + orderType + status + orderID) => 1
+	PrefixOrderProducerType = "\x26"
+	// PrefixEscrowBalance 私有订单的托管余额，保存在订单双方的私有数据集合中 ('%s-%s', prefix, account) => Amount余额
+	PrefixEscrowBalance = "\x27"
+	// PrefixMaterialPriceIndex 物料类型的报价索引 (组合: prefix + materialType + producer) => 1
+	PrefixMaterialPriceIndex = "\x28"
 )
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// ErrPrivateOrder 私有订单的完整数据不在当前peer上，需要由订单双方的peer背书
+var ErrPrivateOrder = errors.New("ErrPrivateOrder: order is private, not available on this peer")
+
+// transientPrice 私有价格通过交易的transient字段传入，不会写入区块
+const transientPrice = "price"
+
+// transientSalt 私有订单的随机盐通过transient字段传入，只保存在私有数据中，
+// 订单的其他字段都是公开的，没有盐时可以穷举金额算出financialsHash
+const transientSalt = "salt"
+
+// minSaltLength 随机盐的最小字节数
+const minSaltLength = 16
+
+// pairCollection 下单者和供货商两个组织共享的私有数据集合，
+// 与 collections_config.json 中的名字一致: pair-<组织A>-<组织B>，组织按字典序，'.'替换为'_'
+func pairCollection(a, b string) string {
+	orgs := []string{a, b}
+	sort.Strings(orgs)
+	r := strings.NewReplacer(".", "_")
+	return fmt.Sprintf("pair-%s-%s", r.Replace(orgs[0]), r.Replace(orgs[1]))
+}
+
+// getTransientAmount 读取transient字段中的金额
+func getTransientAmount(stub shim.ChaincodeStubInterface, name string) (Amount, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return Amount{}, fmt.Errorf("failed to get transient %v", err)
+	}
+	val, ok := transient[name]
+	if !ok {
+		return Amount{}, fmt.Errorf("%s is required in transient", name)
+	}
+	return ParseAmount(string(val))
+}
+
+// parseOrderPrice 解析下单参数中的价格，为空时从transient读取，订单的金额保存在私有数据中
+func parseOrderPrice(stub shim.ChaincodeStubInterface, arg string) (Amount, bool, error) {
+	if arg != "" {
+		price, err := ParseAmount(arg)
+		if err != nil {
+			return Amount{}, false, fmt.Errorf("invalid price, got %s", arg)
+		}
+		return price, false, nil
+	}
+	price, err := getTransientAmount(stub, transientPrice)
+	if err != nil {
+		return Amount{}, false, err
+	}
+	return price, true, nil
+}
+
+// parsePriceKind 私有价格的种类，material或product，对应供货商的角色和订单类型
+func parsePriceKind(kind string) (string, int, error) {
+	switch kind {
+	case RoleMaterialProducer:
+		return PrefixMaterialPrice, 0, nil
+	case RoleProductProducer:
+		return PrefixProductPrice, 1, nil
+	}
+	return "", 0, fmt.Errorf("invalid price kind, got %s", kind)
+}
+
+func privatePriceKey(prefix, producer, buyer, pType string) string {
+	return fmt.Sprintf("%s-%s-%s-%s", prefix, producer, buyer, pType)
+}
+
+// setPrivatePrice 供货商为某个下单者设置协商价格，参数 [kind, type, buyer]，价格在transient的price中。
+// 价格只保存在双方的私有数据集合中，通道上只有哈希
+func (c *Contract) setPrivatePrice(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 || args[1] == "" || args[2] == "" {
+		return shim.Error("invalid arguments")
+	}
+	prefix, _, err := parsePriceKind(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	producer, err := requireRole(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	buyer := args[2]
+	if buyer == producer {
+		return shim.Error("buyer is the producer")
+	}
+	price, err := getTransientAmount(stub, transientPrice)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key := privatePriceKey(prefix, producer, buyer, args[1])
+	if err := stub.PutPrivateData(pairCollection(producer, buyer), key, amountToBytes(price)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put private data %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// getPrivatePrice 查询协商价格，参数 [kind, producer, buyer, type]，只有双方可以查询
+func (c *Contract) getPrivatePrice(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 4 {
+		return shim.Error("invalid arguments")
+	}
+	_, orderType, err := parsePriceKind(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	producer, buyer := args[1], args[2]
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	if role != producer && role != buyer {
+		return shim.Error(fmt.Sprintf("permission denied for %s", role))
+	}
+	price, ok, err := getPrivatePrice(stub, orderType, producer, buyer, args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !ok {
+		return shim.Error(fmt.Sprintf("private price for %s(%s) not found", args[0], args[3]))
+	}
+	return shim.Success([]byte(price.String()))
+}
+
+// getPrivatePrice 读取协商价格，bool表示是否存在
+func getPrivatePrice(stub shim.ChaincodeStubInterface, orderType int, producer, buyer, pType string) (Amount, bool, error) {
+	prefix := PrefixMaterialPrice
+	if orderType != 0 {
+		prefix = PrefixProductPrice
+	}
+	val, err := stub.GetPrivateData(pairCollection(producer, buyer), privatePriceKey(prefix, producer, buyer, pType))
+	if err != nil {
+		return Amount{}, false, fmt.Errorf("failed to get private data %v", err)
+	}
+	if len(val) == 0 {
+		return Amount{}, false, nil
+	}
+	price, err := bytesToAmount(val)
+	return price, err == nil, err
+}
+
+// getTransientSalt 读取transient中私有订单的随机盐
+func getTransientSalt(stub shim.ChaincodeStubInterface) (string, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get transient %v", err)
+	}
+	salt := transient[transientSalt]
+	if len(salt) < minSaltLength {
+		return "", fmt.Errorf("%s in transient must be at least %d bytes", transientSalt, minSaltLength)
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// publicOrder 私有订单在通道上公开的部分，金额和盐清零，附带私有数据的哈希
+func publicOrder(order *Order, private []byte) *Order {
+	o := *order
+	o.Amount = Amount{}
+	o.Paid = Amount{}
+	o.Salt = ""
+	o.Deliveries = make([]OrderDelivery, len(order.Deliveries))
+	for i, d := range order.Deliveries {
+		d.Amount = Amount{}
+		o.Deliveries[i] = d
+	}
+	sum := sha256.Sum256(private)
+	o.FinancialsHash = hex.EncodeToString(sum[:])
+	return &o
+}
+
+// getPrivateOrder 读取私有订单的完整数据，当前peer不在集合中时返回错误
+func getPrivateOrder(stub shim.ChaincodeStubInterface, order *Order) (*Order, error) {
+	key := fmt.Sprintf("%s-%s", PrefixOrder, order.OrderID)
+	val, err := stub.GetPrivateData(pairCollection(order.Payer, order.Producer), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get private data %v", err)
+	}
+	if len(val) == 0 {
+		return nil, fmt.Errorf("%w: order(%s)", ErrPrivateOrder, order.OrderID)
+	}
+	var full Order
+	if err := json.Unmarshal(val, &full); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal order %v", err)
+	}
+	return &full, nil
+}
+
+// getOrderView 查询订单，订单双方和结算方可以看到私有订单的金额，其他人只能看到公开部分
+func getOrderView(stub shim.ChaincodeStubInterface, orderID string) (*Order, error) {
+	order, err := getPublicOrder(stub, orderID)
+	if err != nil || !order.Private {
+		return order, err
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role %v", err)
+	}
+	if role != order.Payer && role != order.Producer && !isAuditor(stub, role) {
+		return order, nil
+	}
+	full, err := getPrivateOrder(stub, order)
+	if err != nil {
+		return order, nil
+	}
+	return full, nil
+}
+
+// escrowCollection 订单货款所在的私有数据集合。私有订单的货款托管在双方的集合中，
+// 通道上的余额变化不会暴露订单金额；普通订单和早期的私有订单为空，使用通道上的余额
+func escrowCollection(order *Order) string {
+	if !order.Escrow {
+		return ""
+	}
+	return pairCollection(order.Payer, order.Producer)
+}
+
+// getEscrowBalance 读取账户的余额，collection为空时读取通道上的余额，否则读取该集合中的托管余额
+func getEscrowBalance(stub shim.ChaincodeStubInterface, collection, account string) (Amount, error) {
+	if collection == "" {
+		return getBalance(stub, account)
+	}
+	val, err := stub.GetPrivateData(collection, fmt.Sprintf("%s-%s", PrefixEscrowBalance, account))
+	if err != nil {
+		return Amount{}, fmt.Errorf("failed to get private data %v", err)
+	}
+	return bytesToAmount(val)
+}
+
+// putEscrowBalance 保存账户的余额，collection含义同getEscrowBalance
+func putEscrowBalance(stub shim.ChaincodeStubInterface, collection, account string, amount Amount) error {
+	if collection == "" {
+		return stub.PutState(fmt.Sprintf("%s-%s", PrefixBalance, account), amountToBytes(amount))
+	}
+	return stub.PutPrivateData(collection, fmt.Sprintf("%s-%s", PrefixEscrowBalance, account), amountToBytes(amount))
+}
+
+// addOrderBalance 给订单的一方增加余额，私有订单记入双方集合中的托管余额
+func addOrderBalance(stub shim.ChaincodeStubInterface, order *Order, account string, amount Amount) error {
+	collection := escrowCollection(order)
+	current, err := getEscrowBalance(stub, collection, account)
+	if err != nil {
+		return err
+	}
+	if current, err = current.Add(amount); err != nil {
+		return err
+	}
+	return putEscrowBalance(stub, collection, account, current)
+}
+
+// reduceOrderBalance 扣减订单一方的余额，私有订单从双方集合中的托管余额扣减
+func reduceOrderBalance(stub shim.ChaincodeStubInterface, order *Order, account string, amount Amount) error {
+	collection := escrowCollection(order)
+	current, err := getEscrowBalance(stub, collection, account)
+	if err != nil {
+		return err
+	}
+	if current, err = current.Sub(amount); err != nil {
+		return err
+	}
+	return putEscrowBalance(stub, collection, account, current)
+}
+
+// depositEscrow 把调用者通道上的资金存入与counterparty的私有数据集合中，用于支付私有订单，参数 [counterparty, amount]。
+// 存入的金额是公开的，但与具体的订单无关
+func (c *Contract) depositEscrow(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return moveEscrow(stub, args, true)
+}
+
+// withdrawEscrow 把调用者在与counterparty的私有数据集合中的余额取回通道上，参数 [counterparty, amount]
+func (c *Contract) withdrawEscrow(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return moveEscrow(stub, args, false)
+}
+
+func moveEscrow(stub shim.ChaincodeStubInterface, args []string, deposit bool) peer.Response {
+	if len(args) != 2 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	amount, err := parsePositiveAmount(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if args[0] == caller.Org {
+		return shim.Error(fmt.Sprintf("invalid counterparty, got %s", args[0]))
+	}
+	collection := pairCollection(caller.Org, args[0])
+	from, to := "", collection
+	if deposit {
+		if err := caller.checkSpend(amount); err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		from, to = collection, ""
+	}
+	balance, err := getEscrowBalance(stub, from, caller.Account)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get balance %v", err))
+	}
+	if balance, err = balance.Sub(amount); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := putEscrowBalance(stub, from, caller.Account, balance); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put balance %v", err))
+	}
+	if balance, err = getEscrowBalance(stub, to, caller.Account); err != nil {
+		return shim.Error(fmt.Sprintf("failed to get balance %v", err))
+	}
+	if balance, err = balance.Add(amount); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := putEscrowBalance(stub, to, caller.Account, balance); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put balance %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// getEscrowBalance 查询调用者在与counterparty的私有数据集合中的托管余额，参数 [counterparty]
+func (c *Contract) getEscrowBalance(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	balance, err := getEscrowBalance(stub, pairCollection(caller.Org, args[0]), caller.Account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(balance.String()))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPrivateOrder(t *testing.T) {
+	s := setupOrder(t)
+	price := map[string]string{transientPrice: "80"}
+	s.mustFail(orgLCD, "setPrivatePrice", RoleMaterialProducer, "LCD", orgTV)
+	if res := s.invokeWithTransient(orgTV, price, "setPrivatePrice", RoleMaterialProducer, "LCD", orgLCD); res.Status == 200 {
+		t.Fatal("only material producer can set material price")
+	}
+	if res := s.invokeWithTransient(orgLCD, price, "setPrivatePrice", RoleMaterialProducer, "LCD", orgTV); res.Status != 200 {
+		t.Fatal(res.Message)
+	}
+	if got := string(s.mustInvoke(orgTV, "getPrivatePrice", RoleMaterialProducer, orgLCD, orgTV, "LCD")); got != "80" {
+		t.Fatalf("unexpected private price %s", got)
+	}
+	s.mustFail(orgAudio, "getPrivatePrice", RoleMaterialProducer, orgLCD, orgTV, "LCD")
+
+	// 私有订单的货款从托管在双方私有数据集合中的余额支付，通道上只能看到与订单无关的存入金额
+	s.mustFail(orgTV, "depositEscrow", orgLCD, "200000")
+	s.mustFail(orgTV, "depositEscrow", orgTV, "2000")
+	s.mustInvoke(orgTV, "depositEscrow", orgLCD, "2000")
+	s.expectBalance(orgTV, 98000)
+	escrowBalance := func(caller, counterparty string) string {
+		t.Helper()
+		return string(s.mustInvoke(caller, "getEscrowBalance", counterparty))
+	}
+	if got := escrowBalance(orgTV, orgLCD); got != "2000" {
+		t.Fatalf("unexpected escrow balance %s", got)
+	}
+
+	// 价格和随机盐在transient中，订单金额只保存在私有数据集合中
+	salt := "0123456789abcdef"
+	if res := s.invokeWithTransient(orgTV, map[string]string{transientPrice: "79", transientSalt: salt}, "makeMaterialOrder", orgLCD, "LCD", "10", ""); res.Status == 200 {
+		t.Fatal("price lower than the private price should fail")
+	}
+	if res := s.invokeWithTransient(orgTV, map[string]string{transientPrice: "90"}, "makeMaterialOrder", orgLCD, "LCD", "10", ""); res.Status == 200 {
+		t.Fatal("private order without salt should fail")
+	}
+	res := s.invokeWithTransient(orgTV, map[string]string{transientPrice: "90", transientSalt: salt}, "makeMaterialOrder", orgLCD, "LCD", "10", "", "10")
+	if res.Status != 200 {
+		t.Fatal(res.Message)
+	}
+	var public Order
+	if err := json.Unmarshal(res.Payload, &public); err != nil {
+		t.Fatal(err)
+	}
+	key := fmt.Sprintf("%s-%s", PrefixOrder, public.OrderID)
+	collection := pairCollection(orgTV, orgLCD)
+	if collection != "pair-material_lcd-product_tv" {
+		t.Fatalf("unexpected collection %s", collection)
+	}
+	private := s.PvtState[collection][key]
+	sum := sha256.Sum256(private)
+	if !public.Private || !public.Amount.IsZero() || public.FinancialsHash != hex.EncodeToString(sum[:]) ||
+		public.Salt != "" || strings.Contains(string(s.State[key]), "800") || !strings.Contains(string(private), hex.EncodeToString([]byte(salt))) {
+		t.Fatalf("unexpected public order %s", s.State[key])
+	}
+	s.expectBalance(orgTV, 98000)
+	if got := escrowBalance(orgTV, orgLCD); got != "1200" {
+		t.Fatalf("unexpected escrow balance %s", got)
+	}
+
+	var order Order
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "getOrder", public.OrderID), &order); err != nil {
+		t.Fatal(err)
+	}
+	if order.Amount.Cmp(NewAmount(800)) != 0 || order.FinancialsHash != "" {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	// payment在所有双方的集合中，在自己的peer上也能看到金额
+	s.peer = orgPayment
+	if err := json.Unmarshal(s.mustInvoke(orgPayment, "getOrder", public.OrderID), &order); err != nil {
+		t.Fatal(err)
+	}
+	if order.Amount.Cmp(NewAmount(800)) != 0 {
+		t.Fatalf("auditor should see the amount, got %+v", order)
+	}
+	s.peer = ""
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "getOrder", public.OrderID), &order); err != nil {
+		t.Fatal(err)
+	}
+	if !order.Amount.IsZero() {
+		t.Fatalf("store should not see the amount, got %s", order.Amount)
+	}
+
+	// 收货时货款记入供货商的托管余额，供货商可以取回通道上
+	s.mustInvoke(orgLCD, "acceptOrder", public.OrderID)
+	s.mustInvoke(orgLCD, "shipOrder", public.OrderID, "4")
+	s.mustInvoke(orgTV, "confirmOrder", public.OrderID)
+	s.expectBalance(orgLCD, 0)
+	if got := escrowBalance(orgLCD, orgTV); got != "320" {
+		t.Fatalf("unexpected escrow balance %s", got)
+	}
+	s.mustFail(orgLCD, "withdrawEscrow", orgTV, "321")
+	s.mustInvoke(orgLCD, "withdrawEscrow", orgTV, "320")
+	s.expectBalance(orgLCD, 320)
+
+	// 不在集合中的peer不能处理私有订单，由双方的peer背书时处理，跳过的订单不计入limit
+	order = s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100", "10")
+	s.now += 20
+	s.peer = orgStore
+	var expired []*ExpiredOrder
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "expireOrders", "1"), &expired); err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].OrderID != order.OrderID {
+		t.Fatalf("unexpected expired orders %+v", expired)
+	}
+	// 私有订单的退款退回托管余额，返回值中不包含金额
+	s.peer = orgLCD
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "expireOrders"), &expired); err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].OrderID != public.OrderID || !expired[0].ReturnToPayer.IsZero() {
+		t.Fatalf("unexpected expired orders %+v", expired)
+	}
+	s.expectBalance(orgTV, 98000)
+	if got := escrowBalance(orgTV, orgLCD); got != "1680" {
+		t.Fatalf("unexpected escrow balance %s", got)
+	}
+}
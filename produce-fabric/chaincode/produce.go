@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -13,13 +12,70 @@ import (
 
 // Product 产品
 type Product struct {
-	Owner     string    `json:"owner"`
+	Owner     string    `json:"owner,omitempty"`
+	Producer  string    `json:"producer"`
 	CreatedAt time.Time `json:"createdAt"`
 	// BatchID 产品批号
 	BatchID string `json:"batchID"`
 	// MaterialBatches 这个产品包含的物料的批次号
 	MaterialBatches []string `json:"materialBatches"`
 	ProductType     string   `json:"productType"`
+	// Action 产生当前版本的操作，OrderID 为引起所有权变更的订单
+	Action  string `json:"action,omitempty"`
+	OrderID string `json:"orderID,omitempty"`
+	// DocType 固定为product，用于CouchDB富查询
+	DocType string `json:"docType,omitempty"`
+	// Recalled 产品所用的物料批次被召回，已从库存中移除，不能再转移
+	Recalled bool `json:"recalled,omitempty"`
+	// Scrapped 产品已被所有者报废，已从库存中移除，不能再转移，ScrapReason 为报废原因
+	Scrapped    bool   `json:"scrapped,omitempty"`
+	ScrapReason string `json:"scrapReason,omitempty"`
+	// Sold 产品已卖给最终消费者，已从库存中移除，不能再转移
+	Sold   bool       `json:"sold,omitempty"`
+	SoldAt *time.Time `json:"soldAt,omitempty"`
+	// VerifyHash 防伪码的sha256，防伪码由生产者的密钥生成，见verificationCode
+	VerifyHash string `json:"verifyHash,omitempty"`
+	// Components 按物料清单装入的子部件产品ID，IncorporatedInto 为装有该产品的上级产品ID
+	Components       []string `json:"components,omitempty"`
+	IncorporatedInto string   `json:"incorporatedInto,omitempty"`
+	// Custodian 保管产品的门店，为空时由所有者自己保管，寄存不改变所有权
+	Custodian string `json:"custodian,omitempty"`
+}
+
+// inStock 产品是否还在所有者的库存中，可以转移、售出或用作子部件
+func (product *Product) inStock() bool {
+	return !product.Recalled && !product.Scrapped && !product.Sold && product.IncorporatedInto == ""
+}
+
+// TracedBatch 溯源结果中的物料批次，批次信息不在链上时Material为空，
+// 批次属于某个子部件时Via为该子部件的产品ID
+type TracedBatch struct {
+	BatchID  string    `json:"batchID"`
+	Material *Material `json:"material"`
+	Via      string    `json:"via,omitempty"`
+}
+
+// 产品记录变更的原因
+const (
+	ProductActionRegistered   = "registered"
+	ProductActionTransferred  = "transferred"
+	ProductActionRecalled     = "recalled"
+	ProductActionScrapped     = "scrapped"
+	ProductActionSold         = "sold"
+	ProductActionIncorporated = "incorporated"
+	ProductActionCheckedIn    = "checkedIn"
+	ProductActionCheckedOut   = "checkedOut"
+)
+
+// ProductHistory 产品的一个历史版本
+type ProductHistory struct {
+	TxID      string    `json:"txID"`
+	Timestamp time.Time `json:"timestamp"`
+	OldOwner  string    `json:"oldOwner"`
+	NewOwner  string    `json:"newOwner"`
+	Action    string    `json:"action"`
+	OrderID   string    `json:"orderID,omitempty"`
+	Product   *Product  `json:"product,omitempty"`
 }
 
 func (c *Contract) getMyProducts(stub shim.ChaincodeStubInterface, args []string) peer.Response {
@@ -34,24 +90,72 @@ func (c *Contract) getMyProducts(stub shim.ChaincodeStubInterface, args []string
 	return shim.Success(data)
 }
 
-func (c *Contract) setProductPrice(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	if len(args) != 2 {
+// ProductStock 库存中的一个产品
+type ProductStock struct {
+	ProductType string `json:"productType"`
+	ProductID   string `json:"productID"`
+}
+
+// getMyProductsPage 分页查询调用者的产品库存明细，参数 [productType, pageSize, bookmark]，
+// productType为空时查询所有类型
+func (c *Contract) getMyProductsPage(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 1 {
 		return shim.Error("invalid arguments")
 	}
+	pageSize, bookmark, err := parsePage(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	role, err := cid.GetMSPID(stub)
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to get role %v", err))
 	}
-	if !strings.HasPrefix(role, "product.") {
-		return shim.Error(fmt.Sprintf("only for product producer, got %s", role))
+	keys := []string{role}
+	if args[0] != "" {
+		keys = append(keys, args[0])
+	}
+	iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(PrefixProductPreserve, keys, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+	}
+	defer iter.Close()
+	stocks := []ProductStock{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(attr) != 3 {
+			return shim.Error("internal key format wrong")
+		}
+		stocks = append(stocks, ProductStock{ProductType: attr[1], ProductID: attr[2]})
+	}
+	data, err := json.Marshal(Page{Records: stocks, Count: len(stocks), Bookmark: meta.GetBookmark()})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+func (c *Contract) setProductPrice(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("invalid arguments")
+	}
+	role, err := requireRole(stub, RoleProductProducer)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 	productType := args[0]
-	price, err := strconv.ParseUint(args[1], 10, 64)
+	price, err := ParseAmount(args[1])
 	if err != nil {
 		return shim.Error(fmt.Sprintf("invalid price, got %s", args[1]))
 	}
 	key := fmt.Sprintf("%s-%s-%s", PrefixProductPrice, role, productType)
-	if err := stub.PutState(key, uint64ToBytes(price)); err != nil {
+	if err := stub.PutState(key, amountToBytes(price)); err != nil {
 		return shim.Error(fmt.Sprintf("failed to put state, %v", err))
 	}
 	return shim.Success(nil)
@@ -67,81 +171,356 @@ func (c *Contract) getProductPrice(stub shim.ChaincodeStubInterface, args []stri
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	return shim.Success([]byte(strconv.FormatUint(price, 10)))
+	return shim.Success([]byte(price.String()))
 }
 
+// registerProduct 登记产品，参数 [productType, productID, batchID, materialBatch...]。
+// 生产者为该产品类型设置了物料清单时必须使用produce，由链码扣除物料并记录批次
 func (c *Contract) registerProduct(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	role, err := cid.GetMSPID(stub)
+	role, err := requireRole(stub, RoleProductProducer)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	if !strings.HasPrefix(role, "product.") {
-		return shim.Error("only for product producer")
-	}
 	if len(args) < 4 {
 		return shim.Error("invalid arguments")
 	}
 	productType := args[0]
-	productID := args[1]
-	batchID := args[2]
-	materialBatches := args[3:]
-	t, err := stub.GetTxTimestamp()
+	bom, err := getBOM(stub, role, productType)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if bom != nil {
+		return shim.Error(fmt.Sprintf("productType(%s) has a bill of materials, use produce instead", productType))
+	}
+	if _, err := createProduct(stub, role, productType, args[1], args[2], args[3:], nil); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// createProduct 写入新产品、溯源索引和库存，发出EvtProductCreated事件，components为装入的子部件
+func createProduct(stub shim.ChaincodeStubInterface, role, productType, productID, batchID string, materialBatches, components []string) (*Product, error) {
+	for _, mbatch := range materialBatches {
+		recall, err := getRecall(stub, mbatch)
+		if err != nil {
+			return nil, err
+		}
+		if recall != nil {
+			return nil, fmt.Errorf("material batch(%s) is recalled", mbatch)
+		}
+	}
+	hash, err := getVerifyHash(stub, productID)
+	if err != nil {
+		return nil, err
+	}
+	t, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
 	product := Product{
 		Owner:           role,
+		Producer:        role,
 		CreatedAt:       time.Unix(t.GetSeconds(), 0),
 		BatchID:         batchID,
 		MaterialBatches: materialBatches,
 		ProductType:     productType,
+		Action:          ProductActionRegistered,
+		DocType:         DocTypeProduct,
+		VerifyHash:      hash,
+		Components:      components,
 	}
 	pData, err := json.Marshal(product)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to marshal product %v", err))
+		return nil, fmt.Errorf("failed to marshal product %v", err)
 	}
 	pKey := fmt.Sprintf("%s-%s", PrefixProduct, productID)
 	existing, err := stub.GetState(pKey)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+		return nil, fmt.Errorf("failed to get state, %v", err)
 	}
 	if len(existing) > 0 {
-		return shim.Error(fmt.Sprintf("product(%s) already exist", productID))
+		return nil, fmt.Errorf("product(%s) already exist", productID)
 	}
 	if err := stub.PutState(pKey, pData); err != nil {
-		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+		return nil, fmt.Errorf("failed to put state %v", err)
 	}
 	for _, mbatch := range materialBatches {
 		mpKey, err := stub.CreateCompositeKey(PrefixMaterialProduct, []string{mbatch, productID})
 		if err != nil {
-			return shim.Error(fmt.Sprintf("failed to create mpkey, %v", err))
+			return nil, fmt.Errorf("failed to create mpkey, %v", err)
 		}
 		if err := stub.PutState(mpKey, []byte{1}); err != nil {
-			return shim.Error(fmt.Sprintf("failed to put state %v", err))
+			return nil, fmt.Errorf("failed to put state %v", err)
 		}
 	}
 	ppKey, err := stub.CreateCompositeKey(PrefixProductPreserve, []string{role, productType, productID})
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to create ppkey, %v", err))
+		return nil, fmt.Errorf("failed to create ppkey, %v", err)
 	}
 	if err := stub.PutState(ppKey, []byte{1}); err != nil {
-		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+		return nil, fmt.Errorf("failed to put state %v", err)
 	}
 	if err := stub.SetEvent("EvtProductCreated", pData); err != nil {
-		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+		return nil, fmt.Errorf("failed to set event %v", err)
 	}
-	return shim.Success(nil)
+	return &product, nil
+}
+
+func (c *Contract) getProductHistory(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	productID := args[0]
+	if productID == "" {
+		return shim.Error("productID is empty")
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	history, err := getProductHistory(stub, productID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(history) == 0 {
+		return shim.Error(fmt.Sprintf("product(%s) does not exist", productID))
+	}
+	for i := range history {
+		historyView(stub, &history[i], role)
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal history %v", err))
+	}
+	return shim.Success(data)
 }
 
-func transferProduct(stub shim.ChaincodeStubInterface, from, to, productType string, count uint64) error {
+func (c *Contract) getProduct(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	product, err := getProduct(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	data, err := json.Marshal(productView(stub, product, role))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal product %v", err))
+	}
+	return shim.Success(data)
+}
+
+// getProducts 批量查询产品，不存在的产品ID对应null
+func (c *Contract) getProducts(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) == 0 || len(args) > maxPageSize {
+		return shim.Error("invalid arguments")
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	products := make(map[string]*Product, len(args))
+	for _, id := range args {
+		pkey := fmt.Sprintf("%s-%s", PrefixProduct, id)
+		val, err := stub.GetState(pkey)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get state %v", err))
+		}
+		if len(val) == 0 {
+			products[id] = nil
+			continue
+		}
+		var product Product
+		if err := json.Unmarshal(val, &product); err != nil {
+			return shim.Error(fmt.Sprintf("failed to unmarshal product %v", err))
+		}
+		products[id] = productView(stub, &product, role)
+	}
+	data, err := json.Marshal(products)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal products %v", err))
+	}
+	return shim.Success(data)
+}
+
+// productView 按调用者过滤产品字段，所有者、生产者和结算方可以看到全部字段，
+// 其他组织只能看到产品类型、生产者、批号等公开信息，看不到当前所有者和订单
+func productView(stub shim.ChaincodeStubInterface, product *Product, role string) *Product {
+	if role == product.Owner || role == product.Producer || isAuditor(stub, role) {
+		return product
+	}
+	return &Product{
+		Producer:        product.Producer,
+		CreatedAt:       product.CreatedAt,
+		BatchID:         product.BatchID,
+		MaterialBatches: product.MaterialBatches,
+		ProductType:     product.ProductType,
+	}
+}
+
+// historyView 按productView的规则隐藏调用者无权查看的历史版本，
+// 只有该版本的所有者、转出方、生产商和审计方可以看到所有者和订单
+func historyView(stub shim.ChaincodeStubInterface, h *ProductHistory, role string) {
+	visible := role == h.OldOwner || isAuditor(stub, role)
+	if h.Product != nil {
+		visible = visible || role == h.Product.Owner || role == h.Product.Producer
+		h.Product = productView(stub, h.Product, role)
+	}
+	if visible {
+		return
+	}
+	h.OldOwner = ""
+	h.NewOwner = ""
+	h.OrderID = ""
+}
+
+// traceMaterialBatch 正向溯源: 分页列出使用了某个物料批次的产品ID，
+// 产品作为子部件装入了其他产品时，紧接着列出装有它的各级产品，分页按直接使用该批次的产品计
+func (c *Contract) traceMaterialBatch(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 1 {
+		return shim.Error("invalid arguments")
+	}
+	batchID := args[0]
+	if batchID == "" {
+		return shim.Error("batchID is empty")
+	}
+	pageSize, bookmark, err := parsePage(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(PrefixMaterialProduct, []string{batchID}, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+	}
+	defer iter.Close()
+	ids := []string{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(attr) != 2 {
+			return shim.Error("internal key format wrong")
+		}
+		ids = appendUnique(ids, attr[1])
+		product, err := getProduct(stub, attr[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		ancestors, _, err := productAncestors(stub, product)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		ids = appendUnique(ids, ancestors...)
+	}
+	data, err := json.Marshal(Page{Records: ids, Count: len(ids), Bookmark: meta.GetBookmark()})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+// traceProduct 反向溯源: 分页列出产品所用物料批次及批次信息，包括各级子部件所用的批次，bookmark为批次下标
+func (c *Contract) traceProduct(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 1 {
+		return shim.Error("invalid arguments")
+	}
+	productID := args[0]
+	pageSize, bookmark, err := parsePage(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var start int
+	if bookmark != "" {
+		start, err = strconv.Atoi(bookmark)
+		if err != nil || start < 0 {
+			return shim.Error(fmt.Sprintf("invalid bookmark, got %s", bookmark))
+		}
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	product, err := getProduct(stub, productID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	all, err := productBatches(stub, product, "", 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	batches := []TracedBatch{}
+	end := start + int(pageSize)
+	if end > len(all) {
+		end = len(all)
+	}
+	for i := start; i < end; i++ {
+		material, err := getMaterialBatch(stub, all[i].BatchID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		all[i].Material = materialView(stub, material, role)
+		batches = append(batches, all[i])
+	}
+	page := Page{Records: batches, Count: len(batches)}
+	if end < len(all) {
+		page.Bookmark = strconv.Itoa(end)
+	}
+	data, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+// productBatches 递归列出产品及其各级子部件所用的物料批次，不读取批次信息
+func productBatches(stub shim.ChaincodeStubInterface, product *Product, via string, depth int) ([]TracedBatch, error) {
+	if depth > maxTraceDepth {
+		return nil, fmt.Errorf("product nesting exceeds %d levels", maxTraceDepth)
+	}
+	var batches []TracedBatch
+	for _, batchID := range product.MaterialBatches {
+		batches = append(batches, TracedBatch{BatchID: batchID, Via: via})
+	}
+	for _, id := range product.Components {
+		component, err := getProduct(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		sub, err := productBatches(stub, component, id, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, sub...)
+	}
+	return batches, nil
+}
+
+// transferProduct 从from的库存中转移count个产品给to，store不为空时从from寄存在该门店的产品中出库，
+// 并发出门店的EvtCheckOut事件
+func transferProduct(stub shim.ChaincodeStubInterface, from, to, store, productType string, count uint64, orderID string) error {
 	if from == to {
 		return fmt.Errorf("transfer to a same guy is forbidden")
 	}
 	var i uint64
-	iter, err := stub.GetStateByPartialCompositeKey(PrefixProductPreserve, []string{from, productType})
+	prefix, keys := PrefixProductPreserve, []string{from, productType}
+	if store != "" {
+		prefix, keys = PrefixProductCustody, []string{store, from, productType}
+	}
+	iter, err := stub.GetStateByPartialCompositeKey(prefix, keys)
 	if err != nil {
 		return err
 	}
+	defer iter.Close()
+	var ids []string
 	for iter.HasNext() && i < count {
 		kv, err := iter.Next()
 		if err != nil {
@@ -151,36 +530,73 @@ func transferProduct(stub shim.ChaincodeStubInterface, from, to, productType str
 		if err != nil {
 			return err
 		}
-		if len(attr) != 3 {
+		if len(attr) != len(keys)+1 {
 			return fmt.Errorf("internal key split error")
 		}
-		productID := attr[2]
-		if err := changeProductOwner(stub, productID, to); err != nil {
+		productID := attr[len(keys)]
+		if err := changeProductOwner(stub, productID, to, orderID); err != nil {
 			return err
 		}
+		ids = append(ids, productID)
 		i++
 	}
 	if i != count {
 		return fmt.Errorf("insufficient materials, %d less", count-i)
 	}
+	if store != "" {
+		return setCustodyEvent(stub, "EvtCheckOut", map[string]interface{}{
+			"store": store, "owner": from, "to": to, "kind": CustodyProduct,
+			"productType": productType, "ids": ids, "orderID": orderID,
+		})
+	}
 	return nil
 }
 
-func changeProductOwner(stub shim.ChaincodeStubInterface, id, to string) error {
+// getProduct 获取产品信息
+func getProduct(stub shim.ChaincodeStubInterface, id string) (*Product, error) {
 	var product Product
 	pkey := fmt.Sprintf("%s-%s", PrefixProduct, id)
 	val, err := stub.GetState(pkey)
 	if err != nil {
-		return fmt.Errorf("failed to get state %w", err)
+		return nil, fmt.Errorf("failed to get state %w", err)
 	}
 	if len(val) == 0 {
-		return fmt.Errorf("product(%s) does not exist", id)
+		return nil, fmt.Errorf("product(%s) does not exist", id)
 	}
 	if err := json.Unmarshal(val, &product); err != nil {
-		return fmt.Errorf("failed to unmarshal product %w", err)
+		return nil, fmt.Errorf("failed to unmarshal product %w", err)
+	}
+	return &product, nil
+}
+
+func changeProductOwner(stub shim.ChaincodeStubInterface, id, to, orderID string) error {
+	product, err := getProduct(stub, id)
+	if err != nil {
+		return err
+	}
+	if product.Recalled {
+		return fmt.Errorf("product(%s) is recalled", id)
+	}
+	if product.Scrapped {
+		return fmt.Errorf("product(%s) is scrapped", id)
+	}
+	if product.Sold {
+		return fmt.Errorf("product(%s) is sold", id)
+	}
+	if product.IncorporatedInto != "" {
+		return fmt.Errorf("product(%s) is incorporated into %s", id, product.IncorporatedInto)
+	}
+	pkey := fmt.Sprintf("%s-%s", PrefixProduct, id)
+	oppkey, err := productStockKey(stub, product, id)
+	if err != nil {
+		return fmt.Errorf("failed to create oppkey %w", err)
 	}
 	old := product.Owner
 	product.Owner = to
+	product.Custodian = ""
+	product.Action = ProductActionTransferred
+	product.OrderID = orderID
+	product.DocType = DocTypeProduct
 	newData, err := json.Marshal(product)
 	if err != nil {
 		return fmt.Errorf("failed to marshal product %w", err)
@@ -188,10 +604,6 @@ func changeProductOwner(stub shim.ChaincodeStubInterface, id, to string) error {
 	if err := stub.PutState(pkey, newData); err != nil {
 		return fmt.Errorf("failed to put state %w", err)
 	}
-	oppkey, err := stub.CreateCompositeKey(PrefixProductPreserve, []string{old, product.ProductType, id})
-	if err != nil {
-		return fmt.Errorf("failed to create oppkey %w", err)
-	}
 	if err := stub.DelState(oppkey); err != nil {
 		return fmt.Errorf("failed to del state %w", err)
 	}
@@ -203,9 +615,10 @@ func changeProductOwner(stub shim.ChaincodeStubInterface, id, to string) error {
 		return fmt.Errorf("failed to put state %w", err)
 	}
 	evtData, err := json.Marshal(map[string]interface{}{
-		"id":  id,
-		"old": old,
-		"new": to,
+		"id":      id,
+		"old":     old,
+		"new":     to,
+		"orderID": orderID,
 	})
 	if err != nil {
 		return err
@@ -216,16 +629,16 @@ func changeProductOwner(stub shim.ChaincodeStubInterface, id, to string) error {
 	return nil
 }
 
-func getProductPrice(stub shim.ChaincodeStubInterface, producer, productType string) (uint64, error) {
+func getProductPrice(stub shim.ChaincodeStubInterface, producer, productType string) (Amount, error) {
 	key := fmt.Sprintf("%s-%s-%s", PrefixProductPrice, producer, productType)
 	val, err := stub.GetState(key)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get state %w", err)
+		return Amount{}, fmt.Errorf("failed to get state %w", err)
 	}
-	if len(val) != 8 {
-		return 0, fmt.Errorf("product price not found, set price first")
+	if len(val) == 0 {
+		return Amount{}, fmt.Errorf("product price not found, set price first")
 	}
-	return bytesToUint64(val), nil
+	return bytesToAmount(val)
 }
 
 func getMyProducts(stub shim.ChaincodeStubInterface) (map[string]uint64, error) {
@@ -255,3 +668,47 @@ func getMyProducts(stub shim.ChaincodeStubInterface) (map[string]uint64, error)
 	}
 	return m, nil
 }
+
+// getProductHistory 按时间顺序返回产品记录的每一个版本
+func getProductHistory(stub shim.ChaincodeStubInterface, id string) ([]ProductHistory, error) {
+	pkey := fmt.Sprintf("%s-%s", PrefixProduct, id)
+	iter, err := stub.GetHistoryForKey(pkey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history %w", err)
+	}
+	defer iter.Close()
+	var history []ProductHistory
+	var owner string
+	for iter.HasNext() {
+		km, err := iter.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get iter next %w", err)
+		}
+		h := ProductHistory{
+			TxID:      km.GetTxId(),
+			Timestamp: time.Unix(km.GetTimestamp().GetSeconds(), int64(km.GetTimestamp().GetNanos())).UTC(),
+			OldOwner:  owner,
+		}
+		if !km.GetIsDelete() && len(km.GetValue()) > 0 {
+			var product Product
+			if err := json.Unmarshal(km.GetValue(), &product); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal product %w", err)
+			}
+			h.NewOwner = product.Owner
+			h.Action = product.Action
+			h.OrderID = product.OrderID
+			h.Product = &product
+		}
+		// 早期版本的记录没有Action字段
+		if h.Product != nil && h.Action == "" {
+			if len(history) == 0 {
+				h.Action = ProductActionRegistered
+			} else {
+				h.Action = ProductActionTransferred
+			}
+		}
+		owner = h.NewOwner
+		history = append(history, h)
+	}
+	return history, nil
+}
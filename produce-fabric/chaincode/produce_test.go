@@ -0,0 +1,205 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRegisterProduct(t *testing.T) {
+	s := newTestStub(t)
+	s.mustFail(orgLCD, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1")
+	s.mustFail(orgTV, "registerProduct", "TV", "TV_1", "2020-05-20")
+
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1", "Audio_1")
+	var p Product
+	s.expectEvent("EvtProductCreated", &p)
+	if p.Owner != orgTV || p.ProductType != "TV" || len(p.MaterialBatches) != 2 {
+		t.Fatalf("unexpected product %+v", p)
+	}
+	s.mustFail(orgTV, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1")
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_2", "2020-05-20", "LCD_1")
+	s.expectProducts(orgTV, map[string]uint64{"TV": 2})
+}
+
+func TestProductPrice(t *testing.T) {
+	s := newTestStub(t)
+	s.mustFail(orgLCD, "setProductPrice", "TV", "3000")
+	s.mustFail(orgTV, "getProductPrice", orgTV, "TV")
+
+	s.mustInvoke(orgTV, "setProductPrice", "TV", "3000")
+	if price := string(s.mustInvoke(orgStore, "getProductPrice", orgTV, "TV")); price != "3000" {
+		t.Fatalf("unexpected price %s", price)
+	}
+}
+
+func TestTransferProduct(t *testing.T) {
+	s := setupOrder(t)
+	for _, id := range []string{"TV_1", "TV_2", "TV_3"} {
+		s.mustInvoke(orgTV, "registerProduct", "TV", id, "2020-05-20", "LCD_1")
+	}
+	order := s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "2", "3000")
+	s.shipOrder(orgTV, order.OrderID)
+	s.mustInvoke(orgStore, "confirmOrder", order.OrderID)
+	s.expectProducts(orgTV, map[string]uint64{"TV": 1})
+	s.expectProducts(orgStore, map[string]uint64{"TV": 2})
+	s.expectBalance(orgTV, 106000)
+
+	// 库存不足时确认失败，订单保持未完成
+	order = s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "2", "3000")
+	s.shipOrder(orgTV, order.OrderID)
+	s.mustFail(orgStore, "confirmOrder", order.OrderID)
+	s.expectProducts(orgTV, map[string]uint64{"TV": 1})
+}
+
+func TestProductHistory(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1")
+	order := s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "1", "3000")
+	s.shipOrder(orgTV, order.OrderID)
+	s.mustInvoke(orgStore, "confirmOrder", order.OrderID)
+
+	getHistory := func(caller string) []ProductHistory {
+		t.Helper()
+		var history []ProductHistory
+		if err := json.Unmarshal(s.mustInvoke(caller, "getProductHistory", "TV_1"), &history); err != nil {
+			t.Fatal(err)
+		}
+		return history
+	}
+	history := getHistory(orgTV)
+	if len(history) != 2 {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if h := history[0]; h.Action != ProductActionRegistered || h.OldOwner != "" || h.NewOwner != orgTV {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	if h := history[1]; h.Action != ProductActionTransferred || h.OrderID != order.OrderID ||
+		h.OldOwner != orgTV || h.NewOwner != orgStore || h.TxID == "" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	// 买方看不到自己之前的版本的所有者
+	history = getHistory(orgStore)
+	if h := history[0]; h.NewOwner != "" || h.Product.Owner != "" || h.Product.ProductType != "TV" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	if h := history[1]; h.OrderID != order.OrderID || h.OldOwner != orgTV || h.NewOwner != orgStore {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	// 无关的组织只能看到产品的公开信息
+	for _, h := range getHistory(orgAudio) {
+		if h.OldOwner != "" || h.NewOwner != "" || h.OrderID != "" || h.Product.Owner != "" ||
+			h.Product.Producer != orgTV || h.Action == "" {
+			t.Fatalf("unexpected history %+v", h)
+		}
+	}
+	s.mustFail(orgStore, "getProductHistory", "TV_2")
+}
+
+func TestTrace(t *testing.T) {
+	s := newTestStub(t)
+	s.mustInvoke(orgLCD, "registerMaterial", "LCD", "100", "LCD_1")
+	s.mustInvoke(orgAudio, "registerMaterial", "Audio", "100", "Audio_1")
+	for _, id := range []string{"TV_1", "TV_2", "TV_3"} {
+		s.mustInvoke(orgTV, "registerProduct", "TV", id, "2020-05-20", "LCD_1", "Audio_1", "Unknown_1")
+	}
+
+	var ids []string
+	bookmark := ""
+	for {
+		var page struct {
+			Records  []string `json:"records"`
+			Bookmark string   `json:"bookmark"`
+		}
+		if err := json.Unmarshal(s.mustInvoke(orgStore, "traceMaterialBatch", "LCD_1", "2", bookmark), &page); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, page.Records...)
+		if bookmark = page.Bookmark; bookmark == "" {
+			break
+		}
+	}
+	if len(ids) != 3 || ids[0] != "TV_1" || ids[2] != "TV_3" {
+		t.Fatalf("unexpected trace %v", ids)
+	}
+
+	var page struct {
+		Records  []TracedBatch `json:"records"`
+		Bookmark string        `json:"bookmark"`
+	}
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "traceProduct", "TV_2", "2"), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 2 || page.Bookmark != "2" {
+		t.Fatalf("unexpected trace %+v", page)
+	}
+	if m := page.Records[1].Material; m == nil || m.Producer != orgAudio || m.CreatedAt.IsZero() {
+		t.Fatalf("unexpected batch %+v", page.Records[1])
+	}
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "traceProduct", "TV_2", "2", page.Bookmark), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 1 || page.Records[0].Material != nil || page.Bookmark != "" {
+		t.Fatalf("unexpected trace %+v", page)
+	}
+	s.mustFail(orgStore, "traceProduct", "TV_4")
+	s.mustFail(orgStore, "traceMaterialBatch", "LCD_1", "0")
+}
+
+func TestGetProduct(t *testing.T) {
+	s := newTestStub(t)
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1")
+
+	var p Product
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "getProduct", "TV_1"), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Owner != orgTV || p.Producer != orgTV || p.Action != ProductActionRegistered {
+		t.Fatalf("unexpected product %+v", p)
+	}
+	// 其他组织看不到所有者
+	p = Product{}
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "getProduct", "TV_1"), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Owner != "" || p.Action != "" || p.Producer != orgTV || len(p.MaterialBatches) != 1 {
+		t.Fatalf("unexpected product %+v", p)
+	}
+	s.mustFail(orgTV, "getProduct", "TV_2")
+
+	var products map[string]*Product
+	if err := json.Unmarshal(s.mustInvoke(orgPayment, "getProducts", "TV_1", "TV_2"), &products); err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || products["TV_1"].Owner != orgTV || products["TV_2"] != nil {
+		t.Fatalf("unexpected products %v", products)
+	}
+	s.mustFail(orgTV, "getProducts")
+}
+
+func TestGetMyProductsPage(t *testing.T) {
+	s := newTestStub(t)
+	for _, id := range []string{"TV_1", "TV_2", "TV_3"} {
+		s.mustInvoke(orgTV, "registerProduct", "TV", id, "2020-05-20", "LCD_1")
+	}
+	s.mustInvoke(orgTV, "registerProduct", "Panel", "Panel_1", "2020-05-20", "LCD_1")
+
+	var ids []string
+	bookmark := ""
+	for {
+		var p struct {
+			Records  []ProductStock `json:"records"`
+			Bookmark string         `json:"bookmark"`
+		}
+		if err := json.Unmarshal(s.mustInvoke(orgTV, "getMyProductsPage", "TV", "2", bookmark), &p); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range p.Records {
+			ids = append(ids, r.ProductID)
+		}
+		if bookmark = p.Bookmark; bookmark == "" {
+			break
+		}
+	}
+	if len(ids) != 3 || ids[0] != "TV_1" || ids[2] != "TV_3" {
+		t.Fatalf("unexpected products %v", ids)
+	}
+}
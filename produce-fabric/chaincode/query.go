@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// 账本中JSON文档的类型，用于CouchDB富查询，见 META-INF/statedb/couchdb/indexes
+const (
+	DocTypeOrder   = "order"
+	DocTypeProduct = "product"
+)
+
+// 查询条件支持的比较运算
+var queryOperators = map[string]bool{"$eq": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true}
+
+// 允许出现在查询条件中的字段，值为字段是否为数字
+var (
+	orderQueryFields = map[string]bool{
+		"payer": false, "producer": false, "type": false, "createdAt": false, "deadline": false,
+		"status": true, "orderType": true,
+	}
+	productQueryFields = map[string]bool{
+		"owner": false, "producer": false, "productType": false, "batchID": false, "createdAt": false,
+	}
+)
+
+// queryCond 一个查询条件 field op value
+type queryCond struct {
+	field string
+	op    string
+	value interface{}
+}
+
+// ProductRecord 查询结果中的产品
+type ProductRecord struct {
+	ProductID string `json:"productID"`
+	*Product
+}
+
+// queryOrders 按条件查询订单，参数 [selector, pageSize, bookmark]。
+// selector为JSON对象，字段见orderQueryFields，值为相等比较或者 {"$gte": ..., "$lt": ...} 形式的范围，
+// 例如 {"type": "LCD", "createdAt": {"$gte": "2020-05-20T00:00:00Z"}}。
+// 只返回调用者作为下单者或供货商的订单，payment可以查询全部订单
+func (c *Contract) queryOrders(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 1 {
+		return shim.Error("invalid arguments")
+	}
+	conds, err := parseSelector(args[0], orderQueryFields)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, bookmark, err := parsePage(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	var parties []string
+	if !isAuditor(stub, role) {
+		parties = []string{"payer", "producer"}
+	}
+	keys, next, err := queryKeys(stub, PrefixOrder, DocTypeOrder, conds, role, parties, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	orders := []*Order{}
+	for _, key := range keys {
+		order, err := getOrderView(stub, key[len(PrefixOrder)+1:])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		orders = append(orders, order)
+	}
+	data, err := json.Marshal(Page{Records: orders, Count: len(orders), Bookmark: next})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+// queryProducts 按条件查询产品，参数同queryOrders，字段见productQueryFields。
+// 只有所有者本人和payment可以按owner查询，结果按调用者过滤字段，见productView
+func (c *Contract) queryProducts(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 1 {
+		return shim.Error("invalid arguments")
+	}
+	conds, err := parseSelector(args[0], productQueryFields)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, bookmark, err := parsePage(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	for _, cond := range conds {
+		if cond.field == "owner" && (cond.op != "$eq" || cond.value != role) && !isAuditor(stub, role) {
+			return shim.Error(fmt.Sprintf("permission denied for %s to query by owner", role))
+		}
+	}
+	keys, next, err := queryKeys(stub, PrefixProduct, DocTypeProduct, conds, role, nil, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	products := []*ProductRecord{}
+	for _, key := range keys {
+		id := key[len(PrefixProduct)+1:]
+		product, err := getProduct(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		products = append(products, &ProductRecord{ProductID: id, Product: productView(stub, product, role)})
+	}
+	data, err := json.Marshal(Page{Records: products, Count: len(products), Bookmark: next})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+// parseSelector 解析并校验查询条件，只允许白名单中的字段和比较运算
+func parseSelector(selector string, fields map[string]bool) ([]queryCond, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(selector), &m); err != nil {
+		return nil, fmt.Errorf("invalid selector %v", err)
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var conds []queryCond
+	for _, name := range names {
+		numeric, ok := fields[name]
+		if !ok {
+			return nil, fmt.Errorf("field %s is not allowed in selector", name)
+		}
+		ops, ok := m[name].(map[string]interface{})
+		if !ok {
+			ops = map[string]interface{}{"$eq": m[name]}
+		}
+		if len(ops) == 0 {
+			return nil, fmt.Errorf("empty condition for %s", name)
+		}
+		for op, value := range ops {
+			if !queryOperators[op] {
+				return nil, fmt.Errorf("operator %s is not allowed in selector", op)
+			}
+			if _, isNum := value.(float64); isNum != numeric {
+				return nil, fmt.Errorf("invalid value for %s, got %v", name, value)
+			}
+			if _, isStr := value.(string); !numeric && !isStr {
+				return nil, fmt.Errorf("invalid value for %s, got %v", name, value)
+			}
+			conds = append(conds, queryCond{field: name, op: op, value: value})
+		}
+	}
+	return conds, nil
+}
+
+// queryKeys 返回满足条件的一页记录的key。状态数据库为CouchDB时使用富查询，
+// 为LevelDB时按前缀顺序扫描并逐条匹配，bookmark为下一页的起始key。
+// parties不为空时，只返回其中任意一个字段等于role的记录
+func queryKeys(stub shim.ChaincodeStubInterface, prefix, docType string, conds []queryCond, role string, parties []string, pageSize int32, bookmark string) ([]string, string, error) {
+	query, err := couchQuery(docType, conds, role, parties)
+	if err != nil {
+		return nil, "", err
+	}
+	iter, meta, err := stub.GetQueryResultWithPagination(query, pageSize, bookmark)
+	if err == nil && iter != nil {
+		defer iter.Close()
+		var keys []string
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to get iter next %v", err)
+			}
+			keys = append(keys, kv.Key)
+		}
+		next := meta.GetBookmark()
+		if len(keys) < int(pageSize) {
+			next = ""
+		}
+		return keys, next, nil
+	}
+	if err != nil && !strings.Contains(err.Error(), "not supported for leveldb") {
+		return nil, "", fmt.Errorf("failed to query %v", err)
+	}
+
+	startKey := prefix + "-"
+	if bookmark != "" {
+		if !strings.HasPrefix(bookmark, startKey) {
+			return nil, "", fmt.Errorf("invalid bookmark, got %s", bookmark)
+		}
+		startKey = bookmark
+	}
+	// 这些都是 '%s-...' 形式的普通key，'.'紧跟在'-'之后
+	iter, err = stub.GetStateByRange(startKey, prefix+".")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get state by range %v", err)
+	}
+	defer iter.Close()
+	var keys []string
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get iter next %v", err)
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(kv.Value, &doc); err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal %s %v", docType, err)
+		}
+		if !matchDoc(doc, conds, role, parties) {
+			continue
+		}
+		if len(keys) == int(pageSize) {
+			return keys, kv.Key, nil
+		}
+		keys = append(keys, kv.Key)
+	}
+	return keys, "", nil
+}
+
+// couchQuery 生成CouchDB的查询语句，早期版本写入的文档没有docType，更新后才能被查询到
+func couchQuery(docType string, conds []queryCond, role string, parties []string) (string, error) {
+	selector := map[string]interface{}{"docType": docType}
+	for _, cond := range conds {
+		ops, ok := selector[cond.field].(map[string]interface{})
+		if !ok {
+			ops = make(map[string]interface{})
+			selector[cond.field] = ops
+		}
+		ops[cond.op] = cond.value
+	}
+	if len(parties) > 0 {
+		var or []interface{}
+		for _, party := range parties {
+			or = append(or, map[string]interface{}{party: role})
+		}
+		selector["$or"] = or
+	}
+	query, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query %v", err)
+	}
+	return string(query), nil
+}
+
+// matchDoc 在LevelDB上逐条匹配查询条件，与CouchDB一样按字符串或数字比较
+func matchDoc(doc map[string]interface{}, conds []queryCond, role string, parties []string) bool {
+	for _, cond := range conds {
+		c, ok := compareValue(doc[cond.field], cond.value)
+		if !ok {
+			return false
+		}
+		switch cond.op {
+		case "$eq":
+			ok = c == 0
+		case "$gt":
+			ok = c > 0
+		case "$gte":
+			ok = c >= 0
+		case "$lt":
+			ok = c < 0
+		case "$lte":
+			ok = c <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(parties) == 0 {
+		return true
+	}
+	for _, party := range parties {
+		if doc[party] == role {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValue 比较同类型的两个值，类型不同或者字段不存在时返回false
+func compareValue(a, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av < bv:
+			return -1, true
+		case av > bv:
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
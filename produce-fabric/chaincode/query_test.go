@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQueryOrders(t *testing.T) {
+	s := setupOrder(t)
+	first := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "10", "100")
+	s.now += 3600
+	second := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "5", "100")
+	s.mustInvoke(orgLCD, "acceptOrder", second.OrderID)
+
+	query := func(role, selector string, page ...string) Page {
+		t.Helper()
+		var records []*Order
+		p := Page{Records: &records}
+		if err := json.Unmarshal(s.mustInvoke(role, "queryOrders", append([]string{selector}, page...)...), &p); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0, len(records))
+		for _, o := range records {
+			ids = append(ids, o.OrderID)
+		}
+		p.Records = ids
+		return p
+	}
+	expect := func(p Page, ids ...string) {
+		t.Helper()
+		if fmt.Sprint(p.Records) != fmt.Sprint(ids) {
+			t.Fatalf("want %v, got %v", ids, p.Records)
+		}
+	}
+
+	expect(query(orgTV, `{"type": "LCD"}`), first.OrderID, second.OrderID)
+	expect(query(orgLCD, `{"status": 3}`), second.OrderID)
+	since := second.CreatedAt.Format(time.RFC3339)
+	expect(query(orgTV, fmt.Sprintf(`{"createdAt": {"$gte": %q}, "orderType": 0}`, since)), second.OrderID)
+	expect(query(orgTV, fmt.Sprintf(`{"createdAt": {"$lt": %q}}`, since)), first.OrderID)
+	// 只能查到自己参与的订单，payment可以查询全部
+	expect(query(orgStore, `{}`))
+	expect(query(orgPayment, `{"producer": "material.lcd"}`), first.OrderID, second.OrderID)
+
+	p := query(orgTV, `{}`, "1")
+	expect(p, first.OrderID)
+	p = query(orgTV, `{}`, "1", p.Bookmark)
+	expect(p, second.OrderID)
+	if p.Bookmark != "" {
+		t.Fatalf("unexpected bookmark %s", p.Bookmark)
+	}
+
+	for _, selector := range []string{`{"amount": "800"}`, `{"type": {"$regex": "L"}}`, `{"status": "3"}`, `{"type": 1}`, `[]`} {
+		s.mustFail(orgTV, "queryOrders", selector)
+	}
+}
+
+func TestQueryProducts(t *testing.T) {
+	s := newTestStub(t)
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1")
+	s.mustInvoke(orgPC, "registerProduct", "PC", "PC_1", "2020-05-20", "CPU_1")
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_2", "2020-05-21", "LCD_1")
+
+	var records []*ProductRecord
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "queryProducts", `{"productType": "TV", "batchID": {"$gte": "2020-05-21"}}`), &Page{Records: &records}); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ProductID != "TV_2" || records[0].Owner != "" {
+		t.Fatalf("unexpected products %+v", records)
+	}
+	s.mustFail(orgStore, "queryProducts", `{"owner": "product.tv"}`)
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "queryProducts", `{"owner": "product.tv"}`), &Page{Records: &records}); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].ProductID != "TV_2" || records[1].Owner != orgTV {
+		t.Fatalf("unexpected products %+v", records)
+	}
+}
+
+func TestCouchQuery(t *testing.T) {
+	conds, err := parseSelector(`{"type": "LCD", "createdAt": {"$gte": "2020-05-20T00:00:00Z"}}`, orderQueryFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := couchQuery(DocTypeOrder, conds, orgTV, []string{"payer", "producer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"selector":{"$or":[{"payer":"product.tv"},{"producer":"product.tv"}],"createdAt":{"$gte":"2020-05-20T00:00:00Z"},"docType":"order","type":{"$eq":"LCD"}}}`
+	if query != want {
+		t.Fatalf("unexpected query %s", query)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// Recall 物料批次的召回记录
+type Recall struct {
+	BatchID    string    `json:"batchID"`
+	Reason     string    `json:"reason"`
+	RecalledBy string    `json:"recalledBy"`
+	TxID       string    `json:"txID"`
+	Timestamp  time.Time `json:"timestamp"`
+	Products   []string  `json:"products"` //召回的产品ID
+}
+
+// recallBatch 召回有缺陷的物料批次，参数 [batchID, reason]，只有批次的生产者和管理员可以召回。
+// 通过溯源索引把使用了该批次的产品及装有这些产品的各级上级产品全部标记为已召回，
+// 并从所有者的库存中移除，之后不能再通过订单转移；
+// 按产品当前的所有者分别发出EvtProductRecalled事件
+func (c *Contract) recallBatch(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	batchID, reason := args[0], args[1]
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	material, err := getMaterialBatch(stub, batchID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if material == nil || material.Producer != role {
+		if _, err := requireAdmin(stub); err != nil {
+			return shim.Error(fmt.Sprintf("only the producer of batch(%s) or admin can recall, you are %s", batchID, role))
+		}
+	}
+	recall, err := getRecall(stub, batchID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if recall != nil {
+		return shim.Error(fmt.Sprintf("batch(%s) is already recalled", batchID))
+	}
+	t, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	recall = &Recall{
+		BatchID:    batchID,
+		Reason:     reason,
+		RecalledBy: role,
+		TxID:       stub.GetTxID(),
+		Timestamp:  time.Unix(t.GetSeconds(), 0),
+		Products:   []string{},
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(PrefixMaterialProduct, []string{batchID})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+	}
+	defer iter.Close()
+	owners := make(map[string][]string)
+	// 同一个交易中读不到刚写入的产品，用seen避免重复召回装有多个该批次子部件的上级产品
+	seen := make(map[string]bool)
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(attr) != 2 {
+			return shim.Error("internal key format wrong")
+		}
+		product, err := getProduct(stub, attr[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		// 装有该产品的各级上级产品一起召回
+		ancestors, parents, err := productAncestors(stub, product)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		ids := append([]string{attr[1]}, ancestors...)
+		products := append([]*Product{product}, parents...)
+		for i, id := range ids {
+			// 同时使用了多个被召回批次的产品只召回一次，已报废的产品不再流通，不需要召回
+			if seen[id] || products[i].Recalled || products[i].Scrapped {
+				continue
+			}
+			seen[id] = true
+			if err := recallProduct(stub, id, products[i]); err != nil {
+				return shim.Error(err.Error())
+			}
+			recall.Products = append(recall.Products, id)
+			owners[products[i].Owner] = append(owners[products[i].Owner], id)
+		}
+	}
+
+	val, err := json.Marshal(recall)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal recall %v", err))
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixRecall, batchID), val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	}
+	names := make([]string, 0, len(owners))
+	for owner := range owners {
+		names = append(names, owner)
+	}
+	sort.Strings(names)
+	for _, owner := range names {
+		evtData, err := json.Marshal(map[string]interface{}{
+			"batchID":  batchID,
+			"owner":    owner,
+			"products": owners[owner],
+			"reason":   reason,
+		})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to marshal event data %v", err))
+		}
+		if err := stub.SetEvent("EvtProductRecalled", evtData); err != nil {
+			return shim.Error(fmt.Sprintf("failed to set event %v", err))
+		}
+	}
+	if err := stub.SetEvent("EvtBatchRecalled", val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(val)
+}
+
+// getRecall 查询批次的召回记录
+func (c *Contract) getRecall(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	recall, err := getRecall(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if recall == nil {
+		return shim.Error(fmt.Sprintf("batch(%s) is not recalled", args[0]))
+	}
+	data, err := json.Marshal(recall)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal recall %v", err))
+	}
+	return shim.Success(data)
+}
+
+// getRecall 读取批次的召回记录，没有召回时返回nil
+func getRecall(stub shim.ChaincodeStubInterface, batchID string) (*Recall, error) {
+	val, err := stub.GetState(fmt.Sprintf("%s-%s", PrefixRecall, batchID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state %v", err)
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	var recall Recall
+	if err := json.Unmarshal(val, &recall); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal recall %v", err)
+	}
+	return &recall, nil
+}
+
+// recallProduct 将产品标记为已召回，并从所有者的库存中移除
+func recallProduct(stub shim.ChaincodeStubInterface, id string, product *Product) error {
+	product.Recalled = true
+	product.Action = ProductActionRecalled
+	product.OrderID = ""
+	product.DocType = DocTypeProduct
+	val, err := json.Marshal(product)
+	if err != nil {
+		return fmt.Errorf("failed to marshal product %w", err)
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixProduct, id), val); err != nil {
+		return fmt.Errorf("failed to put state %w", err)
+	}
+	ppkey, err := productStockKey(stub, product, id)
+	if err != nil {
+		return fmt.Errorf("failed to create ppkey %w", err)
+	}
+	if err := stub.DelState(ppkey); err != nil {
+		return fmt.Errorf("failed to del state %w", err)
+	}
+	return nil
+}
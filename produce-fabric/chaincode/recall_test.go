@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRecallBatch(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1")
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_2", "2020-05-20", "LCD_1", "Audio_1")
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_3", "2020-05-20", "Audio_1")
+	order := s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "1", "3000")
+	s.shipOrder(orgTV, order.OrderID)
+	s.mustInvoke(orgStore, "confirmOrder", order.OrderID)
+
+	// 只有批次的生产者和管理员可以召回
+	s.mustFail(orgAudio, "recallBatch", "LCD_1", "screen defect")
+	s.mustInvoke(orgLCD, "recallBatch", "LCD_1", "screen defect")
+	s.expectEvents("EvtProductRecalled", "EvtProductRecalled", "EvtBatchRecalled")
+	var evt struct {
+		Owner    string   `json:"owner"`
+		Products []string `json:"products"`
+	}
+	s.expectEvent("EvtProductRecalled", &evt)
+	if evt.Owner != orgTV || len(evt.Products) != 1 || evt.Products[0] != "TV_2" {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+	s.mustFail(orgLCD, "recallBatch", "LCD_1", "screen defect")
+
+	var recall Recall
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "getRecall", "LCD_1"), &recall); err != nil {
+		t.Fatal(err)
+	}
+	if recall.RecalledBy != orgLCD || len(recall.Products) != 2 {
+		t.Fatalf("unexpected recall %+v", recall)
+	}
+	var product Product
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "getProduct", "TV_1"), &product); err != nil {
+		t.Fatal(err)
+	}
+	if !product.Recalled || product.Action != ProductActionRecalled {
+		t.Fatalf("unexpected product %+v", product)
+	}
+
+	// 召回的产品移出库存，不能再通过订单转移，召回的批次不能再用于生产
+	s.expectProducts(orgTV, map[string]uint64{"TV": 1})
+	s.expectProducts(orgStore, map[string]uint64{})
+	order = s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "1", "3000")
+	s.shipOrder(orgTV, order.OrderID)
+	s.mustInvoke(orgStore, "confirmOrder", order.OrderID)
+	s.expectEvent("EvtProductOwnerChanged", &evt)
+	s.mustFail(orgTV, "registerProduct", "TV", "TV_4", "2020-05-21", "LCD_1")
+
+	// 批次信息不在链上时只有管理员可以召回，已召回的产品不重复召回
+	s.mustFail(orgAudio, "recallBatch", "Audio_1", "noise")
+	s.mustInvoke(orgPayment, "recallBatch", "Audio_1", "noise")
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "getRecall", "Audio_1"), &recall); err != nil {
+		t.Fatal(err)
+	}
+	if len(recall.Products) != 1 || recall.Products[0] != "TV_3" {
+		t.Fatalf("unexpected recall %+v", recall)
+	}
+}
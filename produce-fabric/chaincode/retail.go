@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// transientSecret 生产者的防伪密钥通过注册产品交易的transient字段传入，不会写入账本
+const transientSecret = "secret"
+
+// transientCode 消费者验证产品时防伪码通过transient字段传入，不会写入区块
+const transientCode = "code"
+
+// ScanStats 产品防伪码的验证次数，同一个产品被大量验证说明产品ID可能被仿冒
+type ScanStats struct {
+	Count       uint64    `json:"count"`
+	FirstScanAt time.Time `json:"firstScanAt"`
+	LastScanAt  time.Time `json:"lastScanAt"`
+}
+
+// Verification 消费者验证产品的结果，防伪码不正确时只返回Genuine=false
+type Verification struct {
+	ProductID string     `json:"productID"`
+	Genuine   bool       `json:"genuine"`
+	Product   *Product   `json:"product,omitempty"`
+	Scans     *ScanStats `json:"scans,omitempty"`
+}
+
+// verificationCode 由生产者的密钥和产品ID生成防伪码: HMAC-SHA256(secret, productID)的前16个十六进制字符，
+// 生产者线下用同样的方法生成防伪码并印在产品标签上
+func verificationCode(secret []byte, productID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(productID))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// verifyHash 账本中只保存防伪码的sha256
+func verifyHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// getVerifyHash 读取transient中的防伪密钥，返回产品防伪码的哈希，没有密钥时为空
+func getVerifyHash(stub shim.ChaincodeStubInterface, productID string) (string, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get transient %v", err)
+	}
+	secret, ok := transient[transientSecret]
+	if !ok {
+		return "", nil
+	}
+	if len(secret) == 0 {
+		return "", fmt.Errorf("%s in transient is empty", transientSecret)
+	}
+	return verifyHash(verificationCode(secret, productID)), nil
+}
+
+// sellToConsumer 所有者或保管产品的门店把产品卖给最终消费者，参数 [productID]。
+// 售出的产品从库存中移除，不能再通过订单转移，召回时仍会通知售出的组织
+func (c *Contract) sellToConsumer(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	id := args[0]
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	product, err := getProduct(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if product.Owner != role && product.Custodian != role {
+		return shim.Error(fmt.Sprintf("only the owner or custodian of product(%s) can sell it", id))
+	}
+	switch {
+	case product.Sold:
+		return shim.Error(fmt.Sprintf("product(%s) is already sold", id))
+	case product.Recalled:
+		return shim.Error(fmt.Sprintf("product(%s) is recalled", id))
+	case product.Scrapped:
+		return shim.Error(fmt.Sprintf("product(%s) is scrapped", id))
+	case product.IncorporatedInto != "":
+		return shim.Error(fmt.Sprintf("product(%s) is incorporated into %s", id, product.IncorporatedInto))
+	}
+	t, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	soldAt := time.Unix(t.GetSeconds(), 0)
+	product.Sold = true
+	product.SoldAt = &soldAt
+	product.Action = ProductActionSold
+	product.OrderID = ""
+	product.DocType = DocTypeProduct
+	val, err := json.Marshal(product)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal product %v", err))
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixProduct, id), val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	}
+	ppkey, err := productStockKey(stub, product, id)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to create ppkey %v", err))
+	}
+	if err := stub.DelState(ppkey); err != nil {
+		return shim.Error(fmt.Sprintf("failed to del state %v", err))
+	}
+	evtData, err := json.Marshal(map[string]interface{}{
+		"id":     id,
+		"seller": role,
+		"soldAt": soldAt,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal event data %v", err))
+	}
+	if err := stub.SetEvent("EvtProductSold", evtData); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// verifyProduct 消费者验证产品真伪，参数 [productID]，防伪码在transient的code中，任何身份都可以调用。
+// 防伪码正确时返回产品的公开信息(生产者、批号、物料批次、是否售出或召回)并累加验证次数，
+// 需要提交交易才会记录验证次数，只做查询时返回的是之前的次数加一
+func (c *Contract) verifyProduct(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	id := args[0]
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get transient %v", err))
+	}
+	code := string(transient[transientCode])
+	if code == "" {
+		return shim.Error(fmt.Sprintf("%s in transient is empty", transientCode))
+	}
+	result := Verification{ProductID: id}
+	val, err := stub.GetState(fmt.Sprintf("%s-%s", PrefixProduct, id))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state %v", err))
+	}
+	var product Product
+	if len(val) > 0 {
+		if err := json.Unmarshal(val, &product); err != nil {
+			return shim.Error(fmt.Sprintf("failed to unmarshal product %v", err))
+		}
+		result.Genuine = product.VerifyHash != "" &&
+			hmac.Equal([]byte(product.VerifyHash), []byte(verifyHash(code)))
+	}
+	if result.Genuine {
+		t, err := stub.GetTxTimestamp()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		now := time.Unix(t.GetSeconds(), 0)
+		key := fmt.Sprintf("%s-%s", PrefixProductScan, id)
+		stats, err := getScanStats(stub, key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if stats.Count == 0 {
+			stats.FirstScanAt = now
+		}
+		stats.Count++
+		stats.LastScanAt = now
+		sval, err := json.Marshal(stats)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to marshal scan stats %v", err))
+		}
+		if err := stub.PutState(key, sval); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put state %v", err))
+		}
+		result.Product = &Product{
+			Producer:        product.Producer,
+			CreatedAt:       product.CreatedAt,
+			BatchID:         product.BatchID,
+			MaterialBatches: product.MaterialBatches,
+			ProductType:     product.ProductType,
+			Recalled:        product.Recalled,
+			Sold:            product.Sold,
+			SoldAt:          product.SoldAt,
+		}
+		result.Scans = stats
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+func getScanStats(stub shim.ChaincodeStubInterface, key string) (*ScanStats, error) {
+	val, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state %v", err)
+	}
+	var stats ScanStats
+	if len(val) == 0 {
+		return &stats, nil
+	}
+	if err := json.Unmarshal(val, &stats); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scan stats %v", err)
+	}
+	return &stats, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSellAndVerifyProduct(t *testing.T) {
+	s := setupOrder(t)
+	secret := map[string]string{transientSecret: "tv-secret"}
+	if res := s.invokeWithTransient(orgTV, secret, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1"); res.Status != 200 {
+		t.Fatal(res.Message)
+	}
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_2", "2020-05-20", "LCD_1")
+	order := s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "1", "3000")
+	s.shipOrder(orgTV, order.OrderID)
+	s.mustInvoke(orgStore, "confirmOrder", order.OrderID)
+
+	// 只有所有者可以售出，售出后移出库存，不能再转移
+	s.mustFail(orgTV, "sellToConsumer", "TV_1")
+	s.mustInvoke(orgStore, "sellToConsumer", "TV_1")
+	s.expectEvents("EvtProductSold")
+	s.mustFail(orgStore, "sellToConsumer", "TV_1")
+	s.expectProducts(orgStore, map[string]uint64{})
+
+	verify := func(id, code string) Verification {
+		t.Helper()
+		res := s.invokeWithTransient(orgAudio, map[string]string{transientCode: code}, "verifyProduct", id)
+		if res.Status != 200 {
+			t.Fatal(res.Message)
+		}
+		var v Verification
+		if err := json.Unmarshal(res.Payload, &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// 防伪码只能通过transient传入
+	s.mustFail(orgAudio, "verifyProduct", "TV_1")
+	s.mustFail(orgAudio, "verifyProduct", "TV_1", verificationCode([]byte("tv-secret"), "TV_1"))
+	code := verificationCode([]byte("tv-secret"), "TV_1")
+	if v := verify("TV_1", "0123456789abcdef"); v.Genuine || v.Product != nil {
+		t.Fatalf("unexpected verification %+v", v)
+	}
+	if v := verify("TV_9", code); v.Genuine {
+		t.Fatalf("unexpected verification %+v", v)
+	}
+	// 注册时没有密钥的产品不能验证
+	if v := verify("TV_2", verificationCode([]byte("tv-secret"), "TV_2")); v.Genuine {
+		t.Fatalf("unexpected verification %+v", v)
+	}
+	verify("TV_1", code)
+	v := verify("TV_1", code)
+	if !v.Genuine || v.Scans.Count != 2 || v.Product.Producer != orgTV || !v.Product.Sold ||
+		v.Product.Owner != "" || len(v.Product.MaterialBatches) != 1 {
+		t.Fatalf("unexpected verification %+v", v)
+	}
+	if !v.Scans.FirstScanAt.Before(v.Scans.LastScanAt) {
+		t.Fatalf("unexpected scans %+v", v.Scans)
+	}
+}
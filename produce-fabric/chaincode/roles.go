@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// 组织的角色
+const (
+	RoleMaterialProducer = "material" // 物料供货商
+	RoleProductProducer  = "product"  // 产品生产商
+	RolePayment          = "payment"  // 结算方，负责发行和销毁资金，设置补偿比例，可以查看全部数据
+	RoleStore            = "store"    // 门店/仓库，保管其他组织寄存的货物，所有权不变
+)
+
+var roleNames = map[string]string{
+	RoleMaterialProducer: "material producer",
+	RoleProductProducer:  "product producer",
+	RolePayment:          "payment",
+	RoleStore:            "store",
+}
+
+// legacyAdmin 没有创世配置的账本(早期版本)中的管理员组织
+const legacyAdmin = "payment"
+
+// Genesis Init时传入的创世配置
+type Genesis struct {
+	Admin            string              `json:"admin"`                      //管理员组织，负责修改组织的角色
+	Roles            map[string][]string `json:"roles"`                      //组织 => 角色列表
+	CancelCompensate *int                `json:"cancelCompensate,omitempty"` //下单者取消订单时，补偿给供货商的比例，百分比
+	Decimals         *int                `json:"decimals,omitempty"`         //货币的小数位数，设置后不能修改
+	AccountMode      string              `json:"accountMode,omitempty"`      //记账方式，org(默认)或identity
+}
+
+// initGenesis 保存创世配置。链码升级时再次执行Init，此时只有当前管理员可以修改配置，
+// 角色按组织覆盖，配置中没有出现的组织保持不变
+func initGenesis(stub shim.ChaincodeStubInterface, data string) error {
+	var genesis Genesis
+	if err := json.Unmarshal([]byte(data), &genesis); err != nil {
+		return fmt.Errorf("invalid genesis config %v", err)
+	}
+	if genesis.Admin == "" {
+		return fmt.Errorf("admin is empty")
+	}
+	current, err := stub.GetState(PrefixOwner)
+	if err != nil {
+		return fmt.Errorf("failed to get state %v", err)
+	}
+	if len(current) > 0 {
+		caller, err := cid.GetMSPID(stub)
+		if err != nil {
+			return fmt.Errorf("failed to get role %v", err)
+		}
+		if caller != string(current) {
+			return fmt.Errorf("only the admin %s can change genesis config, you are %s", current, caller)
+		}
+	}
+	if err := stub.PutState(PrefixOwner, []byte(genesis.Admin)); err != nil {
+		return fmt.Errorf("failed to put state %v", err)
+	}
+	for org, roles := range genesis.Roles {
+		if _, err := putRoles(stub, org, roles); err != nil {
+			return err
+		}
+	}
+	if genesis.CancelCompensate != nil {
+		if *genesis.CancelCompensate < 0 || *genesis.CancelCompensate > 100 {
+			return fmt.Errorf("cancel compensate invlaid got %d", *genesis.CancelCompensate)
+		}
+		if err := stub.PutState(PrefixCancelCompensate, []byte{byte(*genesis.CancelCompensate)}); err != nil {
+			return fmt.Errorf("failed to put state %v", err)
+		}
+	}
+	if genesis.Decimals != nil {
+		if err := initDecimals(stub, strconv.Itoa(*genesis.Decimals)); err != nil {
+			return err
+		}
+	}
+	if genesis.AccountMode != "" {
+		if err := putAccountMode(stub, genesis.AccountMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getAdmin 返回管理员组织，bool表示账本中是否有创世配置
+func getAdmin(stub shim.ChaincodeStubInterface) (string, bool, error) {
+	val, err := stub.GetState(PrefixOwner)
+	if err != nil {
+		return "", false, err
+	}
+	if len(val) == 0 {
+		return legacyAdmin, false, nil
+	}
+	return string(val), true, nil
+}
+
+// hasRole 组织是否拥有某个角色。没有创世配置的账本沿用早期版本按MSP ID判断的规则
+func hasRole(stub shim.ChaincodeStubInterface, org, role string) (bool, error) {
+	_, configured, err := getAdmin(stub)
+	if err != nil {
+		return false, err
+	}
+	if !configured {
+		switch role {
+		case RoleMaterialProducer:
+			return strings.HasPrefix(org, "material."), nil
+		case RoleProductProducer:
+			return strings.HasPrefix(org, "product."), nil
+		case RolePayment:
+			return org == "payment", nil
+		case RoleStore:
+			return org == "store" || strings.HasPrefix(org, "store."), nil
+		}
+		return false, nil
+	}
+	roles, err := getRoles(stub, org)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range roles {
+		if r == role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isKnownOrg 组织是否拥有任意一个角色，没有创世配置时按MSP ID判断
+func isKnownOrg(stub shim.ChaincodeStubInterface, org string) (bool, error) {
+	for role := range roleNames {
+		ok, err := hasRole(stub, org, role)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// requireRole 检查调用者拥有某个角色，返回调用者的组织
+func requireRole(stub shim.ChaincodeStubInterface, role string) (string, error) {
+	org, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", fmt.Errorf("failed to get role %v", err)
+	}
+	ok, err := hasRole(stub, org, role)
+	if err != nil {
+		return "", fmt.Errorf("failed to get roles %v", err)
+	}
+	if !ok {
+		return "", fmt.Errorf("only for %s, got %s", roleNames[role], org)
+	}
+	return org, nil
+}
+
+// isAuditor 组织是否可以查看全部数据，查询失败时按没有权限处理
+func isAuditor(stub shim.ChaincodeStubInterface, org string) bool {
+	ok, err := hasRole(stub, org, RolePayment)
+	return err == nil && ok
+}
+
+// requireAdmin 检查调用者是管理员
+func requireAdmin(stub shim.ChaincodeStubInterface) (string, error) {
+	org, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", fmt.Errorf("failed to get role %v", err)
+	}
+	admin, _, err := getAdmin(stub)
+	if err != nil {
+		return "", fmt.Errorf("failed to get admin %v", err)
+	}
+	if org != admin {
+		return "", fmt.Errorf("only for admin, got %s", org)
+	}
+	return org, nil
+}
+
+func getRoles(stub shim.ChaincodeStubInterface, org string) ([]string, error) {
+	val, err := stub.GetState(fmt.Sprintf("%s-%s", PrefixRole, org))
+	if err != nil {
+		return nil, err
+	}
+	var roles []string
+	if len(val) == 0 {
+		return roles, nil
+	}
+	if err := json.Unmarshal(val, &roles); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal roles %v", err)
+	}
+	return roles, nil
+}
+
+// putRoles 去重排序后保存组织的角色，返回保存的角色列表，列表为空时删除
+func putRoles(stub shim.ChaincodeStubInterface, org string, roles []string) ([]string, error) {
+	if org == "" {
+		return nil, fmt.Errorf("org is empty")
+	}
+	set := make(map[string]bool)
+	for _, r := range roles {
+		if _, ok := roleNames[r]; !ok {
+			return nil, fmt.Errorf("unknown role %s", r)
+		}
+		set[r] = true
+	}
+	sorted := make([]string, 0, len(set))
+	for r := range set {
+		sorted = append(sorted, r)
+	}
+	sort.Strings(sorted)
+	key := fmt.Sprintf("%s-%s", PrefixRole, org)
+	if len(sorted) == 0 {
+		return sorted, stub.DelState(key)
+	}
+	val, err := json.Marshal(sorted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal roles %v", err)
+	}
+	return sorted, stub.PutState(key, val)
+}
+
+// setRole 管理员为组织增加角色，参数 [org, role...]
+func (c *Contract) setRole(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return changeRoles(stub, args, func(roles []string) []string {
+		return append(roles, args[1:]...)
+	})
+}
+
+// revokeRole 管理员撤销组织的角色，参数 [org, role...]
+func (c *Contract) revokeRole(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return changeRoles(stub, args, func(roles []string) []string {
+		var kept []string
+		for _, r := range roles {
+			revoked := false
+			for _, revoke := range args[1:] {
+				revoked = revoked || r == revoke
+			}
+			if !revoked {
+				kept = append(kept, r)
+			}
+		}
+		return kept
+	})
+}
+
+func changeRoles(stub shim.ChaincodeStubInterface, args []string, change func([]string) []string) peer.Response {
+	if len(args) < 2 {
+		return shim.Error("invalid arguments")
+	}
+	if _, err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, configured, err := getAdmin(stub); err != nil || !configured {
+		return shim.Error("genesis config is not set, upgrade chaincode with a genesis config first")
+	}
+	org := args[0]
+	roles, err := getRoles(stub, org)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// 同一交易内读不到自己的写入，事件使用putRoles整理后的角色列表
+	if roles, err = putRoles(stub, org, change(roles)); err != nil {
+		return shim.Error(err.Error())
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"org":   org,
+		"roles": roles,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal event data %v", err))
+	}
+	if err := stub.SetEvent("EvtRoleChanged", data); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// getConfig 查询管理员、组织的角色和参数
+func (c *Contract) getConfig(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	admin, _, err := getAdmin(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get admin %v", err))
+	}
+	genesis := Genesis{Admin: admin, Roles: make(map[string][]string)}
+	iter, err := stub.GetStateByRange(PrefixRole+"-", PrefixRole+".")
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state by range %v", err))
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+		}
+		var roles []string
+		if err := json.Unmarshal(kv.Value, &roles); err != nil {
+			return shim.Error(fmt.Sprintf("failed to unmarshal roles %v", err))
+		}
+		genesis.Roles[kv.Key[len(PrefixRole)+1:]] = roles
+	}
+	if val, err := stub.GetState(PrefixCancelCompensate); err == nil && len(val) == 1 {
+		compensate := int(val[0])
+		genesis.CancelCompensate = &compensate
+	}
+	if val, err := stub.GetState(PrefixDecimals); err == nil && len(val) == 1 {
+		decimals := int(val[0])
+		genesis.Decimals = &decimals
+	}
+	if genesis.AccountMode, err = getAccountMode(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to get account mode %v", err))
+	}
+	data, err := json.Marshal(genesis)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal config %v", err))
+	}
+	return shim.Success(data)
+}
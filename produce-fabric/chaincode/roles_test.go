@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testGenesis = `{
+	"admin": "payment",
+	"roles": {
+		"material.lcd": ["material"],
+		"product.tv": ["product"],
+		"payment": ["payment"]
+	},
+	"cancelCompensate": 50,
+	"decimals": 2
+}`
+
+func TestGenesis(t *testing.T) {
+	s := newTestStub(t)
+	if res := s.init(orgPayment, testGenesis); res.Status != 200 {
+		t.Fatalf("init failed: %s", res.Message)
+	}
+	var config Genesis
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "getConfig"), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Admin != orgPayment || len(config.Roles) != 3 || config.Roles[orgLCD][0] != RoleMaterialProducer ||
+		*config.CancelCompensate != 50 || *config.Decimals != 2 {
+		t.Fatalf("unexpected config %+v", config)
+	}
+
+	// 角色以账本为准，不再按MSP ID判断
+	s.mustInvoke(orgLCD, "setMaterialPrice", "LCD", "100")
+	if msg := s.mustFail(orgAudio, "setMaterialPrice", "Audio", "100"); !strings.Contains(msg, "only for material producer") {
+		t.Fatalf("unexpected error %s", msg)
+	}
+	s.mustFail(orgLCD, "setProductPrice", "TV", "100")
+	s.mustFail(orgTV, "mint", orgTV, "100")
+
+	// 新增供货商不需要修改链码
+	const orgNew = "supplier.glass"
+	s.mustFail(orgNew, "registerMaterial", "Glass", "10", "GLASS_1")
+	s.mustFail(orgTV, "setRole", orgNew, RoleMaterialProducer)
+	s.mustFail(orgPayment, "setRole", orgNew, "boss")
+	s.mustInvoke(orgPayment, "setRole", orgNew, RoleMaterialProducer, RoleMaterialProducer)
+	var evt struct {
+		Org   string   `json:"org"`
+		Roles []string `json:"roles"`
+	}
+	s.expectEvent("EvtRoleChanged", &evt)
+	if evt.Org != orgNew || len(evt.Roles) != 1 || evt.Roles[0] != RoleMaterialProducer {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+	s.mustInvoke(orgNew, "registerMaterial", "Glass", "10", "GLASS_1")
+
+	s.mustInvoke(orgPayment, "revokeRole", orgLCD, RoleMaterialProducer)
+	s.mustFail(orgLCD, "registerMaterial", "LCD", "10", "LCD_1")
+
+	// 升级时只有管理员可以修改配置，小数位数不能修改
+	if res := s.init(orgTV, testGenesis); res.Status == 200 {
+		t.Fatal("init by non-admin should fail")
+	}
+	if res := s.init(orgPayment, strings.Replace(testGenesis, `"decimals": 2`, `"decimals": 3`, 1)); res.Status == 200 {
+		t.Fatal("decimals should not change")
+	}
+	if res := s.init(orgPayment, strings.Replace(testGenesis, `"admin": "payment"`, `"admin": "store"`, 1)); res.Status != 200 {
+		t.Fatalf("init failed: %s", res.Message)
+	}
+	s.mustFail(orgPayment, "setRole", orgNew, RoleProductProducer)
+	s.mustInvoke(orgStore, "setRole", orgNew, RoleProductProducer)
+}
+
+func TestLegacyRoles(t *testing.T) {
+	s := newTestStub(t)
+	// 没有创世配置时沿用按MSP ID判断的规则，不能修改角色
+	s.mustInvoke(orgLCD, "setMaterialPrice", "LCD", "100")
+	s.mustFail(orgStore, "setMaterialPrice", "LCD", "100")
+	s.mustFail(orgPayment, "setRole", orgStore, RoleMaterialProducer)
+	if res := s.init(orgPayment, "abc"); res.Status == 200 {
+		t.Fatal("invalid init args should fail")
+	}
+}
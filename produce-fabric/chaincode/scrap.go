@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// 报废产品和核销物料的原因
+const (
+	ScrapReasonDamaged   = "damaged"   // 损坏
+	ScrapReasonDefective = "defective" // 质量缺陷
+	ScrapReasonExpired   = "expired"   // 过期
+	ScrapReasonLost      = "lost"      // 丢失
+	ScrapReasonRetired   = "retired"   // 达到使用寿命，退役
+	ScrapReasonOther     = "other"     // 其他，需要在备注中说明
+)
+
+var scrapReasons = map[string]bool{
+	ScrapReasonDamaged: true, ScrapReasonDefective: true, ScrapReasonExpired: true,
+	ScrapReasonLost: true, ScrapReasonRetired: true, ScrapReasonOther: true,
+}
+
+// WriteOff 物料核销记录
+type WriteOff struct {
+	Owner        string    `json:"owner"`
+	MaterialType string    `json:"materialType"`
+	BatchID      string    `json:"batchID"`
+	Num          uint64    `json:"num"`
+	Reason       string    `json:"reason"`
+	Note         string    `json:"note,omitempty"`
+	TxID         string    `json:"txID"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// parseScrapReason 校验原因代码，原因为other时备注不能为空
+func parseScrapReason(args []string) (string, string, error) {
+	reason, note := args[0], ""
+	if len(args) > 1 {
+		note = args[1]
+	}
+	if !scrapReasons[reason] {
+		return "", "", fmt.Errorf("invalid reason, got %s", reason)
+	}
+	if reason == ScrapReasonOther && note == "" {
+		return "", "", fmt.Errorf("note is required for reason %s", reason)
+	}
+	return reason, note, nil
+}
+
+// scrapProduct 所有者报废产品，参数 [productID, reason, note]，note可选。
+// 报废的产品从库存中移除，不能再转移，溯源和历史中仍然可见；已召回的产品也可以报废
+func (c *Contract) scrapProduct(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 2 || len(args) > 3 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	id := args[0]
+	reason, note, err := parseScrapReason(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	product, err := getProduct(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if product.Owner != role {
+		return shim.Error(fmt.Sprintf("only the owner of product(%s) can scrap it", id))
+	}
+	if product.Scrapped {
+		return shim.Error(fmt.Sprintf("product(%s) is already scrapped", id))
+	}
+	if product.IncorporatedInto != "" {
+		return shim.Error(fmt.Sprintf("product(%s) is incorporated into %s", id, product.IncorporatedInto))
+	}
+	product.Scrapped = true
+	product.ScrapReason = reason
+	product.Action = ProductActionScrapped
+	product.OrderID = ""
+	product.DocType = DocTypeProduct
+	val, err := json.Marshal(product)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal product %v", err))
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixProduct, id), val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	}
+	ppkey, err := productStockKey(stub, product, id)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to create ppkey %v", err))
+	}
+	if err := stub.DelState(ppkey); err != nil {
+		return shim.Error(fmt.Sprintf("failed to del state %v", err))
+	}
+	evtData, err := json.Marshal(map[string]interface{}{
+		"id":     id,
+		"owner":  role,
+		"reason": reason,
+		"note":   note,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal event data %v", err))
+	}
+	if err := stub.SetEvent("EvtProductScrapped", evtData); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(val)
+}
+
+// writeOffMaterial 核销调用者持有的某个批次的物料，参数 [batchID, num, reason, note]，note可选。
+// 核销的物料从库存中扣除，不能再转移或消耗，批次信息中累计核销数量，核销记录可用getWriteOffs查询
+func (c *Contract) writeOffMaterial(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 3 || len(args) > 4 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	batchID := args[0]
+	num, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil || num == 0 {
+		return shim.Error(fmt.Sprintf("invalid num, got %s", args[1]))
+	}
+	reason, note, err := parseScrapReason(args[2:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	material, err := getMaterialBatch(stub, batchID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if material == nil {
+		return shim.Error(fmt.Sprintf("batch(%s) does not exist", batchID))
+	}
+	mpkey, err := stub.CreateCompositeKey(PrefixMaterialPreserve, []string{role, material.MaterialType, batchID})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to create key, %v", err))
+	}
+	val, err := stub.GetState(mpkey)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+	}
+	keptNum := bytesToUint64(val)
+	if keptNum < num {
+		return shim.Error(fmt.Sprintf("insufficient materials, %d less", num-keptNum))
+	}
+	if keptNum == num {
+		err = stub.DelState(mpkey)
+	} else {
+		err = stub.PutState(mpkey, uint64ToBytes(keptNum-num))
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state, %v", err))
+	}
+
+	material.WrittenOff += num
+	mbval, err := json.Marshal(material)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal material, %v", err))
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixMaterialBatchInfo, batchID), mbval); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state, %v", err))
+	}
+	t, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	writeOff := WriteOff{
+		Owner:        role,
+		MaterialType: material.MaterialType,
+		BatchID:      batchID,
+		Num:          num,
+		Reason:       reason,
+		Note:         note,
+		TxID:         stub.GetTxID(),
+		Timestamp:    time.Unix(t.GetSeconds(), 0),
+	}
+	woval, err := json.Marshal(writeOff)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal write-off, %v", err))
+	}
+	wokey, err := stub.CreateCompositeKey(PrefixMaterialWriteOff, []string{batchID, writeOff.TxID})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to create key, %v", err))
+	}
+	if err := stub.PutState(wokey, woval); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state, %v", err))
+	}
+	if err := stub.SetEvent("EvtMaterialWrittenOff", woval); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event, %v", err))
+	}
+	return shim.Success(woval)
+}
+
+// getWriteOffs 查询批次的核销记录，参数 [batchID]
+func (c *Contract) getWriteOffs(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 || args[0] == "" {
+		return shim.Error("invalid arguments")
+	}
+	iter, err := stub.GetStateByPartialCompositeKey(PrefixMaterialWriteOff, []string{args[0]})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+	}
+	defer iter.Close()
+	writeOffs := []WriteOff{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+		}
+		var writeOff WriteOff
+		if err := json.Unmarshal(kv.Value, &writeOff); err != nil {
+			return shim.Error(fmt.Sprintf("failed to unmarshal write-off %v", err))
+		}
+		writeOffs = append(writeOffs, writeOff)
+	}
+	data, err := json.Marshal(writeOffs)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
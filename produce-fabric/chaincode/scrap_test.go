@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestScrapProduct(t *testing.T) {
+	s := setupOrder(t)
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_1", "2020-05-20", "LCD_1")
+	s.mustInvoke(orgTV, "registerProduct", "TV", "TV_2", "2020-05-20", "LCD_1")
+
+	s.mustFail(orgStore, "scrapProduct", "TV_1", ScrapReasonDamaged)
+	s.mustFail(orgTV, "scrapProduct", "TV_1", "broken")
+	s.mustFail(orgTV, "scrapProduct", "TV_1", ScrapReasonOther)
+	s.mustInvoke(orgTV, "scrapProduct", "TV_1", ScrapReasonDamaged, "dropped in warehouse")
+	s.expectEvents("EvtProductScrapped")
+	s.mustFail(orgTV, "scrapProduct", "TV_1", ScrapReasonDamaged)
+	s.expectProducts(orgTV, map[string]uint64{"TV": 1})
+
+	// 报废的产品不能再通过订单转移
+	order := s.makeOrder(orgStore, "makeProductOrder", orgTV, "TV", "2", "3000")
+	s.shipOrder(orgTV, order.OrderID)
+	s.mustFail(orgStore, "confirmOrder", order.OrderID)
+	s.mustInvoke(orgStore, "confirmOrder", order.OrderID, "1")
+	s.expectProducts(orgStore, map[string]uint64{"TV": 1})
+
+	// 溯源和历史中仍然可见
+	var page struct {
+		Records []string `json:"records"`
+	}
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "traceMaterialBatch", "LCD_1"), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 2 {
+		t.Fatalf("unexpected trace %v", page.Records)
+	}
+	var history []ProductHistory
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "getProductHistory", "TV_1"), &history); err != nil {
+		t.Fatal(err)
+	}
+	last := history[len(history)-1]
+	if len(history) != 2 || last.Action != ProductActionScrapped || last.Product.ScrapReason != ScrapReasonDamaged {
+		t.Fatalf("unexpected history %+v", history)
+	}
+}
+
+func TestWriteOffMaterial(t *testing.T) {
+	s := setupOrder(t)
+	s.mustFail(orgLCD, "writeOffMaterial", "LCD_1", "0", ScrapReasonExpired)
+	s.mustFail(orgLCD, "writeOffMaterial", "LCD_1", "301", ScrapReasonExpired)
+	s.mustFail(orgTV, "writeOffMaterial", "LCD_1", "1", ScrapReasonExpired)
+	s.mustFail(orgLCD, "writeOffMaterial", "LCD_2", "1", ScrapReasonExpired)
+	s.mustInvoke(orgLCD, "writeOffMaterial", "LCD_1", "280", ScrapReasonExpired)
+	s.expectEvents("EvtMaterialWrittenOff")
+	s.expectMaterials(orgLCD, map[string]uint64{"LCD": 20})
+
+	// 核销的物料不能再通过订单转移
+	order := s.makeOrder(orgTV, "makeMaterialOrder", orgLCD, "LCD", "30", "100")
+	s.shipOrder(orgLCD, order.OrderID)
+	s.mustFail(orgTV, "confirmOrder", order.OrderID)
+	s.mustInvoke(orgTV, "confirmOrder", order.OrderID, "20")
+	s.mustInvoke(orgTV, "writeOffMaterial", "LCD_1", "20", ScrapReasonLost)
+	s.expectMaterials(orgTV, map[string]uint64{})
+
+	var material Material
+	if err := json.Unmarshal(s.mustInvoke(orgLCD, "getMaterialBatch", "LCD_1"), &material); err != nil {
+		t.Fatal(err)
+	}
+	if material.WrittenOff != 300 {
+		t.Fatalf("unexpected material %+v", material)
+	}
+	var writeOffs []WriteOff
+	if err := json.Unmarshal(s.mustInvoke(orgStore, "getWriteOffs", "LCD_1"), &writeOffs); err != nil {
+		t.Fatal(err)
+	}
+	if len(writeOffs) != 2 {
+		t.Fatalf("unexpected write-offs %+v", writeOffs)
+	}
+}
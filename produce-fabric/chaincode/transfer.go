@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxMemoLength 转账和提现备注的最大字符数
+const maxMemoLength = 256
+
+// 提现申请的状态
+const (
+	WithdrawalPending  = "pending"  // 已申请，资金已冻结
+	WithdrawalApproved = "approved" // payment已批准，资金已销毁，在链下兑付
+	WithdrawalRejected = "rejected" // payment已拒绝，资金已退回
+)
+
+// Withdrawal 提现申请，申请时从账户中冻结资金，由payment批准后销毁或者拒绝后退回
+type Withdrawal struct {
+	WithdrawalID string     `json:"withdrawalID"`
+	Org          string     `json:"org"`     //申请的组织
+	Account      string     `json:"account"` //冻结资金的账户，按身份记账时为成员个人账户
+	Amount       Amount     `json:"amount"`
+	Memo         string     `json:"memo,omitempty"`
+	Status       string     `json:"status"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ProcessedBy  string     `json:"processedBy,omitempty"` //批准或拒绝的组织
+	ProcessedAt  *time.Time `json:"processedAt,omitempty"`
+	Reference    string     `json:"reference,omitempty"` //批准时为链下兑付的凭证号，拒绝时为原因
+}
+
+// transfer 从调用者的账户向其他账户转账，参数 [to, amount, memo]，to必须是已知的组织或其成员账户。
+// 按身份记账时从成员个人账户转出，与下单一样检查成员的角色和限额
+func (c *Contract) transfer(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("invalid arguments")
+	}
+	to := args[0]
+	amount, err := parsePositiveAmount(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	memo, err := parseMemo(args[2:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if to == "" || to == caller.Account {
+		return shim.Error(fmt.Sprintf("invalid receiver, got %s", to))
+	}
+	if err := checkReceiver(stub, to); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := caller.checkSpend(amount); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := transfer(stub, caller.Account, to, amount); err != nil {
+		return shim.Error(fmt.Sprintf("failed to transfer %v", err))
+	}
+	evtData, err := json.Marshal(map[string]interface{}{
+		"txID":   stub.GetTxID(),
+		"from":   caller.Account,
+		"to":     to,
+		"amount": amount,
+		"memo":   memo,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal event data %v", err))
+	}
+	if err := stub.SetEvent("EvtTransfer", evtData); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// checkReceiver 收款方必须是已知的组织，或者按身份记账时已知组织的成员账户 org/id
+func checkReceiver(stub shim.ChaincodeStubInterface, to string) error {
+	org := to
+	if i := strings.IndexByte(to, '/'); i >= 0 {
+		mode, err := getAccountMode(stub)
+		if err != nil {
+			return fmt.Errorf("failed to get account mode %v", err)
+		}
+		if mode != AccountModeIdentity || i == len(to)-1 {
+			return fmt.Errorf("invalid receiver, got %s", to)
+		}
+		org = to[:i]
+	}
+	ok, err := isKnownOrg(stub, org)
+	if err != nil {
+		return fmt.Errorf("failed to get roles %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("unknown receiver %s", to)
+	}
+	return nil
+}
+
+// requestWithdrawal 申请把资金兑付到链下，参数 [amount, memo]，申请的资金立即从账户中冻结，返回申请
+func (c *Contract) requestWithdrawal(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("invalid arguments")
+	}
+	amount, err := parsePositiveAmount(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	memo, err := parseMemo(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := caller.checkSpend(amount); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := reduceBalance(stub, caller.Account, amount); err != nil {
+		return shim.Error(fmt.Sprintf("failed to freeze balance %v", err))
+	}
+	t, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	w := &Withdrawal{
+		WithdrawalID: stub.GetTxID(),
+		Org:          caller.Org,
+		Account:      caller.Account,
+		Amount:       amount,
+		Memo:         memo,
+		CreatedAt:    time.Unix(t.GetSeconds(), 0),
+	}
+	return putWithdrawal(stub, w, WithdrawalPending, "EvtWithdrawalRequested")
+}
+
+// approveWithdrawal payment批准提现申请，参数 [withdrawalID, reference]，冻结的资金被销毁，
+// reference为链下兑付的凭证号
+func (c *Contract) approveWithdrawal(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return processWithdrawal(stub, args, WithdrawalApproved, "EvtWithdrawalApproved")
+}
+
+// rejectWithdrawal payment拒绝提现申请，参数 [withdrawalID, reason]，冻结的资金退回申请的账户
+func (c *Contract) rejectWithdrawal(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return processWithdrawal(stub, args, WithdrawalRejected, "EvtWithdrawalRejected")
+}
+
+func processWithdrawal(stub shim.ChaincodeStubInterface, args []string, status, event string) peer.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("invalid arguments")
+	}
+	role, err := requireRole(stub, RolePayment)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reference, err := parseMemo(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	w, err := getWithdrawal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if w.Status != WithdrawalPending {
+		return shim.Error(fmt.Sprintf("withdrawal(%s) is %s", w.WithdrawalID, w.Status))
+	}
+	if status == WithdrawalRejected {
+		if err := addBalance(stub, w.Account, w.Amount); err != nil {
+			return shim.Error(fmt.Sprintf("failed to return balance %v", err))
+		}
+	}
+	t, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	processedAt := time.Unix(t.GetSeconds(), 0)
+	w.ProcessedBy = role
+	w.ProcessedAt = &processedAt
+	w.Reference = reference
+	return putWithdrawal(stub, w, status, event)
+}
+
+// getWithdrawal 查询提现申请，参数 [withdrawalID]，只有申请的组织和payment可以查询
+func (c *Contract) getWithdrawal(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	w, err := getWithdrawal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	if role != w.Org && !isAuditor(stub, role) {
+		return shim.Error(fmt.Sprintf("permission denied for %s", role))
+	}
+	data, err := json.Marshal(w)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal withdrawal %v", err))
+	}
+	return shim.Success(data)
+}
+
+// listWithdrawals 按状态查询提现申请，参数 [status]，payment可以看到全部申请，其他组织只能看到自己的
+func (c *Contract) listWithdrawals(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("invalid arguments")
+	}
+	switch args[0] {
+	case WithdrawalPending, WithdrawalApproved, WithdrawalRejected:
+	default:
+		return shim.Error(fmt.Sprintf("invalid status, got %s", args[0]))
+	}
+	role, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get role %v", err))
+	}
+	iter, err := stub.GetStateByPartialCompositeKey(PrefixWithdrawalStatus, []string{args[0]})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get state, %v", err))
+	}
+	defer iter.Close()
+	auditor := isAuditor(stub, role)
+	list := []*Withdrawal{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get iter next %v", err))
+		}
+		_, attr, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attr) != 2 {
+			return shim.Error("internal key format wrong")
+		}
+		w, err := getWithdrawal(stub, attr[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if auditor || w.Org == role {
+			list = append(list, w)
+		}
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal response %v", err))
+	}
+	return shim.Success(data)
+}
+
+func getWithdrawal(stub shim.ChaincodeStubInterface, id string) (*Withdrawal, error) {
+	if id == "" {
+		return nil, fmt.Errorf("withdrawalID is empty")
+	}
+	val, err := stub.GetState(fmt.Sprintf("%s-%s", PrefixWithdrawal, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state %v", err)
+	}
+	if len(val) == 0 {
+		return nil, fmt.Errorf("withdrawal(%s) does not exist", id)
+	}
+	var w Withdrawal
+	if err := json.Unmarshal(val, &w); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal withdrawal %v", err)
+	}
+	return &w, nil
+}
+
+// putWithdrawal 保存申请并维护状态索引，发出事件，返回保存的申请
+func putWithdrawal(stub shim.ChaincodeStubInterface, w *Withdrawal, status, event string) peer.Response {
+	if w.Status != "" {
+		oldKey, err := stub.CreateCompositeKey(PrefixWithdrawalStatus, []string{w.Status, w.WithdrawalID})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to create key, %v", err))
+		}
+		if err := stub.DelState(oldKey); err != nil {
+			return shim.Error(fmt.Sprintf("failed to del state %v", err))
+		}
+	}
+	w.Status = status
+	newKey, err := stub.CreateCompositeKey(PrefixWithdrawalStatus, []string{status, w.WithdrawalID})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to create key, %v", err))
+	}
+	if err := stub.PutState(newKey, []byte{1}); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	}
+	val, err := json.Marshal(w)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to marshal withdrawal %v", err))
+	}
+	if err := stub.PutState(fmt.Sprintf("%s-%s", PrefixWithdrawal, w.WithdrawalID), val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state %v", err))
+	}
+	if err := stub.SetEvent(event, val); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event %v", err))
+	}
+	return shim.Success(val)
+}
+
+// parsePositiveAmount 解析大于0的金额
+func parsePositiveAmount(arg string) (Amount, error) {
+	amount, err := ParseAmount(arg)
+	if err != nil || amount.IsZero() {
+		return Amount{}, fmt.Errorf("invalid amount, got %s", arg)
+	}
+	return amount, nil
+}
+
+// parseMemo 解析可选的备注
+func parseMemo(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	if utf8.RuneCountInString(args[0]) > maxMemoLength {
+		return "", fmt.Errorf("memo is too long, max %d characters", maxMemoLength)
+	}
+	return args[0], nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransfer(t *testing.T) {
+	s := setupOrder(t)
+	s.mustFail(orgTV, "transfer", orgLCD, "0")
+	s.mustFail(orgTV, "transfer", orgTV, "10")
+	s.mustFail(orgTV, "transfer", orgLCD, "200000")
+	s.mustFail(orgTV, "transfer", orgLCD, "10", strings.Repeat("x", maxMemoLength+1))
+	// 收款方必须是已知的组织，按组织记账时不能转给成员账户
+	s.mustFail(orgTV, "transfer", "materail.lcd", "10")
+	s.mustFail(orgTV, "transfer", memberAccount(orgLCD, "alice"), "10")
+	s.mustInvoke(orgTV, "transfer", orgLCD, "300", "invoice 2020-05")
+	var evt struct {
+		From   string `json:"from"`
+		To     string `json:"to"`
+		Amount Amount `json:"amount"`
+		Memo   string `json:"memo"`
+	}
+	s.expectEvent("EvtTransfer", &evt)
+	if evt.From != orgTV || evt.To != orgLCD || evt.Amount.Cmp(NewAmount(300)) != 0 || evt.Memo != "invoice 2020-05" {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+	s.expectBalance(orgTV, 99700)
+	s.expectBalance(orgLCD, 300)
+}
+
+func TestWithdrawal(t *testing.T) {
+	s := setupOrder(t)
+	request := func(amount string) *Withdrawal {
+		t.Helper()
+		var w Withdrawal
+		if err := json.Unmarshal(s.mustInvoke(orgTV, "requestWithdrawal", amount, "bank account 6222"), &w); err != nil {
+			t.Fatal(err)
+		}
+		return &w
+	}
+	s.mustFail(orgTV, "requestWithdrawal", "200000")
+	w1 := request("1000")
+	s.expectEvents("EvtWithdrawalRequested")
+	w2 := request("2000")
+	s.expectBalance(orgTV, 97000)
+
+	list := func(caller, status string) []*Withdrawal {
+		t.Helper()
+		var list []*Withdrawal
+		if err := json.Unmarshal(s.mustInvoke(caller, "listWithdrawals", status), &list); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	if got := list(orgPayment, WithdrawalPending); len(got) != 2 {
+		t.Fatalf("unexpected withdrawals %+v", got)
+	}
+	if got := list(orgStore, WithdrawalPending); len(got) != 0 {
+		t.Fatalf("unexpected withdrawals %+v", got)
+	}
+	s.mustFail(orgStore, "getWithdrawal", w1.WithdrawalID)
+
+	// 只有payment可以处理，批准后资金销毁，拒绝后退回
+	s.mustFail(orgTV, "approveWithdrawal", w1.WithdrawalID, "")
+	s.mustInvoke(orgPayment, "approveWithdrawal", w1.WithdrawalID, "bank-ref-001")
+	s.expectEvents("EvtWithdrawalApproved")
+	s.mustFail(orgPayment, "rejectWithdrawal", w1.WithdrawalID, "")
+	s.mustInvoke(orgPayment, "rejectWithdrawal", w2.WithdrawalID, "account frozen")
+	s.expectEvents("EvtWithdrawalRejected")
+	s.expectBalance(orgTV, 99000)
+
+	var w Withdrawal
+	if err := json.Unmarshal(s.mustInvoke(orgTV, "getWithdrawal", w1.WithdrawalID), &w); err != nil {
+		t.Fatal(err)
+	}
+	if w.Status != WithdrawalApproved || w.ProcessedBy != orgPayment || w.Reference != "bank-ref-001" || w.ProcessedAt == nil {
+		t.Fatalf("unexpected withdrawal %+v", w)
+	}
+	if got := list(orgTV, WithdrawalRejected); len(got) != 1 || got[0].WithdrawalID != w2.WithdrawalID {
+		t.Fatalf("unexpected withdrawals %+v", got)
+	}
+	if got := list(orgPayment, WithdrawalPending); len(got) != 0 {
+		t.Fatalf("unexpected withdrawals %+v", got)
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
@@ -19,6 +22,31 @@ func bytesToUint64(b []byte) uint64 {
 	return binary.BigEndian.Uint64(b)
 }
 
+// parseTime 解析RFC3339或2006-01-02格式的时间，后者为UTC零点
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// appendUnique 追加list中没有的元素
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, v := range list {
+			if v == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func updateState(stub shim.ChaincodeStubInterface, key string, fn func([]byte) error) error {
 	val, err := stub.GetState(key)
 	if err != nil {
@@ -32,3 +60,37 @@ func updateState(stub shim.ChaincodeStubInterface, key string, fn func([]byte) e
 	}
 	return nil
 }
+
+const (
+	// defaultPageSize 分页查询默认每页条数
+	defaultPageSize = 100
+	// maxPageSize 分页查询每页最大条数
+	maxPageSize = 1000
+)
+
+// Page 分页查询结果，Bookmark为空表示没有下一页
+type Page struct {
+	Records  interface{} `json:"records"`
+	Count    int         `json:"count"`
+	Bookmark string      `json:"bookmark"`
+}
+
+// parsePage 解析分页参数 [pageSize, bookmark]，均可省略
+func parsePage(args []string) (int32, string, error) {
+	if len(args) > 2 {
+		return 0, "", fmt.Errorf("invalid pagination arguments")
+	}
+	pageSize := int64(defaultPageSize)
+	if len(args) > 0 && args[0] != "" {
+		var err error
+		pageSize, err = strconv.ParseInt(args[0], 10, 32)
+		if err != nil || pageSize <= 0 || pageSize > maxPageSize {
+			return 0, "", fmt.Errorf("invalid pageSize, got %s", args[0])
+		}
+	}
+	var bookmark string
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	return int32(pageSize), bookmark, nil
+}
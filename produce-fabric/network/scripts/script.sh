@@ -55,8 +55,10 @@ instantiateChaincode() {
 	CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/lcd.example.com/users/Admin@lcd.example.com/msp
 	echo 
 	echo "===================== Instantiating chaincode ===================== "
-	echo peer chaincode instantiate -o produce-orderer:7050 -C produce-channel -n producecc -l golang -v 1.0 -c '{"Args":["init","123","abc"]}' -P "OR('material.lcd.peer','material.audio.peer','material.cpu.peer','product.tv.peer','product.pc.peer','payment.peer','store.peer')"
-	peer chaincode instantiate -o produce-orderer:7050 -C produce-channel -n producecc -l golang -v 1.0 -c '{"Args":["init","123","abc"]}' -P "OR('material.lcd.peer','material.audio.peer','material.cpu.peer','product.tv.peer','product.pc.peer','payment.peer','store.peer')"
+	# 创世配置: 管理员组织、组织的角色、取消订单的补偿比例和货币小数位数，新增组织时由管理员调用setRole
+	GENESIS='{\"admin\":\"payment\",\"roles\":{\"material.lcd\":[\"material\"],\"material.audio\":[\"material\"],\"material.cpu\":[\"material\"],\"product.tv\":[\"product\"],\"product.pc\":[\"product\"],\"payment\":[\"payment\"],\"store\":[\"store\"]},\"cancelCompensate\":50,\"decimals\":2}'
+	echo peer chaincode instantiate -o produce-orderer:7050 -C produce-channel -n producecc -l golang -v 1.0 -c "{\"Args\":[\"init\",\"$GENESIS\"]}" -P "OR('material.lcd.peer','material.audio.peer','material.cpu.peer','product.tv.peer','product.pc.peer','payment.peer','store.peer')" --collections-config /opt/gopath/src/produce/collections_config.json
+	peer chaincode instantiate -o produce-orderer:7050 -C produce-channel -n producecc -l golang -v 1.0 -c "{\"Args\":[\"init\",\"$GENESIS\"]}" -P "OR('material.lcd.peer','material.audio.peer','material.cpu.peer','product.tv.peer','product.pc.peer','payment.peer','store.peer')" --collections-config /opt/gopath/src/produce/collections_config.json
 	echo "===================== Chaincode instantiated ===================== "
 }
 
@@ -164,6 +166,20 @@ confirmOrder() {
 	echo "===================== Chaincode invoked ===================== "
 }
 
+# orderAction <org> <acceptOrder|rejectOrder|shipOrder> <orderID>
+orderAction() {
+	CORE_PEER_LOCALMSPID=$1
+	CORE_PEER_ADDRESS=${1/./-}:7051
+	CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/${1#*.}.example.com/users/User1@${1#*.}.example.com/msp
+	echo "$2: $3"
+	echo "===================== Invoking chaincode ===================== "
+	echo peer chaincode invoke -o produce-orderer:7050 -C produce-channel --waitForEvent -n producecc -c '{"Args":["'$2'",'$3']}' \
+        --peerAddresses ${1/./-}:7051 
+	peer chaincode invoke -o produce-orderer:7050 -C produce-channel --waitForEvent -n producecc -c '{"Args":["'$2'",'$3']}' \
+        --peerAddresses ${1/./-}:7051 
+	echo "===================== Chaincode invoked ===================== "
+}
+
 cancelOrder() {
 	CORE_PEER_LOCALMSPID=$1
 	CORE_PEER_ADDRESS=${1/./-}:7051
@@ -203,6 +219,26 @@ getMyMaterials() {
 	peer chaincode query -C produce-channel -n producecc -c '{"Args":["getMyMaterials"]}'
 }
 
+listOrders() {
+	CORE_PEER_LOCALMSPID=$1
+	CORE_PEER_ADDRESS=${1/./-}:7051
+	CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/${1#*.}.example.com/users/User1@${1#*.}.example.com/msp
+	peer chaincode query -C produce-channel -n producecc -c '{"Args":["listOrders","'$2'","'$3'",""]}'
+}
+
+# expireOrders <org> [limit]，任何组织都可以触发超时订单退款
+expireOrders() {
+	CORE_PEER_LOCALMSPID=$1
+	CORE_PEER_ADDRESS=${1/./-}:7051
+	CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/${1#*.}.example.com/users/User1@${1#*.}.example.com/msp
+	echo "===================== Invoking chaincode ===================== "
+	echo peer chaincode invoke -o produce-orderer:7050 -C produce-channel --waitForEvent -n producecc -c '{"Args":["expireOrders","'$2'"]}' \
+        --peerAddresses ${1/./-}:7051 
+	peer chaincode invoke -o produce-orderer:7050 -C produce-channel --waitForEvent -n producecc -c '{"Args":["expireOrders","'$2'"]}' \
+        --peerAddresses ${1/./-}:7051 
+	echo "===================== Chaincode invoked ===================== "
+}
+
 consumeMaterial() {
 	CORE_PEER_LOCALMSPID=$1
 	CORE_PEER_ADDRESS=${1/./-}:7051
@@ -272,6 +308,9 @@ getBalance
 print "store 向 product.tv 下单5个TV"
 makeOrder store product.tv TV 5 3000
 
+print "查看product.tv收到的未完成订单"
+listOrders product.tv producer 0
+
 print "product.tv 向 material.lcd 下单100个LCD"
 makeOrder product.tv material.lcd LCD 100 100
 
@@ -281,6 +320,10 @@ sleep 3
 print "material.lcd 生产完成，将LCD按照生产批号注册上链"
 registerGoods material.lcd LCD 300 LCD_1
 
+print "material.lcd 接单并发货"
+orderAction material.lcd acceptOrder ${ORDER_ID}
+orderAction material.lcd shipOrder ${ORDER_ID}
+
 print "material.lcd 链下交货，product.tv验货后，确认收货"
 confirmOrder product.tv
 
@@ -299,6 +342,10 @@ sleep 3
 print "material.audio 生产完成，将Audio按照生产批号注册上链"
 registerGoods material.audio Audio 300 Audio_1
 
+print "material.audio 接单并发货"
+orderAction material.audio acceptOrder ${ORDER_ID}
+orderAction material.audio shipOrder ${ORDER_ID}
+
 print "material.audio 链下交货，product.tv验货后，确认收货"
 confirmOrder product.tv
 
@@ -317,6 +364,10 @@ sleep 3
 print "material.cpu 生产完成，将CPU按照生产批号注册上链"
 registerGoods material.cpu CPU 300 CPU_1
 
+print "material.cpu 接单并发货"
+orderAction material.cpu acceptOrder ${ORDER_ID}
+orderAction material.cpu shipOrder ${ORDER_ID}
+
 print "material.audio 链下交货，product.tv验货后，确认收货"
 confirmOrder product.tv
 
@@ -341,6 +392,10 @@ registerGoods product.tv TV TV_3 2020-05 LCD_1 Audio_1 CPU_1
 registerGoods product.tv TV TV_4 2020-05 LCD_1 Audio_1 CPU_1
 registerGoods product.tv TV TV_5 2020-05 LCD_1 Audio_1 CPU_1
 
+print "product.tv 接单并发货"
+orderAction product.tv acceptOrder ${TV_ORDER_ID}
+orderAction product.tv shipOrder ${TV_ORDER_ID}
+
 print "product.tv 链下交货，store收货后，在链上确认收货"
 confirmOrder store
 
@@ -359,7 +414,10 @@ makeOrder store product.pc PC 2 5000
 print "查看balance"
 getBalance
 
-print "store 取消订单"
+print "product.pc 接单"
+orderAction product.pc acceptOrder ${ORDER_ID}
+
+print "store 在product.pc接单后取消订单，需要补偿product.pc"
 cancelOrder store
 
 print "查看balance"
@@ -377,6 +435,9 @@ cancelOrder product.pc
 print "查看balance"
 getBalance
 
+print "store 触发超时订单退款"
+expireOrders store 100
+
 echo
 echo "========= produce network sample setup completed =========== "
 echo